@@ -24,6 +24,7 @@ func New(port string) *APIServer {
 }
 
 func (a *APIServer) Init(router http.Handler) {
+	// streaming handlers lift the WriteTimeout for their own connection, see controllers/stream.go
 	server := http.Server{
 		Addr:         fmt.Sprintf(":%s", a.address),
 		Handler:      middleware.Logger(router),
@@ -59,6 +60,11 @@ func (a *APIServer) Init(router http.Handler) {
 		stop()
 	}
 
-	server.Shutdown(context.Background())
+	// event streams never finish on their own, they are cut off once the grace period is over
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
 	return
 }
@@ -0,0 +1,70 @@
+package collab
+
+import "errors"
+
+var (
+	ErrInvalidRevision = errors.New("Revision is ahead of the document")
+	// ErrStaleRevision means the operation is older than the history the document keeps,
+	// the client has to load the document again.
+	ErrStaleRevision = errors.New("Revision is too old, reload the document")
+)
+
+// maxHistory is how many operations a client can fall behind before it has to reload.
+const maxHistory = 500
+
+// Document is the server's copy of a document being edited, it isn't safe for concurrent
+// use.
+type Document struct {
+	Text     string
+	Revision int
+	// history holds the operations that produced revisions base+1 to Revision.
+	history []Op
+	base    int
+}
+
+func NewDocument(text string) *Document {
+	return &Document{Text: text}
+}
+
+// Apply takes an operation a client made at revision, transforms it over everything that
+// happened since and applies it. The transformed operation is what the other clients need.
+func (d *Document) Apply(revision int, op Op) (Op, error) {
+	if revision < 0 || revision > d.Revision {
+		return nil, ErrInvalidRevision
+	}
+	if revision < d.base {
+		return nil, ErrStaleRevision
+	}
+
+	var err error
+	for _, concurrent := range d.history[revision-d.base:] {
+		if op, _, err = Transform(op, concurrent); err != nil {
+			return nil, err
+		}
+	}
+
+	text, err := Apply(d.Text, op)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Text = text
+	d.Revision++
+	d.history = append(d.history, op)
+	if len(d.history) > maxHistory {
+		drop := len(d.history) - maxHistory
+		d.history = append([]Op{}, d.history[drop:]...)
+		d.base += drop
+	}
+	return op, nil
+}
+
+// Reset replaces the text with one that changed outside of the operations, such as a
+// regular update of the snippet. It counts as a revision and operations made before it
+// are stale, their clients have to load the document again.
+func (d *Document) Reset(text string) {
+	d.Text = text
+	d.Revision++
+	d.history = nil
+	d.base = d.Revision
+}
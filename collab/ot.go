@@ -0,0 +1,252 @@
+// Package collab merges concurrent edits to a snippet with operational transformation.
+// Operations use the JSON format of ot.js: a positive number retains that many characters,
+// a negative number deletes that many and a string inserts itself. Lengths count Unicode
+// code points.
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+var ErrLengthMismatch = errors.New("Operation doesn't match the length of the document")
+
+// Component is one step of an operation, exactly one of its fields is set.
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// Op walks over the whole document, retaining, inserting and deleting as it goes.
+type Op []Component
+
+func (o Op) Retain(n int) Op {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Retain > 0 {
+		o[last].Retain += n
+		return o
+	}
+	return append(o, Component{Retain: n})
+}
+
+// Insert keeps inserts ahead of a delete at the same position so equal operations always
+// look the same.
+func (o Op) Insert(s string) Op {
+	if s == "" {
+		return o
+	}
+	last := len(o) - 1
+	if last >= 0 && o[last].Insert != "" {
+		o[last].Insert += s
+		return o
+	}
+	if last >= 0 && o[last].Delete > 0 {
+		if last > 0 && o[last-1].Insert != "" {
+			o[last-1].Insert += s
+			return o
+		}
+		o = append(o, o[last])
+		o[last] = Component{Insert: s}
+		return o
+	}
+	return append(o, Component{Insert: s})
+}
+
+func (o Op) Delete(n int) Op {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Delete > 0 {
+		o[last].Delete += n
+		return o
+	}
+	return append(o, Component{Delete: n})
+}
+
+// BaseLen is the length of the document the operation applies to.
+func (o Op) BaseLen() int {
+	n := 0
+	for _, c := range o {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// TargetLen is the length of the document once the operation is applied.
+func (o Op) TargetLen() int {
+	n := 0
+	for _, c := range o {
+		n += c.Retain + utf8.RuneCountInString(c.Insert)
+	}
+	return n
+}
+
+func (o Op) MarshalJSON() ([]byte, error) {
+	out := make([]any, 0, len(o))
+	for _, c := range o {
+		switch {
+		case c.Insert != "":
+			out = append(out, c.Insert)
+		case c.Delete > 0:
+			out = append(out, -c.Delete)
+		default:
+			out = append(out, c.Retain)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (o *Op) UnmarshalJSON(b []byte) error {
+	var raw []any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	op := Op{}
+	for _, v := range raw {
+		switch v := v.(type) {
+		case string:
+			op = op.Insert(v)
+		case float64:
+			if v != float64(int(v)) || v == 0 {
+				return fmt.Errorf("invalid operation component %v", v)
+			}
+			if v > 0 {
+				op = op.Retain(int(v))
+			} else {
+				op = op.Delete(int(-v))
+			}
+		default:
+			return fmt.Errorf("invalid operation component %v", v)
+		}
+	}
+	*o = op
+	return nil
+}
+
+// Apply runs op over doc.
+func Apply(doc string, op Op) (string, error) {
+	runes := []rune(doc)
+	if op.BaseLen() != len(runes) {
+		return "", ErrLengthMismatch
+	}
+
+	out := make([]rune, 0, op.TargetLen())
+	i := 0
+	for _, c := range op {
+		switch {
+		case c.Insert != "":
+			out = append(out, []rune(c.Insert)...)
+		case c.Delete > 0:
+			i += c.Delete
+		default:
+			out = append(out, runes[i:i+c.Retain]...)
+			i += c.Retain
+		}
+	}
+	return string(out), nil
+}
+
+// Transform takes two operations made concurrently on the same document and returns a'
+// and b' such that applying a then b' gives the same document as b then a'. When both
+// insert at the same position the insert of a goes first.
+func Transform(a, b Op) (Op, Op, error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, ErrLengthMismatch
+	}
+
+	a1, b1 := Op{}, Op{}
+	ia, ib := 0, 0
+	var ca, cb *Component
+	next := func(op Op, i *int) *Component {
+		if *i >= len(op) {
+			return nil
+		}
+		c := op[*i]
+		*i++
+		return &c
+	}
+	ca, cb = next(a, &ia), next(b, &ib)
+
+	for ca != nil || cb != nil {
+		if ca != nil && ca.Insert != "" {
+			a1 = a1.Insert(ca.Insert)
+			b1 = b1.Retain(utf8.RuneCountInString(ca.Insert))
+			ca = next(a, &ia)
+			continue
+		}
+		if cb != nil && cb.Insert != "" {
+			a1 = a1.Retain(utf8.RuneCountInString(cb.Insert))
+			b1 = b1.Insert(cb.Insert)
+			cb = next(b, &ib)
+			continue
+		}
+		if ca == nil || cb == nil {
+			return nil, nil, ErrLengthMismatch
+		}
+
+		lenA, lenB := ca.Retain+ca.Delete, cb.Retain+cb.Delete
+		n := min(lenA, lenB)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			a1, b1 = a1.Retain(n), b1.Retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			a1 = a1.Delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			b1 = b1.Delete(n)
+		}
+		// both deleting the same range leaves nothing for either to do
+
+		ca, cb = shorten(ca, n), shorten(cb, n)
+		if ca == nil {
+			ca = next(a, &ia)
+		}
+		if cb == nil {
+			cb = next(b, &ib)
+		}
+	}
+
+	return a1, b1, nil
+}
+
+// shorten drops the first n characters of a retain or delete, nil means it is used up.
+func shorten(c *Component, n int) *Component {
+	if c.Retain > 0 {
+		c.Retain -= n
+		if c.Retain == 0 {
+			return nil
+		}
+		return c
+	}
+	c.Delete -= n
+	if c.Delete == 0 {
+		return nil
+	}
+	return c
+}
+
+// TransformIndex moves a cursor position over op, text inserted at the cursor pushes it
+// forward.
+func TransformIndex(pos int, op Op) int {
+	index, newPos := 0, pos
+	for _, c := range op {
+		if index > pos {
+			break
+		}
+		switch {
+		case c.Insert != "":
+			newPos += utf8.RuneCountInString(c.Insert)
+		case c.Delete > 0:
+			newPos -= min(pos-index, c.Delete)
+			index += c.Delete
+		default:
+			index += c.Retain
+		}
+	}
+	return newPos
+}
@@ -0,0 +1,143 @@
+package collab
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestApply(t *testing.T) {
+	op := Op{}.Retain(6).Insert("brave ").Retain(5).Delete(1)
+	got, err := Apply("hello world!", op)
+	if err != nil || got != "hello brave world" {
+		t.Fatalf("expected %q, got %q %v", "hello brave world", got, err)
+	}
+
+	if _, err = Apply("short", op); err != ErrLengthMismatch {
+		t.Errorf("expected a length mismatch, got %v", err)
+	}
+}
+
+func TestOpJSON(t *testing.T) {
+	var op Op
+	if err := json.Unmarshal([]byte(`[3, "héllo", -2, 1]`), &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.BaseLen() != 6 || op.TargetLen() != 9 {
+		t.Errorf("unexpected lengths %d %d", op.BaseLen(), op.TargetLen())
+	}
+
+	b, _ := json.Marshal(op)
+	if string(b) != `[3,"héllo",-2,1]` {
+		t.Errorf("unexpected encoding %s", b)
+	}
+
+	if err := json.Unmarshal([]byte(`[1.5]`), &op); err == nil {
+		t.Error("expected fractional components to be rejected")
+	}
+}
+
+// randomOp makes an operation over doc out of random retains, inserts and deletes.
+func randomOp(r *rand.Rand, doc string) Op {
+	op := Op{}
+	left := utf8.RuneCountInString(doc)
+	for left > 0 {
+		n := 1 + r.Intn(min(left, 5))
+		switch r.Intn(3) {
+		case 0:
+			op = op.Retain(n)
+			left -= n
+		case 1:
+			op = op.Delete(n)
+			left -= n
+		default:
+			op = op.Insert([]string{"a", "bc", "é", "\n", "xyz"}[r.Intn(5)])
+		}
+	}
+	if r.Intn(2) == 0 {
+		op = op.Insert("end")
+	}
+	return op
+}
+
+func TestTransformConverges(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		doc := []string{"", "hello world", "func main() {\n\tprintln(\"é\")\n}"}[i%3]
+		a, b := randomOp(r, doc), randomOp(r, doc)
+
+		a1, b1, err := Transform(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ab, err := Apply(doc, a)
+		if err == nil {
+			ab, err = Apply(ab, b1)
+		}
+		ba, err2 := Apply(doc, b)
+		if err2 == nil {
+			ba, err2 = Apply(ba, a1)
+		}
+		if err != nil || err2 != nil || ab != ba {
+			t.Fatalf("%q diverged with %v and %v: %q %v, %q %v", doc, a, b, ab, err, ba, err2)
+		}
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	op := Op{}.Retain(2).Insert("xx").Retain(3).Delete(4).Retain(1)
+	for pos, want := range map[int]int{0: 0, 2: 4, 4: 6, 6: 7, 9: 7, 10: 8} {
+		if got := TransformIndex(pos, op); got != want {
+			t.Errorf("cursor at %d: expected %d, got %d", pos, want, got)
+		}
+	}
+}
+
+func TestDocument(t *testing.T) {
+	doc := NewDocument("ab")
+
+	// two clients edit revision 0 at the same time
+	if _, err := doc.Apply(0, Op{}.Insert("x").Retain(2)); err != nil {
+		t.Fatal(err)
+	}
+	op, err := doc.Apply(0, Op{}.Retain(2).Insert("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Text != "xaby" || doc.Revision != 2 || op.BaseLen() != 3 {
+		t.Fatalf("unexpected document %q at %d, op %v", doc.Text, doc.Revision, op)
+	}
+
+	if _, err = doc.Apply(3, Op{}.Retain(4)); err != ErrInvalidRevision {
+		t.Errorf("expected an invalid revision, got %v", err)
+	}
+
+	for i := 0; i < maxHistory+1; i++ {
+		if _, err = doc.Apply(doc.Revision, Op{}.Retain(4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = doc.Apply(0, Op{}.Retain(3)); err != ErrStaleRevision {
+		t.Errorf("expected a stale revision, got %v", err)
+	}
+}
+
+func TestDocumentReset(t *testing.T) {
+	doc := NewDocument("ab")
+	if _, err := doc.Apply(0, Op{}.Retain(2).Insert("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	doc.Reset("xyz")
+	if doc.Text != "xyz" || doc.Revision != 2 {
+		t.Fatalf("unexpected document %q at %d", doc.Text, doc.Revision)
+	}
+	if _, err := doc.Apply(1, Op{}.Retain(3)); err != ErrStaleRevision {
+		t.Errorf("expected an op made before the reset to be stale, got %v", err)
+	}
+	if _, err := doc.Apply(2, Op{}.Retain(3).Insert("!")); err != nil || doc.Text != "xyz!" {
+		t.Errorf("expected an op made after the reset to apply, got %v %q", err, doc.Text)
+	}
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+// languageExtensions names the code files of an export, unknown languages get .txt.
+var languageExtensions = map[string]string{
+	"bash":       ".sh",
+	"c":          ".c",
+	"c++":        ".cpp",
+	"cpp":        ".cpp",
+	"c#":         ".cs",
+	"csharp":     ".cs",
+	"css":        ".css",
+	"go":         ".go",
+	"html":       ".html",
+	"java":       ".java",
+	"javascript": ".js",
+	"json":       ".json",
+	"kotlin":     ".kt",
+	"markdown":   ".md",
+	"php":        ".php",
+	"python":     ".py",
+	"ruby":       ".rb",
+	"rust":       ".rs",
+	"shell":      ".sh",
+	"sql":        ".sql",
+	"swift":      ".swift",
+	"typescript": ".ts",
+	"yaml":       ".yaml",
+}
+
+type AccountController struct {
+	accounts services.AccountStore
+	sessions services.SessionStore
+	cookies  utils.CookieConfig
+	log      *slog.Logger
+}
+
+func NewAccountController(accounts services.AccountStore, sessions services.SessionStore, cookies utils.CookieConfig, log *slog.Logger) *AccountController {
+	return &AccountController{
+		accounts: accounts,
+		sessions: sessions,
+		cookies:  cookies,
+		log:      log,
+	}
+}
+
+// @Summary      Export Account
+// @Description  Download everything stored about the signed in user as a zip archive. account.json holds the profile, identities, tokens, sessions, orgs, snippets, collaborations and reports, and the code of every snippet is also stored as a file under snippets/.
+// @Tags         users
+// @Produce      application/zip
+// @Success      200  {file}    file            "Zip archive"
+// @Failure      401  {object}  utils.Response  "Unauthorized access"
+// @Failure      500  {object}  utils.Response  "Internal server error"
+// @Router       /me/export [get]
+func (a *AccountController) Export(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	export, err := a.accounts.GetExport(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while exporting your account", err, a.log)
+		return
+	}
+
+	sessions, err := a.sessions.GetUserSessions(session.UserID)
+	if err != nil && err != redis.Nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while exporting your sessions", err, a.log)
+		return
+	}
+	export.Sessions = []*types.Session{}
+	if sessions != nil {
+		export.Sessions = *sessions
+	}
+
+	account, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while exporting your account", err, a.log)
+		return
+	}
+
+	filename := fmt.Sprintf("snipnet-%s-%s.zip", export.User.Username, export.ExportedAt.Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	// the status is sent by now, a failure past this point can only cut the archive short
+	archive := zip.NewWriter(w)
+	write := func(name string, data []byte) error {
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	err = write("account.json", account)
+	for _, snippet := range export.Snippets {
+		if err != nil {
+			break
+		}
+		err = write("snippets/"+snippet.ID+codeExtension(snippet.Language), []byte(snippet.Code))
+	}
+	if err != nil {
+		a.log.Error("EXPORT", slog.String("Unable to write the export", err.Error()))
+		return
+	}
+	if err = archive.Close(); err != nil {
+		a.log.Error("EXPORT", slog.String("Unable to write the export", err.Error()))
+	}
+	return
+}
+
+func codeExtension(language string) string {
+	if ext, ok := languageExtensions[strings.ToLower(strings.TrimSpace(language))]; ok {
+		return ext
+	}
+	return ".txt"
+}
+
+// @Summary      Delete Account
+// @Description  Delete the signed in user and sign them out everywhere. With mode=delete all their snippets are deleted, with mode=anonymise their public and org snippets are kept under a ghost account. Orgs the user is the last member of are deleted too.
+// @Tags         users
+// @Produce      json
+// @Param        mode  query     string          true  "delete or anonymise"
+// @Success      200   {object}  utils.Response  "Account deleted"
+// @Failure      400   {object}  utils.Response  "Invalid mode"
+// @Failure      401   {object}  utils.Response  "Unauthorized access"
+// @Failure      409   {object}  utils.Response  "Only owner of an org with other members"
+// @Router       /me [delete]
+func (a *AccountController) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	mode := r.URL.Query().Get("mode")
+	if mode != services.AccountDelete && mode != services.AccountAnonymise {
+		utils.WriteErr(w, http.StatusBadRequest, "mode must be delete or anonymise", errors.New("Invalid mode"), a.log)
+		return
+	}
+
+	err := a.accounts.DeleteAccount(session.UserID, mode)
+	if err == services.ErrSoleOwner {
+		utils.WriteErr(w, http.StatusConflict, "Hand over ownership of your orgs before deleting your account", err, a.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while deleting your account", err, a.log)
+		return
+	}
+
+	// the account is gone already, sessions left behind fail to load their user anyway
+	if err = a.sessions.DeleteUserSessions(session.UserID, ""); err != nil && err != redis.Nil {
+		a.log.Error("DELETE ACCOUNT", slog.String("Unable to revoke sessions", err.Error()))
+	}
+
+	if a.cookies.Enabled {
+		a.cookies.ClearSession(w)
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Account deleted", "", a.log)
+	return
+}
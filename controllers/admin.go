@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type AdminController struct {
+	users    services.UserStore
+	sessions services.SessionStore
+	log      *slog.Logger
+}
+
+func NewAdminController(users services.UserStore, sessions services.SessionStore, log *slog.Logger) *AdminController {
+	return &AdminController{
+		users:    users,
+		sessions: sessions,
+		log:      log,
+	}
+}
+
+// @Summary      List Users
+// @Description  List every user account. Admins only.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  services.User   "List of users"
+// @Failure      401   {object} utils.Response  "Unauthorized access"
+// @Failure      403   {object} utils.Response  "Not an admin"
+// @Failure      500   {object} utils.Response  "Internal server error"
+// @Router       /admin/users [get]
+func (a *AdminController) GetUsers(w http.ResponseWriter, r *http.Request) {
+	page := r.URL.Query().Get("page")
+	var offset int
+	limit := 50
+	if p, err := strconv.Atoi(page); err != nil || p <= 0 {
+		offset = 0
+	} else {
+		offset = (p - 1) * limit
+	}
+
+	users, err := a.users.GetUsers(offset, limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching users", err, a.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Users found", users, a.log)
+	return
+}
+
+// @Summary      Change User Role
+// @Description  Change the role of a user to user, moderator or admin. Admins only.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id    path     string               true  "User ID"
+// @Param        body  body     types.UpdateRoleBody true  "New role"
+// @Success      200   {object} services.User        "Updated user"
+// @Failure      400   {object} utils.Response       "Invalid role"
+// @Failure      401   {object} utils.Response       "Unauthorized access"
+// @Failure      403   {object} utils.Response       "Not an admin"
+// @Failure      404   {object} utils.Response       "User not found"
+// @Router       /admin/users/{id}/role [patch]
+func (a *AdminController) UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	var body types.UpdateRoleBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, a.log)
+		return
+	}
+
+	if !policy.ValidRole(body.Role) {
+		utils.WriteErr(w, http.StatusBadRequest, "Role must be one of user, moderator or admin", errors.New("Invalid role"), a.log)
+		return
+	}
+
+	// stops the last admin from locking everyone out by accident
+	if id == session.UserID {
+		utils.WriteErr(w, http.StatusBadRequest, "You can't change your own role", errors.New("Invalid user"), a.log)
+		return
+	}
+
+	user, err := a.users.UpdateUserRole(id, body.Role)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User with id %s not found", id), err, a.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "User role updated", user, a.log)
+	return
+}
+
+// @Summary      Suspend User
+// @Description  Suspend a user account and sign it out everywhere. Admins only.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id   path     string  true  "User ID"
+// @Success      200  {object} services.User   "Suspended user"
+// @Failure      400  {object} utils.Response  "Invalid user"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      403  {object} utils.Response  "Not an admin"
+// @Failure      404  {object} utils.Response  "User not found"
+// @Router       /admin/users/{id}/suspend [post]
+func (a *AdminController) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	if id == session.UserID {
+		utils.WriteErr(w, http.StatusBadRequest, "You can't suspend your own account", errors.New("Invalid user"), a.log)
+		return
+	}
+
+	user, err := a.users.SetUserSuspended(id, true)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User with id %s not found", id), err, a.log)
+		return
+	}
+
+	// suspended users are rejected on every request anyway, this just cleans up their sessions
+	if err = a.sessions.DeleteUserSessions(id, ""); err != nil {
+		a.log.Error("ADMIN", slog.String("Unable to revoke sessions", err.Error()))
+	}
+
+	utils.WriteRes(w, http.StatusOK, "User suspended", user, a.log)
+	return
+}
+
+// @Summary      Unsuspend User
+// @Description  Lift the suspension of a user account. Admins only.
+// @Tags         admin
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id   path     string  true  "User ID"
+// @Success      200  {object} services.User   "Reinstated user"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      403  {object} utils.Response  "Not an admin"
+// @Failure      404  {object} utils.Response  "User not found"
+// @Router       /admin/users/{id}/suspend [delete]
+func (a *AdminController) UnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	user, err := a.users.SetUserSuspended(id, false)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User with id %s not found", id), err, a.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "User reinstated", user, a.log)
+	return
+}
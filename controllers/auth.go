@@ -2,10 +2,13 @@ package controllers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,138 +17,449 @@ import (
 
 	utils "snipnet/controllers/responseutils"
 	"snipnet/services"
+	"snipnet/services/oauth"
 	"snipnet/types"
 )
 
-const (
-	SessionMaxAge = 259200
-)
+// oauthStateTTL is how long a user has to finish signing in with the provider.
+const oauthStateTTL = time.Minute * 10
 
-var ctx = context.Background()
+// maxUsernameAttempts is how many usernames based on the one at the identity provider are
+// tried for a new account, before falling back to a random suffix.
+const maxUsernameAttempts = 5
 
 type AuthController struct {
 	users       services.UserStore
-	oauthConfig *oauth2.Config
-	log         *slog.Logger
+	sessions    services.SessionStore
+	providers   oauth.Providers
 	cache       *redis.Client
+	frontendURL string
+	cookies     utils.CookieConfig
+	log         *slog.Logger
+}
+
+// oauthState is kept under the state passed to the provider. UserID is set for states
+// issued to link an identity, only that user can complete the link.
+type oauthState struct {
+	Provider string `json:"provider"`
+	Verifier string `json:"verifier"`
+	UserID   string `json:"user_id,omitempty"`
 }
 
 func NewAuthController(
 	users services.UserStore,
-	oauthConfig *oauth2.Config,
-	log *slog.Logger,
+	sessions services.SessionStore,
+	providers oauth.Providers,
 	rds *redis.Client,
+	frontendURL string,
+	cookies utils.CookieConfig,
+	log *slog.Logger,
 ) *AuthController {
 	return &AuthController{
 		users:       users,
-		oauthConfig: oauthConfig,
-		log:         log,
+		sessions:    sessions,
+		providers:   providers,
 		cache:       rds,
+		frontendURL: frontendURL,
+		cookies:     cookies,
+		log:         log,
 	}
 }
 
-// @Summary      Sign In
-// @Description  Sign in using GitHub OAuth. Exchange the authorization code for a user session.
+// @Summary      OAuth Login
+// @Description  Start signing in with an identity provider. Redirects to the provider with a fresh state and PKCE challenge.
+// @Description  With link=true the state is issued to the signed in user to link the identity to their account instead, the callback then passes the code and state on to the frontend for POST /me/identities.
 // @Tags         auth
-// @Accept       json
-// @Produce      json
-// @Param        code  query    string  true  "Authorization code from the OAuth session"
-// @Success      200   {object} services.User       "Authenticated user details"
-// @Failure      400   {object} utils.Response      "Invalid or missing authorization code"
-// @Failure      500   {object} utils.Response      "Internal server error"
-// @Router       /signin [post]
-func (a *AuthController) GitHubOauth(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	token, err := a.oauthConfig.Exchange(r.Context(), code)
+// @Security     ApiKeyAuth
+// @Param        provider  path   string  true   "Identity provider, e.g github"
+// @Param        link      query  bool    false  "Link the identity to the signed in user"
+// @Success      302  "Redirect to the identity provider"
+// @Failure      400  {object} utils.Response  "Unknown identity provider"
+// @Failure      401  {object} utils.Response  "Linking without being signed in"
+// @Failure      403  {object} utils.Response  "Linking with a token without the user:write scope"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /auth/{provider}/login [get]
+func (a *AuthController) OauthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := a.providers.Get(r.PathValue("provider"))
 	if err != nil {
-		utils.WriteErr(w, http.StatusBadRequest, "Invalid Code", err, a.log)
+		utils.WriteErr(w, http.StatusBadRequest, "Unknown identity provider", err, a.log)
 		return
 	}
 
-	ghUser, err := fetchGHUser(token.AccessToken)
+	state := uuid.NewString()
+	verifier := oauth2.GenerateVerifier()
+	issued := oauthState{Provider: provider.Name(), Verifier: verifier}
+	if r.URL.Query().Get("link") == "true" {
+		session, ok := r.Context().Value(types.AuthSession).(types.Session)
+		if !ok {
+			utils.WriteErr(w, http.StatusUnauthorized, "Sign in to link an identity",
+				errors.New("Linking an identity without a session"), a.log)
+			return
+		}
+		if !session.HasScope(types.ScopeUserWrite) {
+			utils.WriteErr(w, http.StatusForbidden, "Linking an identity needs the user:write scope",
+				fmt.Errorf("Missing scope %s", types.ScopeUserWrite), a.log)
+			return
+		}
+		issued.UserID = session.UserID
+	}
+	val, err := json.Marshal(issued)
 	if err != nil {
-		utils.WriteErr(w, http.StatusInternalServerError, "Invalid Code", err, a.log)
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to start signing in", err, a.log)
 		return
 	}
 
-	user, err := a.users.GetUser("oauth_id", string(ghUser.ID))
+	err = a.cache.Set(r.Context(), "oauth_state:"+state, val, oauthStateTTL).Err()
 	if err != nil {
-		id := uuid.NewString()
-		user, err = a.users.CreateUser(id, &ghUser)
-		if err != nil {
-			utils.WriteErr(
-				w,
-				http.StatusInternalServerError,
-				"An error occured while creating the user resource",
-				err,
-				a.log,
-			)
-			return
-		}
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to start signing in", err, a.log)
+		return
 	}
 
-	session_id, err := a.createSession(user.ID)
+	http.Redirect(w, r, provider.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+	return
+}
+
+// @Summary      OAuth Callback
+// @Description  Complete signing in with an identity provider. Validates the state and PKCE verifier, creates a session and redirects to the frontend.
+// @Description  With cookie sessions enabled the session is set as a cookie, otherwise the tokens are passed in the URL fragment.
+// @Description  An identity whose email belongs to another account is refused with error=account_exists, the account holder has to sign in and link it with login?link=true.
+// @Tags         auth
+// @Param        provider  path   string  true   "Identity provider, e.g github"
+// @Param        state     query  string  true   "State issued by the login endpoint"
+// @Param        code      query  string  true   "Authorization code from the provider"
+// @Success      302  "Redirect to the frontend, errors are passed along in the error query parameter"
+// @Router       /auth/{provider}/callback [get]
+func (a *AuthController) OauthCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	key := "oauth_state:" + query.Get("state")
+	val, err := a.cache.Get(r.Context(), key).Result()
 	if err != nil {
-		utils.WriteErr(
-			w,
-			http.StatusInternalServerError,
-			"An error occured while creating a new session",
-			err,
-			a.log,
-		)
+		a.log.Error("AUTH", slog.String("Invalid oauth state", err.Error()))
+		a.redirectErr(w, r, "invalid_state")
+		return
+	}
+
+	var state oauthState
+	if err = json.Unmarshal([]byte(val), &state); err != nil || state.Provider != r.PathValue("provider") {
+		a.redirectErr(w, r, "invalid_state")
+		return
+	}
+
+	if e := query.Get("error"); e != "" {
+		a.redirectErr(w, r, e)
+		return
+	}
+
+	// a link is completed by its user with POST /me/identities, which uses up the state
+	if state.UserID != "" {
+		link := url.Values{}
+		link.Set("provider", state.Provider)
+		link.Set("code", query.Get("code"))
+		link.Set("state", query.Get("state"))
+		http.Redirect(w, r, a.frontendURL+"?"+link.Encode(), http.StatusFound)
+		return
+	}
+
+	// states are single use, a replayed callback finds nothing
+	if n, err := a.cache.Del(r.Context(), key).Result(); err != nil || n == 0 {
+		a.redirectErr(w, r, "invalid_state")
+		return
+	}
+
+	identity, _, err := a.exchangeCode(r.Context(), state.Provider, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		a.log.Error("AUTH", slog.String("Unable to exchange code", err.Error()))
+		a.redirectErr(w, r, "invalid_code")
 		return
 	}
 
-	user.AuthToken = session_id
-	utils.WriteRes(w, http.StatusOK, "Account signed-in successfully", user, a.log)
+	user, err := a.findOrCreateUser(identity)
+	if err == services.ErrEmailTaken {
+		a.redirectErr(w, r, "account_exists")
+		return
+	}
+	if err != nil {
+		a.log.Error("AUTH", slog.String("Unable to create user", err.Error()))
+		a.redirectErr(w, r, "server_error")
+		return
+	}
+
+	session, err := a.sessions.CreateSession(user.ID, r.UserAgent(), utils.ClientIP(r))
+	if err != nil {
+		a.log.Error("AUTH", slog.String("Unable to create session", err.Error()))
+		a.redirectErr(w, r, "server_error")
+		return
+	}
+
+	if a.cookies.Enabled {
+		a.cookies.SetSession(w, session.SessionID, session.RefreshToken, session.ExpiryTime)
+		http.Redirect(w, r, a.frontendURL, http.StatusFound)
+		return
+	}
+
+	// the fragment never reaches a server, so tokens don't end up in access logs
+	fragment := url.Values{}
+	fragment.Set("auth_token", session.SessionID)
+	fragment.Set("refresh_token", session.RefreshToken)
+	http.Redirect(w, r, a.frontendURL+"#"+fragment.Encode(), http.StatusFound)
 	return
 }
 
-func (a *AuthController) createSession(userId string) (string, error) {
-	session_id := utils.GenerateSessionID()
-	session, err := json.Marshal(types.Session{
-		UserID:     userId,
-		SessionID:  session_id,
-		CreatedAt:  time.Now(),
-		ExpiryTime: time.Now().Add(time.Hour * 24 * 7),
-	})
+func (a *AuthController) redirectErr(w http.ResponseWriter, r *http.Request, reason string) {
+	http.Redirect(w, r, a.frontendURL+"?error="+url.QueryEscape(reason), http.StatusFound)
+}
+
+// exchangeCode trades an authorization code for the identity it belongs to.
+func (a *AuthController) exchangeCode(
+	ctx context.Context,
+	name, code string,
+	opts ...oauth2.AuthCodeOption,
+) (*types.Identity, int, error) {
+	provider, err := a.providers.Get(name)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	token, err := provider.Exchange(ctx, code, opts...)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	identity, err := provider.FetchIdentity(ctx, token)
 	if err != nil {
-		return "", err
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return identity, http.StatusOK, nil
+}
+
+func (a *AuthController) findOrCreateUser(identity *types.Identity) (*services.User, error) {
+	user, err := a.users.GetUserByIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// GitHub accounts created before identities existed have none linked yet
+	if identity.Provider == "github" && identity.Email != "" {
+		user, err = a.users.GetUser("email", identity.Email)
+		if err == nil {
+			identities, err := a.users.GetIdentities(user.ID)
+			if err != nil {
+				return nil, err
+			}
+			if len(*identities) == 0 {
+				_, err = a.users.LinkIdentity(user.ID, identity)
+				if err != nil {
+					return nil, err
+				}
+				return user, nil
+			}
+		}
 	}
 
-	err = a.cache.Set(ctx, session_id, session, time.Second*640800).Err()
+	if identity.Email == "" {
+		return nil, fmt.Errorf("%s did not share an email address", identity.Provider)
+	}
+
+	// the account with this email has to link the identity itself, from a signed in session
+	if _, err = a.users.GetUser("email", identity.Email); err == nil {
+		return nil, services.ErrEmailTaken
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// the username at the provider can be taken here, the fallbacks can be too
+	username := identity.Username
+	candidates := []string{username, fmt.Sprintf("%s-%s", username, identity.Provider)}
+	for i := 2; i < maxUsernameAttempts; i++ {
+		candidates = append(candidates, fmt.Sprintf("%s-%s-%d", username, identity.Provider, i))
+	}
+	candidates = append(candidates, fmt.Sprintf("%s-%s", username, uuid.NewString()[:8]))
+
+	for _, candidate := range candidates {
+		if _, err = a.users.GetUser("username", candidate); err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		identity.Username = candidate
+		user, err = a.users.CreateUser(uuid.NewString(), identity)
+		// taken by a sign up that got there first
+		if err == services.ErrUsernameTaken {
+			continue
+		}
+		return user, err
+	}
+	return nil, services.ErrUsernameTaken
+}
+
+// @Summary      List Identities
+// @Description  List the identity providers linked to the current user.
+// @Tags         auth
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200  {array}  types.Identity  "Linked identities"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /me/identities [get]
+func (a *AuthController) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	identities, err := a.users.GetIdentities(session.UserID)
 	if err != nil {
-		return "", err
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching identities", err, a.log)
+		return
 	}
 
-	return session_id, nil
+	utils.WriteRes(w, http.StatusOK, "Identities found", identities, a.log)
+	return
 }
 
-func fetchGHUser(accessToken string) (types.GHUser, error) {
-	req, err := http.NewRequest(http.MethodGet, "https://api.github.com/user", nil)
+// @Summary      Link Identity
+// @Description  Link another identity provider account to the current user. The code and state are the ones the callback passed on after GET /auth/{provider}/login?link=true.
+// @Tags         auth
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        code      query    string  true  "Authorization code from the OAuth session"
+// @Param        provider  query    string  true  "Identity provider the code was issued by"
+// @Param        state     query    string  true  "State issued by the login endpoint"
+// @Success      201  {object} types.Identity  "Linked identity"
+// @Failure      400  {object} utils.Response  "Invalid state or authorization code"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      409  {object} utils.Response  "Identity already linked to an account"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /me/identities [post]
+func (a *AuthController) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	query := r.URL.Query()
+
+	// states are single use, and only the user they were issued to can use them
+	val, err := a.cache.GetDel(r.Context(), "oauth_state:"+query.Get("state")).Result()
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "Invalid state", err, a.log)
+		return
+	}
+	var state oauthState
+	if err = json.Unmarshal([]byte(val), &state); err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "Invalid state", err, a.log)
+		return
+	}
+	if state.UserID != session.UserID || state.Provider != query.Get("provider") {
+		utils.WriteErr(w, http.StatusBadRequest, "Invalid state",
+			errors.New("State issued to another user or provider"), a.log)
+		return
+	}
+
+	identity, status, err := a.exchangeCode(r.Context(), state.Provider, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		utils.WriteErr(w, status, "Invalid Code", err, a.log)
+		return
+	}
+
+	if _, err = a.users.GetUserByIdentity(identity.Provider, identity.Subject); err == nil {
+		utils.WriteErr(
+			w,
+			http.StatusConflict,
+			"This account is already linked to a Snipnet user",
+			errors.New("Identity already linked"),
+			a.log,
+		)
+		return
+	}
+
+	linked, err := a.users.LinkIdentity(session.UserID, identity)
 	if err != nil {
-		return types.GHUser{}, nil
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while linking the identity", err, a.log)
+		return
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-	req.Header.Set("Accept", "application/vnd.github+json")
 
-	resp, err := http.DefaultClient.Do(req)
+	utils.WriteRes(w, http.StatusCreated, "Identity linked", linked, a.log)
+	return
+}
+
+// @Summary      Unlink Identity
+// @Description  Unlink an identity provider account. The last identity of a user can't be unlinked.
+// @Tags         auth
+// @Security     ApiKeyAuth
+// @Param        id   path     string  true  "Identity ID to be unlinked"
+// @Success      204  "Identity unlinked, no content returned"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "Identity not found or it is the last one"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /me/identities/{id} [delete]
+func (a *AuthController) DeleteIdentity(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	err := a.users.DeleteIdentity(id, session.UserID)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, "Identity not found or it is your only sign-in method", err, a.log)
+		return
+	}
 	if err != nil {
-		return types.GHUser{}, nil
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while unlinking the identity", err, a.log)
+		return
 	}
 
-	defer resp.Body.Close()
-	var respBody types.GHUser
-	if resp.Body == nil {
-		return types.GHUser{}, err
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Refresh Session
+// @Description  Exchange a refresh token for a new session and refresh token. Each refresh token can only be used once, replaying one signs out every session that descends from the same sign-in.
+// @Description  Browser clients using cookie sessions can omit the body, the refresh cookie is used instead.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body     types.RefreshTokenBody  false  "Refresh token issued at sign-in or by a previous refresh"
+// @Success      200   {object} types.AuthTokens        "New session and refresh tokens"
+// @Failure      400   {object} utils.Response          "Missing refresh token"
+// @Failure      401   {object} utils.Response          "Invalid, expired or reused refresh token"
+// @Failure      500   {object} utils.Response          "Internal server error"
+// @Router       /token/refresh [post]
+func (a *AuthController) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var body types.RefreshTokenBody
+	cookie, err := r.Cookie(utils.RefreshCookie)
+	if a.cookies.Enabled && err == nil {
+		body.RefreshToken = cookie.Value
+	} else if err = utils.ParseJson(r, &body); err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, a.log)
+		return
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	if err = utils.Validate.Struct(body); err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "Missing parameters", err, a.log)
+		return
+	}
+
+	session, err := a.sessions.RefreshSession(body.RefreshToken, r.UserAgent(), utils.ClientIP(r))
+	if err == services.ErrRefreshTokenInvalid || err == services.ErrRefreshTokenReused {
+		if a.cookies.Enabled {
+			a.cookies.ClearSession(w)
+		}
+		utils.WriteErr(w, http.StatusUnauthorized, "Invalid refresh token", err, a.log)
+		return
+	}
 	if err != nil {
-		return types.GHUser{}, err
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while refreshing the session", err, a.log)
+		return
+	}
+
+	if a.cookies.Enabled {
+		a.cookies.SetSession(w, session.SessionID, session.RefreshToken, session.ExpiryTime)
 	}
 
-	return respBody, nil
+	utils.WriteRes(w, http.StatusOK, "Session refreshed", types.AuthTokens{
+		AuthToken:    session.SessionID,
+		RefreshToken: session.RefreshToken,
+		ExpiryTime:   session.ExpiryTime,
+	}, a.log)
+	return
 }
 
 // @Summary      Sign Out
@@ -159,12 +473,16 @@ func fetchGHUser(accessToken string) (types.GHUser, error) {
 // @Router       /signout [post]
 func (a *AuthController) Signout(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(types.AuthSession).(types.Session)
-	err := a.cache.Del(ctx, session.SessionID).Err()
-	if err != nil {
+	err := a.sessions.DeleteSession(session.UserID, session.ID)
+	if err != nil && err != redis.Nil {
 		utils.WriteErr(w, http.StatusInternalServerError, "Unable to log you out, please try again", err, a.log)
 		return
 	}
 
+	if a.cookies.Enabled {
+		a.cookies.ClearSession(w)
+	}
+
 	utils.WriteRes(w, http.StatusOK, "Account logged out successfully", "", a.log)
 	return
 }
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	validator "github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/services/secrets"
+	"snipnet/types"
+)
+
+// Operations of a snippet batch, tags and collections don't exist yet so the operations on
+// them fail with 501 until they do.
+const (
+	BatchCreate           = "create"
+	BatchUpdate           = "update"
+	BatchDelete           = "delete"
+	BatchVisibility       = "visibility"
+	BatchAddTags          = "add_tags"
+	BatchMoveToCollection = "move_to_collection"
+)
+
+// batchErr is an operation of a batch that can't be applied.
+type batchErr struct {
+	status  int
+	message string
+}
+
+func (e *batchErr) Error() string {
+	return e.message
+}
+
+func stringOr(value *string, fallback string) string {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+// @Summary      Batch Snippets
+// @Description  Create, update, delete and change the visibility of up to 100 snippets at once. Every operation
+// @Description  gets a result with the status it would have had on its own. An atomic batch is applied in full or
+// @Description  not at all, operations that weren't applied because another one failed get a 424.
+// @Tags         snippet
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        body  body     types.BatchBody  true  "Operations of the batch"
+// @Param        acknowledge_secrets  query  bool  false  "Save public snippets even though credentials were found in them"
+// @Param        Idempotency-Key  header  string  false  "Unique key of the request, retries with the same key get the first response back"
+// @Success      200   {object} types.BatchResponse  "Result of each operation"
+// @Failure      400   {object} utils.Response       "Invalid request or missing parameters"
+// @Failure      500   {object} utils.Response       "Internal server error"
+// @Router       /snippets/batch [post]
+func (s *SnippetController) Batch(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.BatchBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, s.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing parameters", error, s.log)
+		return
+	}
+
+	// the snippets are fetched together rather than once per operation
+	ids := []string{}
+	for _, op := range body.Operations {
+		if op.Op != BatchCreate && op.ID != "" {
+			ids = append(ids, op.ID)
+		}
+	}
+	found, err := s.snippets.GetSnippetsByID(ids)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to fetch snippets", err, s.log)
+		return
+	}
+
+	res := types.BatchResponse{Atomic: body.Atomic, Results: make([]types.BatchResult, len(body.Operations))}
+	ops := []services.BatchOp{}
+	// indexes[j] is the index in the batch of ops[j]
+	indexes := []int{}
+	findings := map[int][]secrets.Finding{}
+	seen := map[string]bool{}
+	created := 0
+	for i, op := range body.Operations {
+		res.Results[i] = types.BatchResult{Index: i, Op: op.Op, ID: op.ID}
+
+		batchOp, opFindings, err := s.prepareBatchOp(r, session, op, found, seen, created)
+		if err != nil {
+			var e *batchErr
+			errors.As(err, &e)
+			res.Results[i].Status, res.Results[i].Error = e.status, e.message
+			res.Failed++
+			continue
+		}
+		ops = append(ops, batchOp)
+		indexes = append(indexes, i)
+		if batchOp.Op == services.BatchCreate {
+			created++
+		}
+		if len(opFindings) > 0 {
+			findings[i] = opFindings
+		}
+	}
+
+	if body.Atomic && res.Failed > 0 {
+		for i := range res.Results {
+			if res.Results[i].Status == 0 {
+				res.Results[i].Status = http.StatusFailedDependency
+				res.Results[i].Error = services.ErrBatchAborted.Error()
+			}
+		}
+		utils.WriteRes(w, http.StatusOK, "Batch not applied", res, s.log)
+		return
+	}
+
+	for j, applied := range s.snippets.ApplyBatch(ops, session.UserID, body.Atomic) {
+		result := &res.Results[indexes[j]]
+		if applied.Err != nil {
+			result.Status, result.Error = s.batchStatus(applied.Err)
+			res.Failed++
+			continue
+		}
+
+		res.Applied++
+		switch result.Op {
+		case BatchCreate:
+			result.Status = http.StatusCreated
+		case BatchDelete:
+			result.Status = http.StatusNoContent
+		default:
+			result.Status = http.StatusOK
+		}
+		if applied.Snippet != nil {
+			result.ID = applied.Snippet.ID
+			result.Snippet = applied.Snippet
+		}
+		if opFindings, ok := findings[result.Index]; ok {
+			result.Warnings = opFindings
+		}
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Batch applied", res, s.log)
+	return
+}
+
+// prepareBatchOp checks an operation of a batch the way its own endpoint would, and turns it
+// into a change for the store. seen tracks the snippets of the batch, each of them can only
+// be in it once since every change is made on the version that was fetched. created is how
+// many snippets the batch creates before the operation.
+func (s *SnippetController) prepareBatchOp(
+	r *http.Request,
+	session types.Session,
+	op types.BatchOperation,
+	found map[string]*types.SnippetWithUser,
+	seen map[string]bool,
+	created int,
+) (services.BatchOp, []secrets.Finding, error) {
+	switch op.Op {
+	case BatchCreate:
+		return s.prepareBatchCreate(r, session, op, created)
+	case BatchUpdate, BatchVisibility, BatchDelete:
+	case BatchAddTags:
+		return services.BatchOp{}, nil, &batchErr{http.StatusNotImplemented, "Tags aren't supported yet"}
+	case BatchMoveToCollection:
+		return services.BatchOp{}, nil, &batchErr{http.StatusNotImplemented, "Collections aren't supported yet"}
+	default:
+		return services.BatchOp{}, nil, &batchErr{http.StatusBadRequest, "Unknown operation " + strconv.Quote(op.Op)}
+	}
+
+	if op.ID == "" {
+		return services.BatchOp{}, nil, &batchErr{http.StatusBadRequest, "Missing snippet id"}
+	}
+	if seen[op.ID] {
+		return services.BatchOp{}, nil, &batchErr{http.StatusBadRequest, "The snippet is in the batch more than once"}
+	}
+	seen[op.ID] = true
+
+	// snippets the caller can't see are reported as missing so their ids don't leak
+	sp, ok := found[op.ID]
+	var access policy.Access
+	if ok {
+		access = s.access(session, sp)
+	}
+	if !ok || !policy.CanSnippet(session, sp, access, policy.Read) {
+		return services.BatchOp{}, nil, &batchErr{http.StatusNotFound, "Snippet not found"}
+	}
+
+	action := policy.Update
+	if op.Op == BatchDelete {
+		action = policy.Delete
+	}
+	if !policy.CanSnippet(session, sp, access, action) {
+		return services.BatchOp{}, nil, &batchErr{http.StatusUnauthorized, "You are not authorized to access this resource"}
+	}
+
+	if op.Op == BatchDelete {
+		return services.BatchOp{Op: services.BatchDelete, Snippet: &services.Snippet{ID: sp.ID, Version: sp.Version}}, nil, nil
+	}
+
+	if op.Op == BatchVisibility {
+		if op.IsPublic == nil {
+			return services.BatchOp{}, nil, &batchErr{http.StatusBadRequest, "Missing is_public"}
+		}
+		op = types.BatchOperation{Op: op.Op, ID: op.ID, IsPublic: op.IsPublic}
+	}
+
+	public := sp.IsPublic == "true"
+	if op.IsPublic != nil {
+		public = *op.IsPublic
+	}
+	if !canChangeVisibility(session, sp, access, public) {
+		return services.BatchOp{}, nil, &batchErr{http.StatusUnauthorized, "You are not authorized to change the visibility of this snippet"}
+	}
+
+	snippet := &services.Snippet{
+		ID:          sp.ID,
+		UserID:      sp.UserID,
+		OrgID:       sp.OrgID,
+		Title:       stringOr(op.Title, sp.Title),
+		Description: stringOr(op.Description, sp.Description),
+		Language:    stringOr(op.Language, sp.Language),
+		Code:        stringOr(op.Code, sp.Code),
+		IsPublic:    strconv.FormatBool(public),
+		Version:     sp.Version,
+	}
+	if err := utils.Validate.Struct(snippet); err != nil {
+		return services.BatchOp{}, nil, &batchErr{http.StatusBadRequest, "Missing parameters"}
+	}
+
+	findings, ok := scanSecrets(r, snippet.Code, public, sp.UserID == session.UserID)
+	if !ok {
+		return services.BatchOp{}, nil, &batchErr{http.StatusUnprocessableEntity, secretsMessage}
+	}
+	s.scoreSpam(snippet, 0)
+	return services.BatchOp{Op: services.BatchUpdate, Snippet: snippet}, findings, nil
+}
+
+// prepareBatchCreate checks a create of a batch, created is how many snippets the batch
+// creates before it.
+func (s *SnippetController) prepareBatchCreate(
+	r *http.Request,
+	session types.Session,
+	op types.BatchOperation,
+	created int,
+) (services.BatchOp, []secrets.Finding, error) {
+	public := op.IsPublic != nil && *op.IsPublic
+	snippet := &services.Snippet{
+		ID:          uuid.NewString(),
+		UserID:      session.UserID,
+		OrgID:       op.OrgID,
+		Title:       stringOr(op.Title, ""),
+		Description: stringOr(op.Description, ""),
+		Language:    stringOr(op.Language, ""),
+		Code:        stringOr(op.Code, ""),
+		IsPublic:    strconv.FormatBool(public),
+	}
+	if err := utils.Validate.Struct(snippet); err != nil {
+		return services.BatchOp{}, nil, &batchErr{http.StatusBadRequest, "Missing parameters"}
+	}
+
+	if snippet.OrgID != nil {
+		if _, err := s.orgs.GetMemberRole(*snippet.OrgID, session.UserID); err != nil {
+			return services.BatchOp{}, nil, &batchErr{http.StatusForbidden, "You are not a member of that org"}
+		}
+	}
+
+	findings, ok := scanSecrets(r, snippet.Code, public, true)
+	if !ok {
+		return services.BatchOp{}, nil, &batchErr{http.StatusUnprocessableEntity, secretsMessage}
+	}
+	s.scoreSpam(snippet, created+1)
+	return services.BatchOp{Op: services.BatchCreate, Snippet: snippet}, findings, nil
+}
+
+// batchStatus is the status and message of an operation the store failed to apply.
+func (s *SnippetController) batchStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, services.ErrBatchAborted):
+		return http.StatusFailedDependency, err.Error()
+	case errors.Is(err, services.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, "The snippet has been changed since it was fetched"
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, "Snippet not found"
+	default:
+		s.log.Error("BATCH", slog.String("Unable to apply operation", err.Error()))
+		return http.StatusInternalServerError, "Unable to apply the operation"
+	}
+}
@@ -0,0 +1,541 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+
+	"snipnet/collab"
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/services/secrets"
+	"snipnet/types"
+)
+
+const (
+	// collabSaveInterval is how often the code of a snippet being edited live is saved.
+	collabSaveInterval = 5 * time.Second
+	// collabClaimTTL is how long the claim of an instance on a room lasts, it is renewed
+	// with every save so it only runs out when the instance goes away.
+	collabClaimTTL = 30 * time.Second
+)
+
+// errRoomElsewhere is returned when the room of a snippet is open on another instance.
+var errRoomElsewhere = errors.New("Snippet is being edited on another server")
+
+// collabMessage is sent both ways over the socket.
+//
+// Clients send op with the revision it was made at, and cursor with their position.
+// The server answers with init when the client connects, ack once its op is applied, op
+// for the ops of others, join, leave and cursor for presence, saved once a revision is
+// stored, reset with the new code when the snippet was changed outside of the room, and
+// warning or error when something needs the client's attention.
+type collabMessage struct {
+	Type     string            `json:"type"`
+	Revision int               `json:"revision"`
+	Op       collab.Op         `json:"op,omitempty"`
+	Code     string            `json:"code,omitempty"`
+	ClientID string            `json:"client_id,omitempty"`
+	Cursor   int               `json:"cursor,omitempty"`
+	Client   *collabPresence   `json:"client,omitempty"`
+	Clients  []*collabPresence `json:"clients,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Findings []secrets.Finding `json:"findings,omitempty"`
+}
+
+type collabPresence struct {
+	ClientID string `json:"client_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	CanEdit  bool   `json:"can_edit"`
+	Cursor   int    `json:"cursor"`
+}
+
+type collabClient struct {
+	collabPresence
+	conn *websocket.Conn
+	send chan collabMessage
+}
+
+// collabRoom holds everyone editing one snippet.
+type collabRoom struct {
+	id      string
+	mu      sync.Mutex
+	doc     *collab.Document
+	clients map[*collabClient]struct{}
+	// saved is the last revision stored, warned the last one clients were warned about.
+	// version is the version of the snippet that revision is, saves only apply to it.
+	saved   int
+	warned  int
+	version int
+	// editor is the user who made the last edit, saves are attributed to them.
+	editor string
+	saveMu sync.Mutex
+	// ready is closed once the room is open, err is set when opening it failed. done is
+	// closed when the last client leaves, closed once the code is saved after that.
+	ready  chan struct{}
+	err    error
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// broadcast sends msg to every client but except, the caller holds room.mu. Clients too
+// slow to keep up are disconnected.
+func (room *collabRoom) broadcast(msg collabMessage, except *collabClient) {
+	for client := range room.clients {
+		if client != except {
+			client.push(msg)
+		}
+	}
+}
+
+func (c *collabClient) push(msg collabMessage) {
+	select {
+	case c.send <- msg:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (room *collabRoom) presence() []*collabPresence {
+	clients := []*collabPresence{}
+	for client := range room.clients {
+		p := client.collabPresence
+		clients = append(clients, &p)
+	}
+	return clients
+}
+
+// CollabController lets collaborators edit a snippet together over a WebSocket. Rooms
+// live in the memory of the instance, the instance opening one claims it in the room store
+// and clients reaching another instance are turned away until it is closed.
+type CollabController struct {
+	snippets *SnippetController
+	claims   services.RoomStore
+	origins  []string
+	log      *slog.Logger
+	// instance tells the rooms of this instance apart in the room store.
+	instance string
+	mu       sync.Mutex
+	rooms    map[string]*collabRoom
+	// closing are the rooms the last client left that are still being saved.
+	closing map[string]*collabRoom
+}
+
+func NewCollabController(
+	snippets *SnippetController,
+	claims services.RoomStore,
+	origins []string,
+	log *slog.Logger,
+) *CollabController {
+	return &CollabController{
+		snippets: snippets,
+		claims:   claims,
+		origins:  origins,
+		log:      log,
+		instance: uuid.NewString(),
+		rooms:    map[string]*collabRoom{},
+		closing:  map[string]*collabRoom{},
+	}
+}
+
+// @Summary      Live Editing
+// @Description  Upgrade to a WebSocket to edit a snippet together with its collaborators. Edits are ot.js operations, see collabMessage for the protocol. Anyone who can read the snippet can follow along, only those who can update it can edit. The code is saved every few seconds.
+// @Tags         snippet
+// @Param        id      path   string  true   "Snippet ID"
+// @Param        ticket  query  string  false  "Ticket from POST /stream/tickets, browsers can't send an Authorization header with a WebSocket"
+// @Success      101  {string} string          "Switching protocols"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "Snippet not found"
+// @Failure      409  {object} utils.Response  "Snippet is being edited on another server, retry later"
+// @Router       /snippets/{id}/live [get]
+func (c *CollabController) Live(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+	s := c.snippets
+
+	snippet, err := s.snippets.GetSnippet(id)
+	access := policy.Access{}
+	if err == nil {
+		access = s.access(session, snippet)
+		if !policy.CanSnippet(session, snippet, access, policy.Read) {
+			err = errors.New("Not authorized")
+		}
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), err, c.log)
+		return
+	}
+
+	user, err := s.users.GetUser("id", session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusUnauthorized, "User not found", err, c.log)
+		return
+	}
+
+	// turned away before the upgrade so clients can tell, join checks again for real
+	owner, err := c.claims.Owner(r.Context(), snippet.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Live editing is unavailable", err, c.log)
+		return
+	}
+	if owner != "" && owner != c.instance {
+		w.Header().Set("Retry-After", strconv.Itoa(int(collabClaimTTL.Seconds())))
+		utils.WriteErr(w, http.StatusConflict, "This snippet is being edited on another server, try again later",
+			errRoomElsewhere, c.log)
+		return
+	}
+
+	// the socket outlives the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	if err = errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})); err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Live editing is not supported", err, c.log)
+		return
+	}
+
+	client := &collabClient{
+		collabPresence: collabPresence{
+			ClientID: uuid.NewString(),
+			UserID:   user.ID,
+			Username: user.Username,
+			CanEdit:  policy.CanSnippet(session, snippet, access, policy.Update) && session.HasScope(types.ScopeSnippetsWrite),
+		},
+		send: make(chan collabMessage, 64),
+	}
+
+	server := websocket.Server{
+		// cookies are sent along with cross-site sockets, only the frontend may open one
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if origin := r.Header.Get("Origin"); origin != "" && !slices.Contains(c.origins, origin) {
+				return fmt.Errorf("origin %s not allowed", origin)
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = 1 << 20
+			client.conn = conn
+			c.serve(snippet.ID, client)
+		},
+	}
+	server.ServeHTTP(w, r)
+	return
+}
+
+func (c *CollabController) serve(id string, client *collabClient) {
+	room, err := c.join(id, client)
+	if err == errRoomElsewhere {
+		websocket.JSON.Send(client.conn, collabMessage{Type: "error", Message: "This snippet is being edited on another server, try again later"})
+		client.conn.Close()
+		return
+	}
+	if err != nil {
+		c.log.Error("COLLAB", slog.String("Unable to open snippet", err.Error()))
+		websocket.JSON.Send(client.conn, collabMessage{Type: "error", Message: "Unable to open snippet"})
+		client.conn.Close()
+		return
+	}
+	defer c.leave(room, client)
+
+	go func() {
+		for msg := range client.send {
+			if err := websocket.JSON.Send(client.conn, msg); err != nil {
+				client.conn.Close()
+			}
+		}
+	}()
+
+	for {
+		var msg collabMessage
+		if err := websocket.JSON.Receive(client.conn, &msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "op":
+			if !client.CanEdit {
+				client.push(collabMessage{Type: "error", Message: "You can't edit this snippet"})
+				continue
+			}
+			c.applyOp(room, client, msg)
+		case "cursor":
+			room.mu.Lock()
+			client.Cursor = max(0, min(msg.Cursor, utf8.RuneCountInString(room.doc.Text)))
+			room.broadcast(collabMessage{Type: "cursor", ClientID: client.ClientID, Cursor: client.Cursor}, client)
+			room.mu.Unlock()
+		default:
+			client.push(collabMessage{Type: "error", Message: fmt.Sprintf("Unknown message type %s", msg.Type)})
+		}
+	}
+}
+
+func (c *CollabController) applyOp(room *collabRoom, client *collabClient, msg collabMessage) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	op, err := room.doc.Apply(msg.Revision, msg.Op)
+	if err == collab.ErrStaleRevision {
+		client.push(collabMessage{Type: "error", Message: err.Error(), Code: room.doc.Text, Revision: room.doc.Revision})
+		return
+	}
+	if err != nil {
+		client.push(collabMessage{Type: "error", Message: err.Error()})
+		return
+	}
+
+	room.editor = client.UserID
+	for other := range room.clients {
+		other.Cursor = collab.TransformIndex(other.Cursor, op)
+	}
+	client.push(collabMessage{Type: "ack", Revision: room.doc.Revision})
+	room.broadcast(collabMessage{Type: "op", Revision: room.doc.Revision, Op: op, ClientID: client.ClientID}, client)
+}
+
+// join adds client to the room of the snippet, opening the room with the stored code when
+// nobody is editing it yet. A room still being saved after the last client left is waited
+// for, so it isn't opened again with the old code.
+func (c *CollabController) join(id string, client *collabClient) (*collabRoom, error) {
+	for {
+		c.mu.Lock()
+		if closing, ok := c.closing[id]; ok {
+			c.mu.Unlock()
+			<-closing.closed
+			continue
+		}
+		room, ok := c.rooms[id]
+		if !ok {
+			room = &collabRoom{
+				id:      id,
+				clients: map[*collabClient]struct{}{},
+				ready:   make(chan struct{}),
+				done:    make(chan struct{}),
+				closed:  make(chan struct{}),
+			}
+			c.rooms[id] = room
+		}
+		c.mu.Unlock()
+
+		if !ok {
+			c.open(room)
+		}
+		<-room.ready
+		if room.err != nil {
+			return nil, room.err
+		}
+
+		// the last client can have left while the room was waited for
+		c.mu.Lock()
+		if c.rooms[id] != room {
+			c.mu.Unlock()
+			continue
+		}
+		room.mu.Lock()
+		room.clients[client] = struct{}{}
+		client.push(collabMessage{
+			Type:     "init",
+			ClientID: client.ClientID,
+			Revision: room.doc.Revision,
+			Code:     room.doc.Text,
+			Clients:  room.presence(),
+		})
+		room.broadcast(collabMessage{Type: "join", Client: &client.collabPresence}, client)
+		room.mu.Unlock()
+		c.mu.Unlock()
+		return room, nil
+	}
+}
+
+// open claims the room for this instance and loads the code, the clients waiting on the
+// room get room.err when either fails.
+func (c *CollabController) open(room *collabRoom) {
+	defer close(room.ready)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	claimed, err := c.claims.Claim(ctx, room.id, c.instance, collabClaimTTL)
+	if err == nil && !claimed {
+		err = errRoomElsewhere
+	}
+
+	var snippet *types.SnippetWithUser
+	if err == nil {
+		if snippet, err = c.snippets.snippets.GetSnippet(room.id); err != nil {
+			c.release(room.id)
+		}
+	}
+
+	if err != nil {
+		room.err = err
+		c.mu.Lock()
+		delete(c.rooms, room.id)
+		c.mu.Unlock()
+		return
+	}
+
+	room.doc = collab.NewDocument(snippet.Code)
+	room.version = snippet.Version
+	go c.autosave(room)
+}
+
+// leave removes client from its room. The last one out closes the room and saves the code
+// once the lock is released, the room stays in closing until then.
+func (c *CollabController) leave(room *collabRoom, client *collabClient) {
+	c.mu.Lock()
+	room.mu.Lock()
+	delete(room.clients, client)
+	close(client.send)
+	room.broadcast(collabMessage{Type: "leave", ClientID: client.ClientID}, nil)
+	empty := len(room.clients) == 0
+	room.mu.Unlock()
+	if empty {
+		delete(c.rooms, room.id)
+		c.closing[room.id] = room
+		close(room.done)
+	}
+	c.mu.Unlock()
+	client.conn.Close()
+
+	if !empty {
+		return
+	}
+	c.save(room)
+	c.release(room.id)
+
+	c.mu.Lock()
+	delete(c.closing, room.id)
+	c.mu.Unlock()
+	close(room.closed)
+}
+
+func (c *CollabController) release(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := c.claims.Release(ctx, id, c.instance); err != nil {
+		c.log.Error("COLLAB", slog.String("Unable to release room", err.Error()))
+	}
+}
+
+// autosave saves the room every collabSaveInterval and renews the claim on it.
+func (c *CollabController) autosave(room *collabRoom) {
+	ticker := time.NewTicker(collabSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-room.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			claimed, err := c.claims.Claim(ctx, room.id, c.instance, collabClaimTTL)
+			cancel()
+			if err != nil {
+				c.log.Error("COLLAB", slog.String("Unable to renew room", err.Error()))
+			} else if !claimed {
+				c.log.Error("COLLAB", slog.String("Room claimed by another instance", room.id))
+			}
+			c.save(room)
+		}
+	}
+}
+
+// save stores the code of the room through the same checks as a regular update. Public
+// snippets aren't saved while their code looks like it contains credentials, editors are
+// warned instead. The code is only saved over the version of the snippet the room has, when
+// the snippet was changed since the room takes the stored code and the edits made in the
+// meantime are dropped.
+func (c *CollabController) save(room *collabRoom) {
+	room.saveMu.Lock()
+	defer room.saveMu.Unlock()
+	s := c.snippets
+
+	room.mu.Lock()
+	code, revision, editor := room.doc.Text, room.doc.Revision, room.editor
+	room.mu.Unlock()
+
+	// read even when nothing changed in the room, so it picks up regular updates
+	sp, err := s.snippets.GetSnippet(room.id)
+	if err != nil {
+		c.log.Error("COLLAB", slog.String("Unable to save snippet", err.Error()))
+		return
+	}
+	if sp.Version != room.version {
+		c.reset(room, sp)
+		return
+	}
+	if revision == room.saved {
+		return
+	}
+
+	if findings := secrets.Scan(code); len(findings) > 0 && sp.IsPublic == "true" {
+		room.mu.Lock()
+		if room.warned != revision {
+			room.warned = revision
+			room.broadcast(collabMessage{
+				Type:     "warning",
+				Revision: revision,
+				Message:  "The code looks like it contains credentials, it won't be saved until they are removed or the snippet is made private",
+				Findings: findings,
+			}, nil)
+		}
+		room.mu.Unlock()
+		return
+	}
+
+	update := &services.Snippet{
+		ID:          sp.ID,
+		UserID:      sp.UserID,
+		OrgID:       sp.OrgID,
+		Title:       sp.Title,
+		Description: sp.Description,
+		Language:    sp.Language,
+		Code:        code,
+		IsPublic:    sp.IsPublic,
+		Version:     room.version,
+	}
+	s.scoreSpam(update, 0)
+
+	saved, err := s.snippets.UpdateSnippetMulti(update, editor)
+	if errors.Is(err, services.ErrVersionMismatch) {
+		// changed between the read and the write
+		if sp, err = s.snippets.GetSnippet(room.id); err == nil {
+			c.reset(room, sp)
+			return
+		}
+	}
+	if err != nil {
+		c.log.Error("COLLAB", slog.String("Unable to save snippet", err.Error()))
+		return
+	}
+
+	room.mu.Lock()
+	room.saved = revision
+	room.version = saved.Version
+	room.broadcast(collabMessage{Type: "saved", Revision: revision}, nil)
+	room.mu.Unlock()
+}
+
+// reset replaces the code of the room with the stored one of sp, the caller holds
+// room.saveMu.
+func (c *CollabController) reset(room *collabRoom, sp *types.SnippetWithUser) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.doc.Reset(sp.Code)
+	room.saved = room.doc.Revision
+	room.version = sp.Version
+	room.broadcast(collabMessage{
+		Type:     "reset",
+		Revision: room.doc.Revision,
+		Code:     room.doc.Text,
+		Message:  "The snippet was changed outside of live editing, edits that weren't saved yet were replaced",
+	}, nil)
+}
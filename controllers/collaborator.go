@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	validator "github.com/go-playground/validator/v10"
+
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/events"
+	"snipnet/types"
+)
+
+// sharedSnippet fetches the snippet in the path and checks the session may manage who it
+// is shared with. The error response has been written when ok is false.
+func (s *SnippetController) sharedSnippet(w http.ResponseWriter, r *http.Request, session types.Session) (snippet *types.SnippetWithUser, ok bool) {
+	id := r.PathValue("id")
+	snippet, err := s.snippets.GetSnippet(id)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), err, s.log)
+		return nil, false
+	}
+
+	access := s.access(session, snippet)
+	if !policy.CanSnippet(session, snippet, access, policy.Share) {
+		// collaborators know the snippet exists, everyone else gets the same answer as a missing one
+		if policy.CanSnippet(session, snippet, access, policy.Read) {
+			utils.WriteErr(w, http.StatusForbidden, "Only the owner can manage collaborators", errors.New("Not authorized"), s.log)
+		} else {
+			utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), errors.New("Not authorized"), s.log)
+		}
+		return nil, false
+	}
+
+	return snippet, true
+}
+
+// @Summary      List Collaborators
+// @Description  List the users a snippet has been shared with. Only the snippet owner can perform this action.
+// @Tags         snippet
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id   path     string              true  "Snippet ID"
+// @Success      200  {array}  types.Collaborator  "Collaborators of the snippet"
+// @Failure      401  {object} utils.Response      "Unauthorized access"
+// @Failure      403  {object} utils.Response      "Not the snippet owner"
+// @Failure      404  {object} utils.Response      "Snippet not found"
+// @Router       /snippets/{id}/collaborators [get]
+func (s *SnippetController) GetCollaborators(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	snippet, ok := s.sharedSnippet(w, r, session)
+	if !ok {
+		return
+	}
+
+	collaborators, err := s.collaborators.GetCollaborators(snippet.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching collaborators", err, s.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Collaborators found", collaborators, s.log)
+	return
+}
+
+// @Summary      Add Collaborator
+// @Description  Share a snippet with a user with read or write access, or change their access. Write access lets them update the snippet but not delete it. Only the snippet owner can perform this action.
+// @Tags         snippet
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id    path     string                  true  "Snippet ID"
+// @Param        body  body     types.CollaboratorBody  true  "Username and permission"
+// @Success      200   {object} types.Collaborator      "Collaborator"
+// @Failure      400   {object} utils.Response          "Invalid request or missing parameters"
+// @Failure      401   {object} utils.Response          "Unauthorized access"
+// @Failure      403   {object} utils.Response          "Not the snippet owner"
+// @Failure      404   {object} utils.Response          "Snippet or user not found"
+// @Router       /snippets/{id}/collaborators [post]
+func (s *SnippetController) AddCollaborator(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.CollaboratorBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, s.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing or invalid parameters", error, s.log)
+		return
+	}
+
+	snippet, ok := s.sharedSnippet(w, r, session)
+	if !ok {
+		return
+	}
+
+	user, err := s.users.GetUser("username", body.Username)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User %s not found", body.Username), err, s.log)
+		return
+	}
+
+	if user.ID == snippet.UserID {
+		utils.WriteErr(w, http.StatusBadRequest, "The owner of a snippet can't be a collaborator", errors.New("Invalid user"), s.log)
+		return
+	}
+
+	collaborator, err := s.collaborators.SetCollaborator(snippet.ID, user.ID, body.Permission)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while adding the collaborator", err, s.log)
+		return
+	}
+	collaborator.Username = user.Username
+	collaborator.Avatar = user.Avatar
+
+	s.events.Publish(r.Context(), events.Event{
+		Type:      events.SnippetShared,
+		UserID:    user.ID,
+		ActorID:   session.UserID,
+		SnippetID: snippet.ID,
+	})
+
+	utils.WriteRes(w, http.StatusOK, "Collaborator added", collaborator, s.log)
+	return
+}
+
+// @Summary      Remove Collaborator
+// @Description  Stop sharing a snippet with a user. The owner can remove anyone, collaborators can remove themselves.
+// @Tags         snippet
+// @Security     ApiKeyAuth
+// @Param        id       path  string  true  "Snippet ID"
+// @Param        user_id  path  string  true  "User ID of the collaborator"
+// @Success      204      "Collaborator removed"
+// @Failure      401      {object} utils.Response  "Unauthorized access"
+// @Failure      403      {object} utils.Response  "Not the snippet owner"
+// @Failure      404      {object} utils.Response  "Snippet or collaborator not found"
+// @Router       /snippets/{id}/collaborators/{user_id} [delete]
+func (s *SnippetController) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+	user_id := r.PathValue("user_id")
+
+	if user_id != session.UserID {
+		if _, ok := s.sharedSnippet(w, r, session); !ok {
+			return
+		}
+	}
+
+	err := s.collaborators.RemoveCollaborator(id, user_id)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Collaborator with id %s not found", user_id), err, s.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to remove collaborator", err, s.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Get Shared Snippets
+// @Description  Retrieve the snippets other users have shared with the current user.
+// @Tags         snippet
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  types.SnippetWithUser  "Snippets shared with the user"
+// @Failure      401   {object} utils.Response         "Unauthorized access"
+// @Failure      500   {object} utils.Response         "Internal server error"
+// @Router       /me/shared [get]
+func (s *SnippetController) GetSharedSnippets(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	page := r.URL.Query().Get("page")
+	var offset int
+	limit := 20
+	if p, err := strconv.Atoi(page); err != nil || p <= 0 {
+		offset = 0
+	} else {
+		offset = (p - 1) * limit
+	}
+
+	snippets, err := s.collaborators.GetSharedSnippets(session.UserID, offset, limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching snippets", err, s.log)
+		return
+	}
+
+	if utils.NotModified(w, r, utils.BodyETag(snippets)) {
+		return
+	}
+	utils.WriteRes(w, http.StatusOK, "Shared snippets found", snippets, s.log)
+	return
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/events"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type FollowController struct {
+	follows services.FollowStore
+	users   services.UserStore
+	events  events.Publisher
+	log     *slog.Logger
+}
+
+func NewFollowController(follows services.FollowStore, users services.UserStore, publisher events.Publisher, log *slog.Logger) *FollowController {
+	return &FollowController{
+		follows: follows,
+		users:   users,
+		events:  publisher,
+		log:     log,
+	}
+}
+
+// @Summary      Follow User
+// @Description  Follow a user, their public snippets show up in your feed. Following someone twice is a no-op.
+// @Tags         users
+// @Produce      json
+// @Param        id   path     string  true  "ID of the user to follow"
+// @Success      200  {object} utils.Response  "User followed"
+// @Failure      400  {object} utils.Response  "Can't follow yourself"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "User not found"
+// @Router       /users/{id}/follow [post]
+func (f *FollowController) Follow(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	if id == session.UserID {
+		utils.WriteErr(w, http.StatusBadRequest, "You can't follow yourself", errors.New("Self follow"), f.log)
+		return
+	}
+
+	user, err := f.users.GetUser("id", id)
+	if err != nil || id == services.GhostUserID {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User with id %s not found", id), sql.ErrNoRows, f.log)
+		return
+	}
+
+	followed, err := f.follows.Follow(session.UserID, user.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while following the user", err, f.log)
+		return
+	}
+
+	// following someone again doesn't tell them again
+	if followed {
+		f.events.Publish(r.Context(), events.Event{Type: events.UserFollowed, UserID: user.ID, ActorID: session.UserID})
+	}
+
+	utils.WriteRes(w, http.StatusOK, fmt.Sprintf("You are now following %s", user.Username), "", f.log)
+	return
+}
+
+// @Summary      Unfollow User
+// @Description  Stop following a user.
+// @Tags         users
+// @Produce      json
+// @Param        id   path     string  true  "ID of the user to unfollow"
+// @Success      200  {object} utils.Response  "User unfollowed"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "Not following the user"
+// @Router       /users/{id}/follow [delete]
+func (f *FollowController) Unfollow(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	err := f.follows.Unfollow(session.UserID, id)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, "You are not following this user", err, f.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while unfollowing the user", err, f.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "User unfollowed", "", f.log)
+	return
+}
+
+// @Summary      List Followers
+// @Description  List the users following a user, most recent first.
+// @Tags         users
+// @Produce      json
+// @Param        id    path     string  true   "ID of the user"
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  types.Follow    "Followers"
+// @Failure      500   {object} utils.Response  "Internal server error"
+// @Router       /users/{id}/followers [get]
+func (f *FollowController) GetFollowers(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	followers, err := f.follows.GetFollowers(r.PathValue("id"), utils.PageOffset(r, limit), limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while fetching followers", err, f.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Followers found", followers, f.log)
+	return
+}
+
+// @Summary      List Following
+// @Description  List the users a user follows, most recently followed first.
+// @Tags         users
+// @Produce      json
+// @Param        id    path     string  true   "ID of the user"
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  types.Follow    "Followed users"
+// @Failure      500   {object} utils.Response  "Internal server error"
+// @Router       /users/{id}/following [get]
+func (f *FollowController) GetFollowing(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	following, err := f.follows.GetFollowing(r.PathValue("id"), utils.PageOffset(r, limit), limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while fetching followed users", err, f.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Followed users found", following, f.log)
+	return
+}
+
+// @Summary      Get Feed
+// @Description  List new and updated public snippets from the users you follow, newest first. Pass next_cursor from the previous page as cursor to get the next one.
+// @Tags         users
+// @Produce      json
+// @Param        cursor  query    string  false  "Cursor of the next page"
+// @Param        limit   query    int     false  "Items per page, 20 by default and at most 100"
+// @Success      200     {object} types.Feed      "Feed"
+// @Failure      400     {object} utils.Response  "Invalid cursor"
+// @Failure      401     {object} utils.Response  "Unauthorized access"
+// @Router       /feed [get]
+func (f *FollowController) GetFeed(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	query := r.URL.Query()
+
+	limit := 20
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+		limit = min(l, 100)
+	}
+
+	var cursor *services.FeedCursor
+	if c := query.Get("cursor"); c != "" {
+		var err error
+		if cursor, err = services.ParseFeedCursor(c); err != nil {
+			utils.WriteErr(w, http.StatusBadRequest, "Invalid cursor", err, f.log)
+			return
+		}
+	}
+
+	feed, err := f.follows.GetFeed(session.UserID, cursor, limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while fetching your feed", err, f.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Feed found", feed, f.log)
+	return
+}
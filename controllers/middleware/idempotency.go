@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	utils "snipnet/controllers/responseutils"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed from an earlier request.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// IdempotencyTTL is how long a response is replayed for.
+	IdempotencyTTL = 24 * time.Hour
+	// idempotencyLease is how long a request holds its key while it is handled, the key is
+	// free again after that if the instance handling it went away.
+	idempotencyLease  = time.Minute
+	maxIdempotencyKey = 255
+)
+
+// replayedHeaders are the response headers that are stored and replayed along with the body,
+// the others describe the request that was made rather than its result.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// IdempotentResponse is what is stored under an idempotency key. Done is false while the
+// first request with the key is still being handled.
+type IdempotentResponse struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// IdempotencyStore keeps the responses of requests made with an idempotency key.
+type IdempotencyStore interface {
+	// Begin claims key for a request with fingerprint for lease. It returns nil when the
+	// key was free, and what is stored under it otherwise.
+	Begin(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotentResponse, error)
+	Save(ctx context.Context, key string, res IdempotentResponse, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+type RedisIdempotencyStore struct {
+	cache *redis.Client
+}
+
+func NewRedisIdempotencyStore(rds *redis.Client) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{cache: rds}
+}
+
+func (s *RedisIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotentResponse, error) {
+	key = "idempotency:" + key
+	claim, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	// the key can expire between SET and GET, it is claimed again then
+	for range 2 {
+		ok, err := s.cache.SetNX(ctx, key, claim, lease).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, nil
+		}
+
+		value, err := s.cache.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var stored IdempotentResponse
+		if err = json.Unmarshal(value, &stored); err != nil {
+			return nil, err
+		}
+		return &stored, nil
+	}
+	return nil, errors.New("Unable to claim idempotency key")
+}
+
+func (s *RedisIdempotencyStore) Save(ctx context.Context, key string, res IdempotentResponse, ttl time.Duration) error {
+	value, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.cache.Set(ctx, "idempotency:"+key, value, ttl).Err()
+}
+
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.cache.Del(ctx, "idempotency:"+key).Err()
+}
+
+// MemoryIdempotencyStore keeps the responses of a single instance in memory, it is used in
+// tests.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]IdempotentResponse
+	expires   map[string]time.Time
+	now       func() time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		responses: map[string]IdempotentResponse{},
+		expires:   map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+func (s *MemoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, lease time.Duration) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if stored, ok := s.responses[key]; ok && now.Before(s.expires[key]) {
+		return &stored, nil
+	}
+	s.responses[key] = IdempotentResponse{Fingerprint: fingerprint}
+	s.expires[key] = now.Add(lease)
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Save(ctx context.Context, key string, res IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses[key] = res
+	s.expires[key] = s.now().Add(ttl)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.responses, key)
+	delete(s.expires, key)
+	return nil
+}
+
+type Idempotency struct {
+	store IdempotencyStore
+	log   *slog.Logger
+}
+
+func NewIdempotency(store IdempotencyStore, log *slog.Logger) *Idempotency {
+	return &Idempotency{store: store, log: log}
+}
+
+// recorder keeps a copy of the response written by the handler.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Idempotent replays the response of the first request made with the same Idempotency-Key
+// for IdempotencyTTL, so clients can retry a POST without doing it twice. Reusing a key for
+// a different request is a 422. Server errors and rate limited requests aren't kept so they
+// can be retried for real. Requests without the header are handled as usual. Keys are per
+// client, when wrapped by IsAuthenticated or OptionalAuth they are per user or token.
+// Responses are kept in Redis as they are, so routes returning secrets, such as access
+// tokens or webhook signing secrets, mustn't be wrapped.
+func (i *Idempotency) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" {
+			next(w, r)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKey {
+			utils.WriteErr(w, http.StatusBadRequest, "Idempotency-Key is too long",
+				errors.New("Idempotency-Key over 255 characters"), i.log)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			if body, err = io.ReadAll(r.Body); err != nil {
+				utils.WriteErr(w, http.StatusBadRequest, "Unable to read the request", err, i.log)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		// the route is part of the request, a key reused on another route is a different request
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+		key := rateLimitKey(r) + ":" + idempotencyKey
+
+		stored, err := i.store.Begin(r.Context(), key, fingerprint, idempotencyLease)
+		if err != nil {
+			i.log.Error("IDEMPOTENCY", slog.String("Handling the request without an idempotency key", err.Error()))
+			next(w, r)
+			return
+		}
+		if stored != nil {
+			i.replay(w, stored, fingerprint)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		done := false
+		// a panicking handler frees the key too, the request never completed
+		defer func() {
+			if !done {
+				i.release(key)
+			}
+		}()
+		next(rec, r)
+		done = true
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+			i.release(key)
+			return
+		}
+
+		res := IdempotentResponse{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      rec.status,
+			Header:      http.Header{},
+			Body:        rec.body.Bytes(),
+		}
+		for _, h := range replayedHeaders {
+			if v := w.Header().Get(h); v != "" {
+				res.Header.Set(h, v)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if err = i.store.Save(ctx, key, res, IdempotencyTTL); err != nil {
+			i.log.Error("IDEMPOTENCY", slog.String("Unable to save the response", err.Error()))
+		}
+	}
+}
+
+func (i *Idempotency) replay(w http.ResponseWriter, stored *IdempotentResponse, fingerprint string) {
+	if stored.Fingerprint != fingerprint {
+		utils.WriteErr(w, http.StatusUnprocessableEntity, "The Idempotency-Key was already used for a different request",
+			errors.New("Idempotency-Key reused"), i.log)
+		return
+	}
+	if !stored.Done {
+		w.Header().Set("Retry-After", "1")
+		utils.WriteErr(w, http.StatusConflict, "A request with this Idempotency-Key is still being handled",
+			errors.New("Idempotency-Key in use"), i.log)
+		return
+	}
+
+	for h, values := range stored.Header {
+		w.Header()[h] = values
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+func (i *Idempotency) release(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := i.store.Release(ctx, key); err != nil {
+		i.log.Error("IDEMPOTENCY", slog.String("Unable to release the idempotency key", err.Error()))
+	}
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"snipnet/types"
+)
+
+func TestIdempotentMiddleware(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	created := 0
+	status := http.StatusCreated
+	create := func(w http.ResponseWriter, r *http.Request) {
+		created++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(10-created))
+		w.WriteHeader(status)
+		w.Write([]byte(`{"id":"` + strconv.Itoa(created) + `"}`))
+	}
+	handler := NewIdempotency(NewMemoryIdempotencyStore(), log).Idempotent(create)
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/snippets", strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	first := post("k1", `{"title":"a"}`)
+	if first.Code != http.StatusCreated || created != 1 {
+		t.Fatalf("expected the first request through, got %d", first.Code)
+	}
+
+	replay := post("k1", `{"title":"a"}`)
+	if replay.Code != http.StatusCreated || created != 1 || replay.Body.String() != first.Body.String() {
+		t.Fatalf("expected the response to be replayed, got %d %s", replay.Code, replay.Body.String())
+	}
+	if replay.Header().Get(IdempotentReplayedHeader) != "true" || replay.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected replayed headers %v", replay.Header())
+	}
+	if replay.Header().Get("RateLimit-Remaining") != "" {
+		t.Errorf("expected headers about the request itself not to be replayed, got %v", replay.Header())
+	}
+
+	if rec := post("k1", `{"title":"b"}`); rec.Code != http.StatusUnprocessableEntity || created != 1 {
+		t.Fatalf("expected a 422 for a different body, got %d", rec.Code)
+	}
+
+	if rec := post("k2", `{"title":"a"}`); rec.Code != http.StatusCreated || created != 2 {
+		t.Fatalf("expected a new key to be handled, got %d", rec.Code)
+	}
+	if rec := post("", `{"title":"a"}`); rec.Code != http.StatusCreated || created != 3 {
+		t.Fatalf("expected requests without a key to be handled, got %d", rec.Code)
+	}
+
+	// another user's key is theirs alone
+	req := httptest.NewRequest(http.MethodPost, "/snippets", strings.NewReader(`{"title":"a"}`))
+	req = req.WithContext(context.WithValue(req.Context(), types.AuthSession, types.Session{UserID: "u1"}))
+	req.Header.Set(IdempotencyKeyHeader, "k1")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusCreated || created != 4 {
+		t.Fatalf("expected keys to be per client, got %d", rec.Code)
+	}
+
+	// server errors aren't kept so the request can be retried
+	status = http.StatusInternalServerError
+	post("k3", `{}`)
+	status = http.StatusCreated
+	if rec := post("k3", `{}`); rec.Code != http.StatusCreated || created != 6 {
+		t.Fatalf("expected the request to be retried after a server error, got %d", rec.Code)
+	}
+}
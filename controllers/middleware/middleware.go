@@ -2,8 +2,8 @@ package middleware
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -11,7 +11,9 @@ import (
 
 	"github.com/redis/go-redis/v9"
 
+	"snipnet/controllers/policy"
 	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
 	"snipnet/types"
 )
 
@@ -29,37 +31,234 @@ func Logger(next http.Handler) http.Handler {
 	})
 }
 
-func IsAuthenticated(next http.HandlerFunc, log *slog.Logger, cache *redis.Client) http.HandlerFunc {
+type Auth struct {
+	log      *slog.Logger
+	sessions services.SessionStore
+	tokens   services.TokenStore
+	users    services.UserStore
+	cookies  utils.CookieConfig
+}
+
+func NewAuth(
+	log *slog.Logger,
+	sessions services.SessionStore,
+	tokens services.TokenStore,
+	users services.UserStore,
+	cookies utils.CookieConfig,
+) *Auth {
+	return &Auth{
+		log:      log,
+		sessions: sessions,
+		tokens:   tokens,
+		users:    users,
+		cookies:  cookies,
+	}
+}
+
+// credentials returns the bearer token of the request, falling back to the session cookie
+// when cookie sessions are enabled.
+func (a *Auth) credentials(r *http.Request) (token string, fromCookie bool) {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), false
+	}
+
+	if a.cookies.Enabled {
+		if cookie, err := r.Cookie(utils.SessionCookie); err == nil {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// ticketSessionKey carries the session of a redeemed stream ticket from Tickets to
+// IsAuthenticated.
+type ticketSessionKey struct{}
+
+// Tickets lets browsers open the WebSocket and event stream routes it wraps, which they
+// can't send an Authorization header to, with a ticket from POST /stream/tickets in the
+// ticket query parameter. The ticket stands for the session that issued it and is used up.
+// It wraps IsAuthenticated or OptionalAuth, which check the session as usual.
+func (a *Auth) Tickets(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ticket := r.URL.Query().Get("ticket")
+		if token, _ := a.credentials(r); ticket == "" || token != "" {
+			next(w, r)
+			return
+		}
+
+		session, err := a.sessions.RedeemTicket(ticket)
+		if err == services.ErrTicketInvalid {
+			utils.WriteErr(w, http.StatusUnauthorized, "Invalid or expired ticket", err, a.log)
+			return
+		}
+		if err != nil {
+			utils.WriteErr(w, http.StatusInternalServerError, "An error occured while validating the ticket", err, a.log)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), ticketSessionKey{}, *session)))
+	}
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// IsAuthenticated accepts either a session id or a personal access token as a bearer
+// token, or the session cookie. Requests made with an access token must carry every
+// scope listed and state-changing requests made with a cookie must carry a CSRF token.
+func (a *Auth) IsAuthenticated(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return a.authenticate(next, false, scopes)
+}
+
+// authenticate loads the session of the request. When optional, requests without
+// credentials or with ones that don't load, such as an expired token, go through
+// anonymously instead of getting a 401.
+func (a *Auth) authenticate(next http.HandlerFunc, optional bool, scopes []string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
-			utils.WriteErr(w, http.StatusUnauthorized, "You are not logged in", errors.New("Session id not found"), log)
+		if session, ok := r.Context().Value(ticketSessionKey{}).(types.Session); ok {
+			a.authorize(w, r, next, session, scopes)
 			return
 		}
 
-		token := strings.TrimPrefix(auth, "Bearer ")
+		unauthorized := func(message string, err error) {
+			if optional {
+				next(w, r)
+				return
+			}
+			utils.WriteErr(w, http.StatusUnauthorized, message, err, a.log)
+		}
+
+		token, fromCookie := a.credentials(r)
 		if token == "" {
-			utils.WriteErr(w, http.StatusUnauthorized, "You are not logged in", errors.New("Session id not found"), log)
+			unauthorized("You are not logged in", errors.New("Session id not found"))
 			return
 		}
 
-		val, err := cache.Get(context.Background(), token).Result()
-		if err == redis.Nil || err != nil {
-			utils.WriteErr(w, http.StatusUnauthorized, "Invalid session token", errors.New(""), log)
+		if fromCookie && !isSafeMethod(r.Method) && !utils.ValidCSRFToken(token, r.Header.Get(utils.CSRFHeader)) {
+			utils.WriteErr(w, http.StatusForbidden, "Missing or invalid CSRF token", errors.New("CSRF check failed"), a.log)
 			return
 		}
 
 		var session types.Session
+		if strings.HasPrefix(token, utils.TokenPrefix) && !fromCookie {
+			s, err := a.tokenSession(token)
+			if err != nil {
+				unauthorized("Invalid access token", err)
+				return
+			}
+			session = *s
+		} else {
+			s, err := a.sessions.GetSession(token)
+			if err == redis.Nil {
+				unauthorized("Invalid session token", errors.New("Session not found"))
+				return
+			}
+			if err != nil {
+				utils.WriteErr(w, http.StatusInternalServerError, "An error occured while validating token ", err, a.log)
+				return
+			}
 
-		err = json.Unmarshal([]byte(val), &session)
-		if err != nil {
-			utils.WriteErr(w, http.StatusInternalServerError, "An error occured while validating token ", err, log)
+			err = a.sessions.TouchSession(s)
+			if err == services.ErrSessionExpired {
+				unauthorized("Your session has expired", err)
+				return
+			}
+			if err != nil {
+				a.log.Error("AUTH", slog.String("Unable to update session", err.Error()))
+			}
+			session = *s
+		}
+
+		a.authorize(w, r, next, session, scopes)
+	}
+}
+
+// authorize loads the role of the session's user and checks the scopes before handing the
+// request on with the session.
+func (a *Auth) authorize(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, session types.Session, scopes []string) {
+	user, err := a.users.GetUser("id", session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusUnauthorized, "Invalid session token", err, a.log)
+		return
+	}
+	if user.SuspendedAt != nil {
+		utils.WriteErr(w, http.StatusForbidden, "Your account has been suspended", errors.New("Account suspended"), a.log)
+		return
+	}
+	session.Role = user.Role
+
+	for _, scope := range scopes {
+		if !session.HasScope(scope) {
+			utils.WriteErr(
+				w,
+				http.StatusForbidden,
+				fmt.Sprintf("This token is missing the %s scope", scope),
+				errors.New("Insufficient scope"),
+				a.log,
+			)
 			return
 		}
+	}
+
+	ctx := context.WithValue(r.Context(), types.AuthSession, session)
+	req := r.WithContext(ctx)
 
-		ctx := context.WithValue(r.Context(), types.AuthSession, session)
-		req := r.WithContext(ctx)
+	next(w, req)
+}
+
+// OptionalAuth authenticates the request like IsAuthenticated when it carries credentials
+// that load and lets it through anonymously otherwise, handlers must not assume a session
+// is set. Suspended accounts and tokens missing a scope are still turned away.
+func (a *Auth) OptionalAuth(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return a.authenticate(next, true, scopes)
+}
+
+func (a *Auth) tokenSession(secret string) (*types.Session, error) {
+	token, err := a.tokens.GetTokenByHash(utils.HashToken(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("Access token expired")
+	}
+
+	if err = a.tokens.TouchToken(token.ID); err != nil {
+		a.log.Error("AUTH", slog.String("Unable to update token usage", err.Error()))
+	}
+
+	scopes := token.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	return &types.Session{
+		UserID:    token.UserID,
+		ID:        token.ID,
+		SessionID: token.ID,
+		CreatedAt: token.CreatedAt,
+		Scopes:    scopes,
+	}, nil
+}
+
+// RequirePermission only lets the request through when the user's role grants permission.
+// It must be wrapped by IsAuthenticated.
+func (a *Auth) RequirePermission(next http.HandlerFunc, permission policy.Permission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := r.Context().Value(types.AuthSession).(types.Session)
+		if !policy.Has(session.Role, permission) {
+			utils.WriteErr(
+				w,
+				http.StatusForbidden,
+				"You are not authorized to access this resource",
+				errors.New("Not authorized"),
+				a.log,
+			)
+			return
+		}
 
-		next(w, req)
+		next(w, r)
 	}
 }
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type mockTokens struct {
+	services.TokenStore
+	tokens map[string]*services.Token
+}
+
+func (m *mockTokens) GetTokenByHash(hash string) (*services.Token, error) {
+	if token, ok := m.tokens[hash]; ok {
+		return token, nil
+	}
+	return nil, redis.Nil
+}
+
+func (m *mockTokens) TouchToken(id string) error { return nil }
+
+type mockSessions struct {
+	services.SessionStore
+}
+
+func (m *mockSessions) GetSession(session_id string) (*types.Session, error) {
+	return nil, redis.Nil
+}
+
+type mockUsers struct {
+	services.UserStore
+}
+
+func (m *mockUsers) GetUser(field, value string) (*services.User, error) {
+	return &services.User{ID: value, Role: "user"}, nil
+}
+
+func TestOptionalAuthFallsThrough(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	expired := time.Now().Add(-time.Hour)
+	tokens := &mockTokens{tokens: map[string]*services.Token{
+		utils.HashToken(utils.TokenPrefix + "expired"): {ID: "t1", UserID: "u1", ExpiresAt: &expired, Scopes: []string{}},
+		utils.HashToken(utils.TokenPrefix + "valid"):   {ID: "t2", UserID: "u1", Scopes: []string{types.ScopeSnippetsRead}},
+	}}
+	auth := NewAuth(log, &mockSessions{}, tokens, &mockUsers{}, utils.CookieConfig{})
+
+	var session *types.Session
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		session = nil
+		if s, ok := r.Context().Value(types.AuthSession).(types.Session); ok {
+			session = &s
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	get := func(h http.HandlerFunc, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/snippets", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	optional := auth.OptionalAuth(handler, types.ScopeSnippetsRead)
+	if code := get(optional, utils.TokenPrefix+"expired"); code != http.StatusOK || session != nil {
+		t.Fatalf("expected an expired token to go through anonymously, got %d %v", code, session)
+	}
+	if code := get(optional, "unknown-session"); code != http.StatusOK || session != nil {
+		t.Fatalf("expected an unknown session to go through anonymously, got %d %v", code, session)
+	}
+	if code := get(optional, utils.TokenPrefix+"valid"); code != http.StatusOK || session == nil || session.UserID != "u1" {
+		t.Fatalf("expected a valid token to be authenticated, got %d %v", code, session)
+	}
+
+	required := auth.IsAuthenticated(handler, types.ScopeSnippetsRead)
+	if code := get(required, utils.TokenPrefix+"expired"); code != http.StatusUnauthorized {
+		t.Fatalf("expected an expired token to get a 401 on authenticated routes, got %d", code)
+	}
+}
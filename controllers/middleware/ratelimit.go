@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/types"
+)
+
+// Limit allows Rate requests every Period, with bursts of up to Burst requests. Burst
+// defaults to Rate.
+type Limit struct {
+	Name   string
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// interval is the time it takes for one request to be allowed again.
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Rate)
+}
+
+type LimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// Limiter counts requests against a limit, key identifies who is making them.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (LimitResult, error)
+}
+
+// gcra applies the generic cell rate algorithm, tat is the theoretical arrival time stored
+// for the key. The new tat is only stored when the request is allowed.
+func gcra(now, tat time.Time, limit Limit) (time.Time, LimitResult) {
+	interval := limit.interval()
+	burst := limit.burst()
+	res := LimitResult{Limit: burst}
+
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(interval)
+	allowAt := newTat.Add(-time.Duration(burst) * interval)
+
+	if now.Before(allowAt) {
+		res.RetryAfter = allowAt.Sub(now)
+		res.ResetAfter = tat.Sub(now)
+		return tat, res
+	}
+
+	res.Allowed = true
+	res.Remaining = int(now.Sub(allowAt) / interval)
+	res.ResetAfter = newTat.Sub(now)
+	return newTat, res
+}
+
+// gcraScript is gcra run atomically in Redis, times are in microseconds and taken from the
+// Redis clock so every instance of the API agrees on them.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - burst * interval
+
+if now < allow_at then
+	return {0, 0, allow_at - now, tat - now}
+end
+
+local reset = new_tat - now
+redis.call("SET", KEYS[1], new_tat, "PX", math.ceil(reset / 1000))
+return {1, math.floor((now - allow_at) / interval), 0, reset}
+`)
+
+type RedisLimiter struct {
+	cache *redis.Client
+}
+
+func NewRedisLimiter(rds *redis.Client) *RedisLimiter {
+	return &RedisLimiter{cache: rds}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+	args := []any{limit.interval().Microseconds(), limit.burst()}
+	values, err := gcraScript.Run(ctx, l.cache, []string{"ratelimit:" + key}, args...).Int64Slice()
+	if err != nil {
+		return LimitResult{}, err
+	}
+	if len(values) != 4 {
+		return LimitResult{}, fmt.Errorf("unexpected rate limit reply %v", values)
+	}
+
+	return LimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit.burst(),
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		ResetAfter: time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
+
+// MemoryLimiter keeps the limits of a single instance in memory. It is used in tests and
+// when Redis can't be reached.
+type MemoryLimiter struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+	now  func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{tats: map[string]time.Time{}, now: time.Now}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	// keys whose tat has passed are back to a full burst, dropping them keeps the map small
+	if len(l.tats) > 10000 {
+		for k, tat := range l.tats {
+			if tat.Before(now) {
+				delete(l.tats, k)
+			}
+		}
+	}
+
+	tat, res := gcra(now, l.tats[key], limit)
+	l.tats[key] = tat
+	return res, nil
+}
+
+type RateLimit struct {
+	limiter  Limiter
+	fallback Limiter
+	log      *slog.Logger
+}
+
+// NewRateLimit limits requests with limiter, falling back to an in-memory limiter for as
+// long as limiter returns errors.
+func NewRateLimit(limiter Limiter, log *slog.Logger) *RateLimit {
+	return &RateLimit{
+		limiter:  limiter,
+		fallback: NewMemoryLimiter(),
+		log:      log,
+	}
+}
+
+// rateLimitKey identifies the client, requests made with an access token are counted
+// separately from the user's sessions and anonymous requests are counted per IP.
+func rateLimitKey(r *http.Request) string {
+	if session, ok := r.Context().Value(types.AuthSession).(types.Session); ok && session.UserID != "" {
+		if session.Scopes != nil {
+			return "token:" + session.ID
+		}
+		return "user:" + session.UserID
+	}
+	return "ip:" + utils.ClientIP(r)
+}
+
+// Policy is the RateLimit-Policy header of the limit, its quota is Rate per Period and
+// bursts above it are told apart in the burst parameter.
+func (l Limit) Policy() string {
+	policy := fmt.Sprintf("%d;w=%d", l.Rate, int(l.Period.Seconds()))
+	if l.burst() != l.Rate {
+		policy += fmt.Sprintf(";burst=%d", l.burst())
+	}
+	return policy
+}
+
+// Limit rejects requests over limit with a 429. When wrapped by IsAuthenticated or
+// OptionalAuth the limit applies per user or token, otherwise per client IP.
+func (l *RateLimit) Limit(next http.HandlerFunc, limit Limit) http.HandlerFunc {
+	policy := limit.Policy()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := limit.Name + ":" + rateLimitKey(r)
+
+		res, err := l.limiter.Allow(r.Context(), key, limit)
+		if err != nil {
+			l.log.Error("RATELIMIT", slog.String("Falling back to the in-memory limiter", err.Error()))
+			res, _ = l.fallback.Allow(r.Context(), key, limit)
+		}
+
+		w.Header().Set("RateLimit-Policy", policy)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.ResetAfter)))
+
+		if !res.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+			utils.WriteErr(w, http.StatusTooManyRequests, "Too many requests, slow down", errors.New("Rate limit exceeded"), l.log)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// seconds rounds d up so clients never retry too early.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"snipnet/types"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewMemoryLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := Limit{Name: "test", Rate: 3, Period: time.Minute}
+
+	for i := 2; i >= 0; i-- {
+		res, _ := limiter.Allow(context.Background(), "a", limit)
+		if !res.Allowed || res.Remaining != i {
+			t.Fatalf("expected request to be allowed with %d remaining, got %+v", i, res)
+		}
+	}
+
+	res, _ := limiter.Allow(context.Background(), "a", limit)
+	if res.Allowed || res.RetryAfter != 20*time.Second {
+		t.Fatalf("expected to be limited for 20s, got %+v", res)
+	}
+
+	if res, _ := limiter.Allow(context.Background(), "b", limit); !res.Allowed {
+		t.Fatalf("keys should be limited separately, got %+v", res)
+	}
+
+	now = now.Add(20 * time.Second)
+	if res, _ := limiter.Allow(context.Background(), "a", limit); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected one request to be allowed after 20s, got %+v", res)
+	}
+
+	now = now.Add(time.Hour)
+	if res, _ := limiter.Allow(context.Background(), "a", limit); !res.Allowed || res.Remaining != 2 {
+		t.Fatalf("expected a full burst after an idle hour, got %+v", res)
+	}
+}
+
+func TestRedisLimiter(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not set")
+	}
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rds := redis.NewClient(opt)
+	if err = rds.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis unavailable: %v", err)
+	}
+
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	defer rds.Del(context.Background(), "ratelimit:"+key)
+
+	limiter := NewRedisLimiter(rds)
+	limit := Limit{Name: "test", Rate: 2, Period: time.Minute}
+	for i := 1; i >= 0; i-- {
+		res, err := limiter.Allow(context.Background(), key, limit)
+		if err != nil || !res.Allowed || res.Remaining != i {
+			t.Fatalf("expected request to be allowed with %d remaining, got %+v %v", i, res, err)
+		}
+	}
+
+	res, err := limiter.Allow(context.Background(), key, limit)
+	if err != nil || res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 30*time.Second {
+		t.Fatalf("expected to be limited, got %+v %v", res, err)
+	}
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+	return LimitResult{}, redis.ErrClosed
+}
+
+func TestLimitPolicy(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  string
+	}{
+		{Limit{Rate: 60, Period: time.Minute}, "60;w=60"},
+		{Limit{Rate: 30, Period: time.Minute, Burst: 10}, "30;w=60;burst=10"},
+		{Limit{Rate: 10, Period: time.Hour, Burst: 10}, "10;w=3600"},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.Policy(); got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limit := Limit{Name: "signin", Rate: 1, Period: time.Minute}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	for name, limiter := range map[string]Limiter{"memory": NewMemoryLimiter(), "fallback": failingLimiter{}} {
+		t.Run(name, func(t *testing.T) {
+			handler := NewRateLimit(limiter, log).Limit(ok, limit)
+
+			req := httptest.NewRequest(http.MethodPost, "/signin", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != "0" {
+				t.Fatalf("expected the first request through, got %d %v", rec.Code, rec.Header())
+			}
+			if rec.Header().Get("RateLimit-Policy") != "1;w=60" {
+				t.Errorf("unexpected policy header %q", rec.Header().Get("RateLimit-Policy"))
+			}
+
+			rec = httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+				t.Fatalf("expected a 429 with Retry-After, got %d %v", rec.Code, rec.Header())
+			}
+
+			// the same user from another address shares nothing with the anonymous client
+			authed := req.WithContext(context.WithValue(req.Context(), types.AuthSession, types.Session{UserID: "u1"}))
+			rec = httptest.NewRecorder()
+			handler(rec, authed)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected users to be limited separately from IPs, got %d", rec.Code)
+			}
+		})
+	}
+}
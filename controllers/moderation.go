@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	validator "github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+// HiddenNotice is shown to the author of a snippet a moderator has taken down.
+const HiddenNotice = "This snippet was hidden by a moderator and is only visible to you"
+
+type ModerationController struct {
+	moderation services.ModerationStore
+	snippets   services.SnippetStore
+	spam       services.SpamStore
+	sessions   services.SessionStore
+	log        *slog.Logger
+}
+
+func NewModerationController(
+	moderation services.ModerationStore,
+	snippets services.SnippetStore,
+	spam services.SpamStore,
+	sessions services.SessionStore,
+	log *slog.Logger,
+) *ModerationController {
+	return &ModerationController{
+		moderation: moderation,
+		snippets:   snippets,
+		spam:       spam,
+		sessions:   sessions,
+		log:        log,
+	}
+}
+
+// @Summary      Report Snippet
+// @Description  Report a public snippet to the moderators. Works with or without being logged in.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Param        id    path     string            true  "Snippet ID"
+// @Param        body  body     types.ReportBody  true  "Reason category and optional details"
+// @Success      201   {object} types.Report      "Report received"
+// @Success      200   {object} utils.Response    "Snippet was already reported by the user"
+// @Failure      400   {object} utils.Response    "Invalid request or missing parameters"
+// @Failure      404   {object} utils.Response    "Snippet not found"
+// @Router       /snippets/{id}/report [post]
+func (m *ModerationController) ReportSnippet(w http.ResponseWriter, r *http.Request) {
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	var body types.ReportBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, m.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing or invalid parameters", error, m.log)
+		return
+	}
+
+	snippet, err := m.snippets.GetSnippet(id)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), err, m.log)
+		return
+	}
+
+	// only the public feed can be reported, anything else is reported as missing
+	if snippet.IsPublic != "true" || snippet.Hidden || snippet.Quarantined {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), errors.New("Snippet not public"), m.log)
+		return
+	}
+
+	if snippet.UserID == session.UserID {
+		utils.WriteErr(w, http.StatusBadRequest, "You can't report your own snippet", errors.New("Invalid report"), m.log)
+		return
+	}
+
+	var reporter_id *string
+	if session.UserID != "" {
+		reporter_id = &session.UserID
+	}
+
+	report, err := m.moderation.CreateReport(&types.Report{
+		ID:         uuid.NewString(),
+		SnippetID:  snippet.ID,
+		ReporterID: reporter_id,
+		Reason:     body.Reason,
+		Details:    body.Details,
+	})
+	if err == sql.ErrNoRows {
+		utils.WriteRes(w, http.StatusOK, "You have already reported this snippet", nil, m.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while reporting the snippet", err, m.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusCreated, "Report received", report, m.log)
+	return
+}
+
+// @Summary      Review Queue
+// @Description  List reports, open ones by default and oldest first. Moderators only.
+// @Tags         moderation
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        status  query    string  false  "open, dismissed or actioned"
+// @Param        page    query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200     {array}  types.Report    "Reports"
+// @Failure      400     {object} utils.Response  "Invalid status"
+// @Failure      403     {object} utils.Response  "Not a moderator"
+// @Router       /moderation/reports [get]
+func (m *ModerationController) GetReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+	if status != "open" && status != "dismissed" && status != "actioned" {
+		utils.WriteErr(w, http.StatusBadRequest, "Status must be one of open, dismissed or actioned", errors.New("Invalid status"), m.log)
+		return
+	}
+
+	limit := 50
+	reports, err := m.moderation.GetReports(status, utils.PageOffset(r, limit), limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching reports", err, m.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Reports found", reports, m.log)
+	return
+}
+
+// moderationNote reads the optional audit note of a moderation request, it writes the
+// error response and returns false when the body is invalid.
+func (m *ModerationController) moderationNote(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body types.ModerationBody
+	if r.ContentLength > 0 {
+		if err := utils.ParseJson(r, &body); err != nil {
+			utils.WriteErr(w, http.StatusBadRequest, "Invalid payload", err, m.log)
+			return "", false
+		}
+		if err := utils.Validate.Struct(body); err != nil {
+			error := err.(validator.ValidationErrors)
+			utils.WriteErr(w, http.StatusBadRequest, "Invalid parameters", error, m.log)
+			return "", false
+		}
+	}
+	return body.Note, true
+}
+
+// resolve applies decision to the report in the path.
+func (m *ModerationController) resolve(w http.ResponseWriter, r *http.Request, decision string) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	note, ok := m.moderationNote(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := m.moderation.ResolveReport(id, session.UserID, decision, note)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Open report with id %s not found", id), err, m.log)
+		return
+	}
+	if err == services.ErrProtectedAccount {
+		utils.WriteErr(w, http.StatusForbidden, "Moderators and admins can only be suspended through /admin/users", err, m.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to resolve report", err, m.log)
+		return
+	}
+
+	if decision == services.ModerationSuspend {
+		if err = m.sessions.DeleteUserSessions(report.AuthorID, ""); err != nil {
+			m.log.Error("MODERATION", slog.String("Unable to revoke sessions", err.Error()))
+		}
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Report resolved", report, m.log)
+	return
+}
+
+// @Summary      Dismiss Report
+// @Description  Close a report without taking action. Moderators only.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id    path     string                true   "Report ID"
+// @Param        body  body     types.ModerationBody  false  "Note for the audit trail"
+// @Success      200   {object} types.Report          "Resolved report"
+// @Failure      403   {object} utils.Response        "Not a moderator"
+// @Failure      404   {object} utils.Response        "Open report not found"
+// @Router       /moderation/reports/{id}/dismiss [post]
+func (m *ModerationController) DismissReport(w http.ResponseWriter, r *http.Request) {
+	m.resolve(w, r, services.ModerationDismiss)
+	return
+}
+
+// @Summary      Hide Reported Snippet
+// @Description  Hide the reported snippet and close every open report on it. Moderators only.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id    path     string                true   "Report ID"
+// @Param        body  body     types.ModerationBody  false  "Note for the audit trail"
+// @Success      200   {object} types.Report          "Resolved report"
+// @Failure      403   {object} utils.Response        "Not a moderator"
+// @Failure      404   {object} utils.Response        "Open report not found"
+// @Router       /moderation/reports/{id}/hide [post]
+func (m *ModerationController) HideReportedSnippet(w http.ResponseWriter, r *http.Request) {
+	m.resolve(w, r, services.ModerationHide)
+	return
+}
+
+// @Summary      Suspend Reported Author
+// @Description  Hide the reported snippet and suspend its author. Moderators only, staff accounts can only be suspended through /admin/users.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id    path     string                true   "Report ID"
+// @Param        body  body     types.ModerationBody  false  "Note for the audit trail"
+// @Success      200   {object} types.Report          "Resolved report"
+// @Failure      403   {object} utils.Response        "Not a moderator or the author is staff"
+// @Failure      404   {object} utils.Response        "Open report not found"
+// @Router       /moderation/reports/{id}/suspend [post]
+func (m *ModerationController) SuspendReportedAuthor(w http.ResponseWriter, r *http.Request) {
+	m.resolve(w, r, services.ModerationSuspend)
+	return
+}
+
+func (m *ModerationController) setHidden(w http.ResponseWriter, r *http.Request, hidden bool) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	note, ok := m.moderationNote(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.moderation.SetSnippetHidden(id, session.UserID, hidden, note)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), err, m.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to update snippet", err, m.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Hide Snippet
+// @Description  Take a snippet down without a report. Moderators only.
+// @Tags         moderation
+// @Accept       json
+// @Security     ApiKeyAuth
+// @Param        id    path  string                true   "Snippet ID"
+// @Param        body  body  types.ModerationBody  false  "Note for the audit trail"
+// @Success      204   "Snippet hidden"
+// @Failure      403   {object} utils.Response  "Not a moderator"
+// @Failure      404   {object} utils.Response  "Snippet not found"
+// @Router       /moderation/snippets/{id}/hide [post]
+func (m *ModerationController) HideSnippet(w http.ResponseWriter, r *http.Request) {
+	m.setHidden(w, r, true)
+	return
+}
+
+// @Summary      Restore Snippet
+// @Description  Restore a hidden snippet. Moderators only.
+// @Tags         moderation
+// @Accept       json
+// @Security     ApiKeyAuth
+// @Param        id    path  string                true   "Snippet ID"
+// @Param        body  body  types.ModerationBody  false  "Note for the audit trail"
+// @Success      204   "Snippet restored"
+// @Failure      403   {object} utils.Response  "Not a moderator"
+// @Failure      404   {object} utils.Response  "Snippet not found"
+// @Router       /moderation/snippets/{id}/hide [delete]
+func (m *ModerationController) UnhideSnippet(w http.ResponseWriter, r *http.Request) {
+	m.setHidden(w, r, false)
+	return
+}
+
+// @Summary      Audit Trail
+// @Description  List moderation decisions, newest first. Moderators only.
+// @Tags         moderation
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  types.AuditEntry  "Audit entries"
+// @Failure      403   {object} utils.Response    "Not a moderator"
+// @Router       /moderation/audit [get]
+func (m *ModerationController) GetAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	entries, err := m.moderation.GetAudit(utils.PageOffset(r, limit), limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching audit trail", err, m.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Audit trail found", entries, m.log)
+	return
+}
+
+// @Summary      Quarantine Queue
+// @Description  List the snippets quarantined as spam, oldest first. Moderators only.
+// @Tags         moderation
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  types.SnippetWithUser  "Quarantined snippets"
+// @Failure      403   {object} utils.Response         "Not a moderator"
+// @Router       /moderation/quarantine [get]
+func (m *ModerationController) GetQuarantined(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	snippets, err := m.moderation.GetQuarantined(utils.PageOffset(r, limit), limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching snippets", err, m.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Quarantined snippets found", snippets, m.log)
+	return
+}
+
+// @Summary      Spam Scores
+// @Description  List the spam checks of a snippet with the signals behind each score, newest first. Moderators only.
+// @Tags         moderation
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id   path     string           true  "Snippet ID"
+// @Success      200  {array}  types.SpamScore  "Score breakdowns"
+// @Failure      403  {object} utils.Response   "Not a moderator"
+// @Router       /moderation/snippets/{id}/spam [get]
+func (m *ModerationController) GetSpamScores(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	scores, err := m.spam.GetSpamScores(id)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching spam scores", err, m.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Spam scores found", scores, m.log)
+	return
+}
+
+// @Summary      Release Snippet
+// @Description  Lift the quarantine of a snippet that was wrongly scored as spam. Moderators only.
+// @Tags         moderation
+// @Accept       json
+// @Security     ApiKeyAuth
+// @Param        id    path  string                true   "Snippet ID"
+// @Param        body  body  types.ModerationBody  false  "Note for the audit trail"
+// @Success      204   "Snippet released"
+// @Failure      403   {object} utils.Response  "Not a moderator"
+// @Failure      404   {object} utils.Response  "Quarantined snippet not found"
+// @Router       /moderation/snippets/{id}/release [post]
+func (m *ModerationController) ReleaseSnippet(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	note, ok := m.moderationNote(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.moderation.ReleaseSnippet(id, session.UserID, note)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Quarantined snippet with id %s not found", id), err, m.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to release snippet", err, m.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type NotificationController struct {
+	notifications services.NotificationStore
+	stream        services.StreamStore
+	log           *slog.Logger
+}
+
+func NewNotificationController(notifications services.NotificationStore, stream services.StreamStore, log *slog.Logger) *NotificationController {
+	return &NotificationController{
+		notifications: notifications,
+		stream:        stream,
+		log:           log,
+	}
+}
+
+// @Summary      List Notifications
+// @Description  List the notifications of the signed in user newest first, along with the number of unread ones.
+// @Tags         notifications
+// @Produce      json
+// @Param        unread  query    bool    false  "Only list unread notifications"
+// @Param        page    query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200     {object} types.Notifications  "Notifications"
+// @Failure      401     {object} utils.Response       "Unauthorized access"
+// @Router       /notifications [get]
+func (n *NotificationController) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	query := r.URL.Query()
+
+	limit := 20
+	offset := utils.PageOffset(r, limit)
+	unread, _ := strconv.ParseBool(query.Get("unread"))
+
+	notifications, err := n.notifications.GetNotifications(session.UserID, unread, offset, limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while fetching notifications", err, n.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Notifications found", notifications, n.log)
+	return
+}
+
+// @Summary      Mark Notification Read
+// @Tags         notifications
+// @Produce      json
+// @Param        id   path     string  true  "Notification ID"
+// @Success      200  {object} utils.Response  "Notification marked as read"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "Unread notification not found"
+// @Router       /notifications/{id}/read [post]
+func (n *NotificationController) MarkRead(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	err := n.notifications.MarkRead(id, session.UserID)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Unread notification with id %s not found", id), err, n.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while updating the notification", err, n.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Notification marked as read", "", n.log)
+	return
+}
+
+// @Summary      Mark All Notifications Read
+// @Tags         notifications
+// @Produce      json
+// @Success      200  {object} utils.Response  "Notifications marked as read"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Router       /notifications/read [post]
+func (n *NotificationController) MarkAllRead(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	if err := n.notifications.MarkAllRead(session.UserID); err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while updating notifications", err, n.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Notifications marked as read", "", n.log)
+	return
+}
+
+// @Summary      Get Notification Preferences
+// @Description  List every notification type and whether the signed in user receives it.
+// @Tags         notifications
+// @Produce      json
+// @Success      200  {object} types.NotificationPreferences  "Preferences"
+// @Failure      401  {object} utils.Response                 "Unauthorized access"
+// @Router       /me/notification-preferences [get]
+func (n *NotificationController) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	preferences, err := n.notifications.GetPreferences(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while fetching preferences", err, n.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Preferences found", preferences, n.log)
+	return
+}
+
+// @Summary      Update Notification Preferences
+// @Description  Turn notification types on or off, types left out keep their setting.
+// @Tags         notifications
+// @Accept       json
+// @Produce      json
+// @Param        preferences  body     types.NotificationPreferences  true  "Types to change, e.g. {\"user.followed\": false}"
+// @Success      200          {object} types.NotificationPreferences  "Preferences"
+// @Failure      400          {object} utils.Response                 "Unknown notification type"
+// @Failure      401          {object} utils.Response                 "Unauthorized access"
+// @Router       /me/notification-preferences [patch]
+func (n *NotificationController) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.NotificationPreferences
+	if err := utils.ParseJson(r, &body); err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, n.log)
+		return
+	}
+
+	for t := range body {
+		if !slices.Contains(services.NotificationTypes, t) {
+			utils.WriteErr(w, http.StatusBadRequest, fmt.Sprintf("Unknown notification type %s", t), errors.New("Invalid type"), n.log)
+			return
+		}
+	}
+
+	preferences, err := n.notifications.SetPreferences(session.UserID, body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while updating preferences", err, n.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Preferences updated", preferences, n.log)
+	return
+}
@@ -0,0 +1,576 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	validator "github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/events"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+// slugs end up in urls so they are kept to lowercase letters, digits and dashes
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+type OrgController struct {
+	orgs     services.OrgStore
+	users    services.UserStore
+	snippets services.SnippetStore
+	events   events.Publisher
+	log      *slog.Logger
+}
+
+func NewOrgController(
+	orgs services.OrgStore,
+	users services.UserStore,
+	snippets services.SnippetStore,
+	publisher events.Publisher,
+	log *slog.Logger,
+) *OrgController {
+	return &OrgController{
+		orgs:     orgs,
+		users:    users,
+		snippets: snippets,
+		events:   publisher,
+		log:      log,
+	}
+}
+
+// org fetches the org in the path along with the session's role in it, the role is empty
+// when the session isn't a member. The error response has been written when ok is false.
+func (o *OrgController) org(w http.ResponseWriter, r *http.Request, session types.Session) (org *services.Org, role string, ok bool) {
+	slug := r.PathValue("slug")
+	org, err := o.orgs.GetOrg(slug)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Org %s not found", slug), err, o.log)
+		return nil, "", false
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching org", err, o.log)
+		return nil, "", false
+	}
+
+	if session.UserID == "" {
+		return org, "", true
+	}
+
+	role, err = o.orgs.GetMemberRole(org.ID, session.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching org membership", err, o.log)
+		return nil, "", false
+	}
+	return org, role, true
+}
+
+func (o *OrgController) forbidden(w http.ResponseWriter) {
+	utils.WriteErr(w, http.StatusForbidden, "You are not authorized to access this resource", errors.New("Not authorized"), o.log)
+}
+
+// @Summary      Create Org
+// @Description  Create an organisation, the creator becomes its first owner.
+// @Tags         orgs
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        body  body     services.Org    true  "Slug, name and description of the org"
+// @Success      201   {object} services.Org    "Created org"
+// @Failure      400   {object} utils.Response  "Invalid request or missing parameters"
+// @Failure      401   {object} utils.Response  "Unauthorized access"
+// @Failure      409   {object} utils.Response  "Slug already taken"
+// @Router       /orgs [post]
+func (o *OrgController) CreateOrg(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body services.Org
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, o.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing parameters", error, o.log)
+		return
+	}
+
+	if !slugPattern.MatchString(body.Slug) {
+		utils.WriteErr(w, http.StatusBadRequest, "Slug may only contain lowercase letters, digits and dashes", errors.New("Invalid slug"), o.log)
+		return
+	}
+
+	if _, err = o.orgs.GetOrg(body.Slug); err == nil {
+		utils.WriteErr(w, http.StatusConflict, fmt.Sprintf("Org %s already exists", body.Slug), errors.New("Duplicate slug"), o.log)
+		return
+	}
+
+	body.ID = uuid.NewString()
+	org, err := o.orgs.CreateOrg(&body, session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating the org", err, o.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusCreated, "Org created", org, o.log)
+	return
+}
+
+// @Summary      List Orgs
+// @Description  List the orgs the current user is a member of, along with their role.
+// @Tags         orgs
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200  {array}  services.Org    "Orgs of the user"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /orgs [get]
+func (o *OrgController) GetOrgs(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	orgs, err := o.orgs.GetUserOrgs(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching orgs", err, o.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Orgs found", orgs, o.log)
+	return
+}
+
+// @Summary      Get Org
+// @Description  Get an org by its slug.
+// @Tags         orgs
+// @Produce      json
+// @Param        slug  path     string          true  "Org slug"
+// @Success      200   {object} services.Org    "Org details"
+// @Failure      404   {object} utils.Response  "Org not found"
+// @Router       /orgs/{slug} [get]
+func (o *OrgController) GetOrg(w http.ResponseWriter, r *http.Request) {
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+	org.Role = role
+
+	utils.WriteRes(w, http.StatusOK, "Org found", org, o.log)
+	return
+}
+
+// @Summary      Update Org
+// @Description  Update the name and description of an org. Owners only.
+// @Tags         orgs
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        slug  path     string              true  "Org slug"
+// @Param        body  body     types.UpdateOrgBody true  "New name and description"
+// @Success      200   {object} services.Org        "Updated org"
+// @Failure      400   {object} utils.Response      "Invalid request or missing parameters"
+// @Failure      403   {object} utils.Response      "Not an owner of the org"
+// @Failure      404   {object} utils.Response      "Org not found"
+// @Router       /orgs/{slug} [patch]
+func (o *OrgController) UpdateOrg(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.UpdateOrgBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, o.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing parameters", error, o.log)
+		return
+	}
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+	if !policy.CanOrg(role) {
+		o.forbidden(w)
+		return
+	}
+
+	org.Name = body.Name
+	org.Description = body.Description
+	org, err = o.orgs.UpdateOrg(org)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to update org", err, o.log)
+		return
+	}
+	org.Role = role
+
+	utils.WriteRes(w, http.StatusOK, "Org updated", org, o.log)
+	return
+}
+
+// @Summary      Delete Org
+// @Description  Delete an org. Its snippets are handed back to their authors. Owners only.
+// @Tags         orgs
+// @Security     ApiKeyAuth
+// @Param        slug  path  string  true  "Org slug"
+// @Success      204   "Org deleted"
+// @Failure      403   {object} utils.Response  "Not an owner of the org"
+// @Failure      404   {object} utils.Response  "Org not found"
+// @Router       /orgs/{slug} [delete]
+func (o *OrgController) DeleteOrg(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+	if !policy.CanOrg(role) {
+		o.forbidden(w)
+		return
+	}
+
+	if err := o.orgs.DeleteOrg(org.ID); err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while deleting the org", err, o.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      List Org Members
+// @Description  List the members of an org. Members only.
+// @Tags         orgs
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        slug  path     string           true  "Org slug"
+// @Success      200   {array}  types.OrgMember  "Members of the org"
+// @Failure      403   {object} utils.Response   "Not a member of the org"
+// @Failure      404   {object} utils.Response   "Org not found"
+// @Router       /orgs/{slug}/members [get]
+func (o *OrgController) GetMembers(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+	if role == "" {
+		o.forbidden(w)
+		return
+	}
+
+	members, err := o.orgs.GetMembers(org.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching members", err, o.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Members found", members, o.log)
+	return
+}
+
+// @Summary      Change Member Role
+// @Description  Change the role of a member to owner, maintainer or member. Owners only.
+// @Tags         orgs
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        slug  path     string               true  "Org slug"
+// @Param        id    path     string               true  "User ID of the member"
+// @Param        body  body     types.UpdateRoleBody true  "New role"
+// @Success      204   "Role updated"
+// @Failure      400   {object} utils.Response       "Invalid role"
+// @Failure      403   {object} utils.Response       "Not an owner of the org"
+// @Failure      404   {object} utils.Response       "Member not found"
+// @Router       /orgs/{slug}/members/{id} [patch]
+func (o *OrgController) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	var body types.UpdateRoleBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, o.log)
+		return
+	}
+
+	if body.Role != policy.OrgOwner && body.Role != policy.OrgMaintainer && body.Role != policy.OrgMember {
+		utils.WriteErr(w, http.StatusBadRequest, "Role must be one of owner, maintainer or member", errors.New("Invalid role"), o.log)
+		return
+	}
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+	if !policy.CanOrg(role) {
+		o.forbidden(w)
+		return
+	}
+
+	// an org must always be left with an owner
+	if id == session.UserID {
+		utils.WriteErr(w, http.StatusBadRequest, "You can't change your own role", errors.New("Invalid member"), o.log)
+		return
+	}
+
+	err = o.orgs.UpdateMemberRole(org.ID, id, body.Role)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Member with id %s not found", id), err, o.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to update member", err, o.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Remove Member
+// @Description  Remove a member from an org. Owners can remove anyone but themselves, members can remove themselves.
+// @Tags         orgs
+// @Security     ApiKeyAuth
+// @Param        slug  path  string  true  "Org slug"
+// @Param        id    path  string  true  "User ID of the member"
+// @Success      204   "Member removed"
+// @Failure      400   {object} utils.Response  "Owners can't leave their org"
+// @Failure      403   {object} utils.Response  "Not an owner of the org"
+// @Failure      404   {object} utils.Response  "Member not found"
+// @Router       /orgs/{slug}/members/{id} [delete]
+func (o *OrgController) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+
+	if id == session.UserID {
+		if policy.CanOrg(role) {
+			utils.WriteErr(w, http.StatusBadRequest, "Owners can't leave their org, hand it over or delete it instead", errors.New("Invalid member"), o.log)
+			return
+		}
+	} else if !policy.CanOrg(role) {
+		o.forbidden(w)
+		return
+	}
+
+	err := o.orgs.RemoveMember(org.ID, id)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Member with id %s not found", id), err, o.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to remove member", err, o.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Invite Member
+// @Description  Invite a user to an org by their username. Owners only.
+// @Tags         orgs
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        slug  path     string            true  "Org slug"
+// @Param        body  body     types.InviteBody  true  "Username and role of the invitee"
+// @Success      201   {object} types.OrgInvite   "Created invite"
+// @Failure      400   {object} utils.Response    "Invalid request or missing parameters"
+// @Failure      403   {object} utils.Response    "Not an owner of the org"
+// @Failure      404   {object} utils.Response    "Org or user not found"
+// @Failure      409   {object} utils.Response    "User is already a member"
+// @Router       /orgs/{slug}/invites [post]
+func (o *OrgController) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.InviteBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, o.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing or invalid parameters", error, o.log)
+		return
+	}
+
+	org, role, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+	if !policy.CanOrg(role) {
+		o.forbidden(w)
+		return
+	}
+
+	user, err := o.users.GetUser("username", body.Username)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User %s not found", body.Username), err, o.log)
+		return
+	}
+
+	if _, err = o.orgs.GetMemberRole(org.ID, user.ID); err == nil {
+		utils.WriteErr(w, http.StatusConflict, fmt.Sprintf("%s is already a member", body.Username), errors.New("Already a member"), o.log)
+		return
+	}
+
+	invite, err := o.orgs.CreateInvite(&types.OrgInvite{
+		ID:        uuid.NewString(),
+		OrgID:     org.ID,
+		UserID:    user.ID,
+		Role:      body.Role,
+		InvitedBy: session.UserID,
+	})
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating the invite", err, o.log)
+		return
+	}
+	invite.OrgSlug = org.Slug
+
+	o.events.Publish(r.Context(), events.Event{
+		Type:    events.OrgInvited,
+		UserID:  user.ID,
+		ActorID: session.UserID,
+		OrgID:   org.ID,
+	})
+
+	utils.WriteRes(w, http.StatusCreated, "Invite created", invite, o.log)
+	return
+}
+
+// @Summary      List Invites
+// @Description  List the pending org invites of the current user.
+// @Tags         orgs
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200  {array}  types.OrgInvite  "Pending invites"
+// @Failure      401  {object} utils.Response   "Unauthorized access"
+// @Router       /me/invites [get]
+func (o *OrgController) GetInvites(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	invites, err := o.orgs.GetUserInvites(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching invites", err, o.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Invites found", invites, o.log)
+	return
+}
+
+// @Summary      Accept Invite
+// @Description  Accept an org invite and join the org with the role it was sent with.
+// @Tags         orgs
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        id   path     string           true  "Invite ID"
+// @Success      200  {object} types.OrgMember  "New membership"
+// @Failure      404  {object} utils.Response   "Invite not found"
+// @Router       /me/invites/{id}/accept [post]
+func (o *OrgController) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	member, err := o.orgs.AcceptInvite(id, session.UserID)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Invite with id %s not found", id), err, o.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to accept invite", err, o.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Invite accepted", member, o.log)
+	return
+}
+
+// @Summary      Decline Invite
+// @Description  Decline an org invite.
+// @Tags         orgs
+// @Security     ApiKeyAuth
+// @Param        id   path  string  true  "Invite ID"
+// @Success      204  "Invite declined"
+// @Failure      404  {object} utils.Response  "Invite not found"
+// @Router       /me/invites/{id} [delete]
+func (o *OrgController) DeclineInvite(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	err := o.orgs.DeleteInvite(id, session.UserID)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Invite with id %s not found", id), err, o.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to decline invite", err, o.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Get Org Snippets
+// @Description  Retrieve the snippets owned by an org. Only members see snippets that aren't public.
+// @Tags         orgs
+// @Produce      json
+// @Param        slug   path     string  true   "Org slug"
+// @Param        page   query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Param        param  query    string  false  "Search parameter to filter snippets"
+// @Param        lang   query    string  false  "Programming language to filter snippets"
+// @Success      200    {array}  types.SnippetWithUser  "Snippets of the org"
+// @Failure      404    {object} utils.Response         "Org not found"
+// @Router       /orgs/{slug}/snippets [get]
+func (o *OrgController) GetOrgSnippets(w http.ResponseWriter, r *http.Request) {
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
+	query := r.URL.Query()
+	page := query.Get("page")
+	param := concatParam(query.Get("param"))
+	lang := query.Get("lang")
+	var offset int
+	limit := 20
+	if p, err := strconv.Atoi(page); err != nil || p <= 0 {
+		offset = 0
+	} else {
+		offset = (p - 1) * limit
+	}
+
+	org, _, ok := o.org(w, r, session)
+	if !ok {
+		return
+	}
+
+	snippets, err := o.snippets.GetOrgSnippets(org.ID, session.UserID, offset, limit, param, lang)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching snippets", err, o.log)
+		return
+	}
+
+	if utils.NotModified(w, r, utils.BodyETag(snippets)) {
+		return
+	}
+	utils.WriteRes(w, http.StatusOK, "Org's snippets found", snippets, o.log)
+	return
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"snipnet/types"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+type Permission string
+
+const (
+	// ModerateSnippets lets a user read and take down snippets they don't own.
+	ModerateSnippets Permission = "snippets:moderate"
+	// ManageUsers lets a user list every account, change roles and suspend accounts.
+	ManageUsers Permission = "users:manage"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleUser:      {},
+	RoleModerator: {ModerateSnippets},
+	RoleAdmin:     {ModerateSnippets, ManageUsers},
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func Has(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type Action int
+
+const (
+	Read Action = iota
+	Update
+	Delete
+	// Share is managing who the snippet is shared with.
+	Share
+)
+
+// Org roles, an org's owners manage the org itself while maintainers only manage its snippets.
+const (
+	OrgOwner      = "owner"
+	OrgMaintainer = "maintainer"
+	OrgMember     = "member"
+)
+
+// Collaborator permissions, write lets a collaborator edit the snippet but not delete it.
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+)
+
+// Access is what the session is to a snippet beyond being its author, it is looked up by
+// the caller since it lives outside the snippet itself.
+type Access struct {
+	// OrgRole is the session's role in the org owning the snippet, empty if it isn't a member.
+	OrgRole string
+	// Collaborator is the permission the snippet was shared with the session with, if any.
+	Collaborator string
+}
+
+// CanSnippet decides whether the session may perform action on the snippet. Handlers call
+// it instead of comparing user ids themselves.
+func CanSnippet(session types.Session, snippet *types.SnippetWithUser, access Access, action Action) bool {
+	if session.UserID != "" && session.UserID == snippet.UserID {
+		return true
+	}
+
+	// a hidden snippet is out of everyone's reach but its author's until a moderator restores it
+	if snippet.Hidden {
+		return (action == Read || action == Delete) && Has(session.Role, ModerateSnippets)
+	}
+
+	orgAdmin := access.OrgRole == OrgOwner || access.OrgRole == OrgMaintainer
+
+	switch action {
+	case Read:
+		public := snippet.IsPublic == "true" && !snippet.Quarantined
+		return public || access.OrgRole != "" || access.Collaborator != "" ||
+			Has(session.Role, ModerateSnippets)
+	case Update:
+		return orgAdmin || access.Collaborator == PermissionWrite
+	case Delete:
+		return orgAdmin || Has(session.Role, ModerateSnippets)
+	case Share:
+		return orgAdmin
+	default:
+		return false
+	}
+}
+
+// CanOrg decides whether a member with role may manage the org's settings and members.
+func CanOrg(role string) bool {
+	return role == OrgOwner
+}
+
+// CanUser decides whether the session may see the private details of a user.
+func CanUser(session types.Session, user_id string) bool {
+	return session.UserID == user_id || Has(session.Role, ManageUsers)
+}
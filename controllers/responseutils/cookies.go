@@ -0,0 +1,88 @@
+package responseutils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookie = "snipnet_session"
+	RefreshCookie = "snipnet_refresh"
+	CSRFCookie    = "snipnet_csrf"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// CookieConfig controls the optional cookie based sessions used by browser clients.
+type CookieConfig struct {
+	Enabled  bool
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+}
+
+// CookieConfigFromEnv reads COOKIE_SESSIONS, COOKIE_SECURE, COOKIE_SAMESITE and COOKIE_DOMAIN.
+// Cookies are Secure unless COOKIE_SECURE is explicitly false, e.g for local development.
+func CookieConfigFromEnv() CookieConfig {
+	sameSite := http.SameSiteLaxMode
+	switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return CookieConfig{
+		Enabled:  os.Getenv("COOKIE_SESSIONS") == "true",
+		Secure:   os.Getenv("COOKIE_SECURE") != "false",
+		SameSite: sameSite,
+		Domain:   os.Getenv("COOKIE_DOMAIN"),
+	}
+}
+
+// CSRFToken is derived from the session id, so it can be checked without storing it and
+// can't be computed by anyone who can't read the HttpOnly session cookie.
+func CSRFToken(session_id string) string {
+	sum := sha256.Sum256([]byte("csrf:" + session_id))
+	return hex.EncodeToString(sum[:])
+}
+
+func ValidCSRFToken(session_id, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(CSRFToken(session_id)), []byte(token)) == 1
+}
+
+func (c CookieConfig) cookie(name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.Domain,
+		Expires:  expires,
+		Secure:   c.Secure,
+		HttpOnly: httpOnly,
+		SameSite: c.SameSite,
+	}
+}
+
+// SetSession writes the session, refresh and CSRF cookies. The CSRF cookie is readable by
+// scripts so the client can echo it back in the X-CSRF-Token header.
+func (c CookieConfig) SetSession(w http.ResponseWriter, session_id, refresh_token string, expires time.Time) {
+	http.SetCookie(w, c.cookie(SessionCookie, session_id, "/", expires, true))
+	http.SetCookie(w, c.cookie(RefreshCookie, refresh_token, "/token/refresh", expires, true))
+	http.SetCookie(w, c.cookie(CSRFCookie, CSRFToken(session_id), "/", expires, false))
+}
+
+func (c CookieConfig) ClearSession(w http.ResponseWriter) {
+	for _, name := range []string{SessionCookie, CSRFCookie} {
+		cookie := c.cookie(name, "", "/", time.Unix(0, 0), name != CSRFCookie)
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+	cookie := c.cookie(RefreshCookie, "", "/token/refresh", time.Unix(0, 0), true)
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,83 @@
+package responseutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VersionETag is the entity tag of a resource with a version column.
+func VersionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// RepresentationETag is the entity tag of a response showing a resource with a version
+// along with data that changes without it, such as the author of a snippet. It starts with
+// the version so MatchVersion still takes it for writes.
+func RepresentationETag(version int, data interface{}) string {
+	return `"` + strconv.Itoa(version) + "-" + strings.Trim(BodyETag(data), `"`) + `"`
+}
+
+// MatchVersion reports whether an If-Match header has a strong tag of version, from
+// VersionETag or RepresentationETag. "*" matches anything.
+func MatchVersion(header string, version int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		tag = strings.Trim(tag, `"`)
+		tag, _, _ = strings.Cut(tag, "-")
+		if v, err := strconv.Atoi(tag); err == nil && v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// BodyETag is the entity tag of a response without a version of its own, such as a listing,
+// it changes whenever the data does.
+func BodyETag(data interface{}) string {
+	b, _ := json.Marshal(data)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// MatchETag reports whether etag is in header, a list of entity tags as sent in If-Match
+// and If-None-Match. "*" matches anything. Weak tags only match when weak is set, If-Match
+// compares strongly and If-None-Match weakly.
+func MatchETag(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified sets the ETag of a GET response and, when the client's If-None-Match already
+// has it, answers 304 Not Modified. The response has been written when it returns true.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && MatchETag(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package responseutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{`"3"`, `"3"`, false, true},
+		{`"2", "3"`, `"3"`, false, true},
+		{`"2"`, `"3"`, false, false},
+		{`*`, `"3"`, false, true},
+		{`W/"3"`, `"3"`, false, false},
+		{`W/"3"`, `"3"`, true, true},
+		{`"3"`, `W/"3"`, true, true},
+	}
+	for _, tt := range tests {
+		if got := MatchETag(tt.header, tt.etag, tt.weak); got != tt.want {
+			t.Errorf("MatchETag(%s, %s, %v) = %v, want %v", tt.header, tt.etag, tt.weak, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	etag := BodyETag([]string{"a", "b"})
+	if etag != BodyETag([]string{"a", "b"}) || etag == BodyETag([]string{"a"}) {
+		t.Fatal("expected BodyETag to follow the data")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/snippets", nil)
+	w := httptest.NewRecorder()
+	if NotModified(w, r, etag) || w.Header().Get("ETag") != etag {
+		t.Errorf("expected a full response with the ETag set, got %d", w.Code)
+	}
+
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	if !NotModified(w, r, etag) || w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+}
+
+func TestMatchVersion(t *testing.T) {
+	etag := RepresentationETag(3, map[string]string{"username": "a"})
+	if etag == RepresentationETag(3, map[string]string{"username": "b"}) {
+		t.Fatal("expected RepresentationETag to follow the data")
+	}
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{etag, true},
+		{VersionETag(3), true},
+		{`"2", ` + etag, true},
+		{RepresentationETag(2, nil), false},
+		{`W/` + etag, false},
+		{`*`, true},
+		{`"3x"`, false},
+	}
+	for _, tt := range tests {
+		if got := MatchVersion(tt.header, 3); got != tt.want {
+			t.Errorf("MatchVersion(%s, 3) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -1,25 +1,75 @@
 package responseutils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 )
 
 type Response struct {
-	Status  bool        `json:"status"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+	Status   bool        `json:"status"`
+	Message  string      `json:"message"`
+	Data     interface{} `json:"data,omitempty"`
+	Warnings interface{} `json:"warnings,omitempty"`
 }
 
 func GenerateSessionID() string {
 	return uuid.NewString()
 }
 
+// TokenPrefix marks personal access tokens so they can be told apart from session ids.
+const TokenPrefix = "snp_"
+
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return TokenPrefix + hex.EncodeToString(b), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP returns the address of the client, X-Forwarded-For is only trusted when
+// TRUST_PROXY_HEADERS is set since it can be forged by anyone talking to the API directly.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			ip, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// PageOffset is the offset of the page query parameter with limit items per page, pages
+// start at 1 and anything else is the first one.
+func PageOffset(r *http.Request, limit int) int {
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		return (p - 1) * limit
+	}
+	return 0
+}
+
 func ParseJson(r *http.Request, payload interface{}) error {
 	if r.Body == nil {
 		return errors.New("Request payload missing")
@@ -40,6 +90,31 @@ func WriteErr(w http.ResponseWriter, status_code int, message string, err error,
 	}
 }
 
+// WriteErrData is WriteErr for errors the client can act on, data tells it what to fix.
+func WriteErrData(w http.ResponseWriter, status_code int, message string, data interface{}, log *slog.Logger) {
+	log.Error("RESPONSE", slog.String("error", message))
+	res := create_res(false, message, data)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status_code)
+	encode_err := json.NewEncoder(w).Encode(res)
+	if encode_err != nil {
+		log.Error("[RESPONSE]", slog.String("Error sending response to user:", encode_err.Error()))
+	}
+}
+
+// WriteResWarn is WriteRes for requests that went through but deserve the client's attention.
+func WriteResWarn(w http.ResponseWriter, status_code int, message string, data, warnings interface{}, log *slog.Logger) {
+	log.Info("RESPONSE", slog.String("message", message))
+	res := create_res(true, message, data)
+	res.Warnings = warnings
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status_code)
+	encode_err := json.NewEncoder(w).Encode(res)
+	if encode_err != nil {
+		log.Error("[RESPONSE]", slog.String("Error sending response to user:", encode_err.Error()))
+	}
+}
+
 func WriteRes(w http.ResponseWriter, status_code int, message string, data interface{}, log *slog.Logger) {
 	log.Info("RESPONSE", slog.String("message", message))
 	res := create_res(true, message, data)
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type SessionController struct {
+	sessions services.SessionStore
+	log      *slog.Logger
+}
+
+func NewSessionController(sessions services.SessionStore, log *slog.Logger) *SessionController {
+	return &SessionController{
+		sessions: sessions,
+		log:      log,
+	}
+}
+
+// @Summary      List Sessions
+// @Description  List the active sessions of the current user, most recently used first.
+// @Tags         sessions
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200  {array}  types.Session   "Active sessions"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /sessions [get]
+func (s *SessionController) GetSessions(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	sessions, err := s.sessions.GetUserSessions(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching sessions", err, s.log)
+		return
+	}
+
+	for _, sess := range *sessions {
+		sess.Current = sess.ID == session.ID
+	}
+	sort.Slice(*sessions, func(i, j int) bool {
+		return (*sessions)[i].LastSeen.After((*sessions)[j].LastSeen)
+	})
+
+	utils.WriteRes(w, http.StatusOK, "Sessions found", sessions, s.log)
+	return
+}
+
+// @Summary      Revoke Session
+// @Description  Sign a single session out, e.g a lost device.
+// @Tags         sessions
+// @Security     ApiKeyAuth
+// @Param        id   path     string  true  "Session ID to be revoked"
+// @Success      204  "Session revoked, no content returned"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "Session not found"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /sessions/{id} [delete]
+func (s *SessionController) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	err := s.sessions.DeleteSession(session.UserID, id)
+	if err == redis.Nil {
+		utils.WriteErr(w, http.StatusNotFound, "Session not found", err, s.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to revoke session, please try again", err, s.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Revoke Other Sessions
+// @Description  Sign out of every session except the one making this request.
+// @Tags         sessions
+// @Security     ApiKeyAuth
+// @Success      204  "Sessions revoked, no content returned"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /sessions [delete]
+func (s *SessionController) DeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	err := s.sessions.DeleteUserSessions(session.UserID, session.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to revoke sessions, please try again", err, s.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Create Stream Ticket
+// @Description  Issue a single use ticket for the WebSocket and event stream routes, which browsers open without an Authorization header. Pass it in the ticket query parameter within 30 seconds, it stands for the session or token that created it.
+// @Tags         sessions
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      201  {object} types.StreamTicket  "Ticket issued"
+// @Failure      401  {object} utils.Response      "Unauthorized access"
+// @Failure      500  {object} utils.Response      "Internal server error"
+// @Router       /stream/tickets [post]
+func (s *SessionController) CreateTicket(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	ticket, err := s.sessions.CreateTicket(&session)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to issue a ticket, please try again", err, s.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusCreated, "Ticket issued", ticket, s.log)
+	return
+}
@@ -1,39 +1,211 @@
 package controllers
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 
 	validator "github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	redis "github.com/redis/go-redis/v9"
 
+	"snipnet/controllers/policy"
 	utils "snipnet/controllers/responseutils"
+	"snipnet/events"
 	"snipnet/services"
+	"snipnet/services/patch"
+	"snipnet/services/secrets"
+	"snipnet/services/spam"
 	"snipnet/types"
 )
 
 type SnippetController struct {
-	snippets services.SnippetStore
-	log      *slog.Logger
-	cache    *redis.Client
+	snippets      services.SnippetStore
+	orgs          services.OrgStore
+	collaborators services.CollaboratorStore
+	users         services.UserStore
+	spam          services.SpamStore
+	spamRules     spam.Config
+	events        events.Publisher
+	stream        services.StreamStore
+	log           *slog.Logger
+	cache         *redis.Client
 }
 
 func NewSnippetController(
 	snippet services.SnippetStore,
+	orgs services.OrgStore,
+	collaborators services.CollaboratorStore,
+	users services.UserStore,
+	spamScores services.SpamStore,
+	spamRules spam.Config,
+	publisher events.Publisher,
+	stream services.StreamStore,
 	log *slog.Logger,
 	cache *redis.Client,
 ) *SnippetController {
 	return &SnippetController{
-		snippets: snippet,
-		log:      log,
-		cache:    cache,
+		snippets:      snippet,
+		orgs:          orgs,
+		collaborators: collaborators,
+		users:         users,
+		spam:          spamScores,
+		spamRules:     spamRules,
+		events:        publisher,
+		stream:        stream,
+		log:           log,
+		cache:         cache,
 	}
 }
 
+// access looks up what the session is to the snippet for policy.CanSnippet.
+func (s *SnippetController) access(session types.Session, snippet *types.SnippetWithUser) policy.Access {
+	var access policy.Access
+	if session.UserID == "" || session.UserID == snippet.UserID {
+		return access
+	}
+
+	if snippet.OrgID != nil {
+		role, err := s.orgs.GetMemberRole(*snippet.OrgID, session.UserID)
+		if err != nil && err != sql.ErrNoRows {
+			s.log.Error("SNIPPET", slog.String("Unable to fetch org role", err.Error()))
+		}
+		access.OrgRole = role
+	}
+
+	permission, err := s.collaborators.GetPermission(snippet.ID, session.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		s.log.Error("SNIPPET", slog.String("Unable to fetch collaborator permission", err.Error()))
+	}
+	access.Collaborator = permission
+	return access
+}
+
+const secretsMessage = "The code looks like it contains credentials, remove them or make the snippet private"
+
+// scanSecrets scans code for credentials before it is saved. Public snippets with findings
+// are rejected unless their owner acknowledged them with ?acknowledge_secrets=true, the
+// findings are returned so the handler can warn about them otherwise.
+func scanSecrets(r *http.Request, code string, public, owner bool) (findings []secrets.Finding, ok bool) {
+	findings = secrets.Scan(code)
+	if len(findings) == 0 || !public {
+		return findings, true
+	}
+	return findings, owner && r.URL.Query().Get("acknowledge_secrets") == "true"
+}
+
+// checkSecrets is scanSecrets for handlers saving a single snippet, the error response has
+// been written when ok is false.
+func (s *SnippetController) checkSecrets(
+	w http.ResponseWriter,
+	r *http.Request,
+	code string,
+	public bool,
+	owner bool,
+) (findings []secrets.Finding, ok bool) {
+	findings, ok = scanSecrets(r, code, public, owner)
+	if ok {
+		return findings, true
+	}
+
+	utils.WriteErrData(
+		w,
+		http.StatusUnprocessableEntity,
+		secretsMessage,
+		findings,
+		s.log,
+	)
+	return nil, false
+}
+
+// scoreSpam scores a snippet before it is saved, the store records the result along with
+// the snippet and a public snippet that scores too high is saved quarantined until a
+// moderator reviews it. Failures are only logged so a broken check never stops anyone from
+// saving. pending is how many of the author's snippets are about to be created along with
+// this one, they count as recent posts.
+func (s *SnippetController) scoreSpam(snippet *services.Snippet, pending int) {
+	input, err := s.spam.GetSpamInput(snippet.UserID, snippet.Code)
+	if err != nil {
+		s.log.Error("SPAM", slog.String("Unable to gather spam signals", err.Error()))
+		return
+	}
+	input.Title = snippet.Title
+	input.Description = snippet.Description
+	input.Code = snippet.Code
+	input.RecentPosts += pending
+
+	result := spam.Score(s.spamRules, *input)
+	snippet.Spam = &result
+}
+
+// writeSnippet writes the saved snippet, along with any secrets found in it.
+func (s *SnippetController) writeSnippet(w http.ResponseWriter, status int, message string, snippet *services.Snippet, findings []secrets.Finding) {
+	w.Header().Set("ETag", utils.VersionETag(snippet.Version))
+	if len(findings) == 0 {
+		utils.WriteRes(w, status, message, snippet, s.log)
+		return
+	}
+	utils.WriteResWarn(w, status, message, snippet, findings, s.log)
+}
+
+// ifMatch checks the If-Match precondition of a write against the snippet as fetched. It
+// returns the version the write is conditional on, 0 when it isn't, and writes 412 when the
+// snippet has changed since the client fetched it.
+func (s *SnippetController) ifMatch(w http.ResponseWriter, r *http.Request, sp *types.SnippetWithUser) (int, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return 0, true
+	}
+	if !utils.MatchVersion(header, sp.Version) {
+		utils.WriteErr(w, http.StatusPreconditionFailed, "The snippet has been changed since you fetched it",
+			services.ErrVersionMismatch, s.log)
+		return 0, false
+	}
+	return sp.Version, true
+}
+
+// writeUpdateErr maps the errors of a snippet write, a concurrent change that slipped in
+// between the precondition check and the write is still a failed precondition.
+func (s *SnippetController) writeUpdateErr(w http.ResponseWriter, status int, message string, err error) {
+	if errors.Is(err, services.ErrVersionMismatch) {
+		utils.WriteErr(w, http.StatusPreconditionFailed, "The snippet has been changed since you fetched it", err, s.log)
+		return
+	}
+	utils.WriteErr(w, status, message, err, s.log)
+}
+
+// canChangeVisibility reports whether the session may make the snippet public or private,
+// that is sharing it with everyone or taking that back, so it needs more than being able to
+// edit it.
+func canChangeVisibility(session types.Session, sp *types.SnippetWithUser, access policy.Access, public bool) bool {
+	return public == (sp.IsPublic == "true") || policy.CanSnippet(session, sp, access, policy.Share)
+}
+
+// canSetVisibility is canChangeVisibility for handlers, the error response has been written
+// when it returns false.
+func (s *SnippetController) canSetVisibility(
+	w http.ResponseWriter,
+	session types.Session,
+	sp *types.SnippetWithUser,
+	access policy.Access,
+	public bool,
+) bool {
+	if canChangeVisibility(session, sp, access, public) {
+		return true
+	}
+	utils.WriteErr(w, http.StatusUnauthorized, "You are not authorized to change the visibility of this snippet",
+		errors.New("Not authorized"), s.log)
+	return false
+}
+
 /*
 This function concatenates multiple req params together using ' & '
 It trims white space around the string and gets rid of repeating spaces within the string
@@ -63,7 +235,9 @@ func concatParam(s string) string {
 // @Param        id    path     string  true  "Snippet ID to be deleted"
 // @Success      204   "Snippet successfully deleted, no content returned"
 // @Failure      401   {object} utils.Response  "Unauthorized access"
+// @Param        If-Match  header  string  false  "ETag of the snippet as fetched, the delete fails if it changed since"
 // @Failure      404   {object} utils.Response  "Snippet not found"
+// @Failure      412   {object} utils.Response  "Snippet changed since it was fetched"
 // @Failure      500   {object} utils.Response  "Internal server error during deletion"
 // @Router       /snippets/{id} [delete]
 func (s *SnippetController) DeleteSnippet(w http.ResponseWriter, r *http.Request) {
@@ -76,20 +250,20 @@ func (s *SnippetController) DeleteSnippet(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if session.UserID != snippet.UserID {
+	if !policy.CanSnippet(session, snippet, s.access(session, snippet), policy.Delete) {
 		utils.WriteErr(w, http.StatusUnauthorized, `You are not authorized to access
 			this resource`, errors.New("Not authorized"), s.log)
 		return
 	}
 
-	err = s.snippets.DeleteSnippet(id)
+	version, ok := s.ifMatch(w, r, snippet)
+	if !ok {
+		return
+	}
+
+	err = s.snippets.DeleteSnippet(id, session.UserID, version)
 	if err != nil {
-		utils.WriteErr(
-			w, http.StatusInternalServerError,
-			"An error occured while deleting snippet",
-			err,
-			s.log,
-		)
+		s.writeUpdateErr(w, http.StatusInternalServerError, "An error occured while deleting snippet", err)
 		return
 	}
 
@@ -98,7 +272,7 @@ func (s *SnippetController) DeleteSnippet(w http.ResponseWriter, r *http.Request
 }
 
 // @Summary      Update Snippet Fields
-// @Description  Update multiple fields of a snippet, such as title, description, and code.
+// @Description  Replace the title, description, language, code and visibility of a snippet.
 // @Tags         snippet
 // @Accept       json
 // @Produce      json
@@ -110,7 +284,11 @@ func (s *SnippetController) DeleteSnippet(w http.ResponseWriter, r *http.Request
 // @Failure      401   {object} utils.Response      "Unauthorized access"
 // @Failure      404   {object} utils.Response      "Snippet not found"
 // @Failure      500   {object} utils.Response      "Internal server error during update"
-// @Router       /snippets/{id} [patch]
+// @Param        acknowledge_secrets  query  bool  false  "Save a public snippet even though credentials were found in it"
+// @Failure      422   {object} utils.Response      "Credentials found in the code of a public snippet"
+// @Param        If-Match  header  string  false  "ETag of the snippet as fetched, the update fails if it changed since"
+// @Failure      412   {object} utils.Response      "Snippet changed since it was fetched"
+// @Router       /snippets/{id} [put]
 func (s *SnippetController) UpdateSnippetMulti(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(types.AuthSession).(types.Session)
 	id := r.PathValue("id")
@@ -134,38 +312,197 @@ func (s *SnippetController) UpdateSnippetMulti(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	if session.UserID != sp.UserID {
+	access := s.access(session, sp)
+	if !policy.CanSnippet(session, sp, access, policy.Update) {
 		utils.WriteErr(w, http.StatusUnauthorized, `You are not authorized to access
 			this resource`, errors.New("Not authorized"), s.log)
 		return
 	}
 
+	public, _ := strconv.ParseBool(body.IsPublic)
+	if !s.canSetVisibility(w, session, sp, access, public) {
+		return
+	}
+
+	version, ok := s.ifMatch(w, r, sp)
+	if !ok {
+		return
+	}
+
+	findings, ok := s.checkSecrets(w, r, body.Code, public, sp.UserID == session.UserID)
+	if !ok {
+		return
+	}
+
 	body.ID = sp.ID
 	body.UserID = sp.UserID
+	body.OrgID = sp.OrgID
+	body.IsPublic = strconv.FormatBool(public)
+	body.Version = version
+	s.scoreSpam(&body, 0)
 
-	snippet, err := s.snippets.UpdateSnippetMulti(&body)
+	snippet, err := s.snippets.UpdateSnippetMulti(&body, session.UserID)
 	if err != nil {
-		utils.WriteErr(w, http.StatusInternalServerError, "Unable to update snippet", err, s.log)
+		s.writeUpdateErr(w, http.StatusInternalServerError, "Unable to update snippet", err)
 		return
 	}
 
-	utils.WriteRes(w, http.StatusOK, "Updated snippet", snippet, s.log)
+	s.writeSnippet(w, http.StatusOK, "Updated snippet", snippet, findings)
 	return
 }
 
-// @Summary      Update Snippet
-// @Description  Update a single field of a snippet, such as the title, description, or code.
+// acceptPatch lists the patch formats PATCH /snippets/{id} takes, application/json is the
+// original {field, value} body.
+var acceptPatch = strings.Join([]string{patch.MergePatchType, patch.JSONPatchType, "application/json"}, ", ")
+
+// @Summary      Patch Snippet
+// @Description  Change some of the title, description, language, code and visibility of a snippet. The body is a
+// @Description  JSON Merge Patch (application/merge-patch+json) or a JSON Patch (application/json-patch+json) of
+// @Description  types.SnippetFields, applied in full or not at all. An application/json body of types.UpdateOneData
+// @Description  still sets a single title, description or code.
 // @Tags         snippet
+// @Accept       application/merge-patch+json
+// @Accept       application/json-patch+json
 // @Accept       json
 // @Produce      json
 // @Security     ApiKeyAuth
 // @Param        id    path     string              true  "Snippet ID to be updated"
-// @Param        body  body     types.UpdateOneData true  "Field and value to update"
+// @Param        body  body     types.SnippetFields true  "Patch of the snippet's fields"
 // @Success      200  {object} 	types.SnippetWithUser  "Updated Snippet details"
-// @Failure      400   {object} utils.Response      "Invalid request or missing parameters"
+// @Failure      400   {object} utils.Response      "Invalid request or malformed patch"
 // @Failure      401   {object} utils.Response      "Unauthorized access"
 // @Failure      404   {object} utils.Response      "Snippet not found"
-// @Router       /snippets/{id} [put]
+// @Failure      409   {object} utils.Response      "The patch doesn't apply to the snippet"
+// @Failure      415   {object} utils.Response      "Unsupported patch format"
+// @Param        acknowledge_secrets  query  bool  false  "Save a public snippet even though credentials were found in it"
+// @Failure      422   {object} utils.Response      "Patched snippet is invalid, or credentials found in the code of a public snippet"
+// @Param        If-Match  header  string  false  "ETag of the snippet as fetched, the update fails if it changed since"
+// @Failure      412   {object} utils.Response      "Snippet changed since it was fetched"
+// @Router       /snippets/{id} [patch]
+func (s *SnippetController) PatchSnippet(w http.ResponseWriter, r *http.Request) {
+	var apply func(doc, p []byte) ([]byte, error)
+	media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch media {
+	case patch.MergePatchType:
+		apply = patch.Merge
+	case patch.JSONPatchType:
+		apply = patch.Apply
+	case "", "application/json":
+		s.UpdateSnippetOne(w, r)
+		return
+	default:
+		w.Header().Set("Accept-Patch", acceptPatch)
+		utils.WriteErr(w, http.StatusUnsupportedMediaType, "Unsupported patch format",
+			fmt.Errorf("Content-Type %s is not one of %s", media, acceptPatch), s.log)
+		return
+	}
+
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	if r.Body == nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", errors.New("Request payload missing"), s.log)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, s.log)
+		return
+	}
+
+	sp, err := s.snippets.GetSnippet(id)
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), err, s.log)
+		return
+	}
+
+	access := s.access(session, sp)
+	if !policy.CanSnippet(session, sp, access, policy.Update) {
+		utils.WriteErr(w, http.StatusUnauthorized, `You are not authorized to access
+			this resource`, errors.New("Not authorized"), s.log)
+		return
+	}
+
+	version, ok := s.ifMatch(w, r, sp)
+	if !ok {
+		return
+	}
+	// the patch was applied to this version, so it is only saved over this version
+	if version == 0 {
+		version = sp.Version
+	}
+
+	public := sp.IsPublic == "true"
+	doc, err := json.Marshal(types.SnippetFields{
+		Title:       sp.Title,
+		Description: sp.Description,
+		Language:    sp.Language,
+		Code:        sp.Code,
+		IsPublic:    &public,
+	})
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Unable to update snippet", err, s.log)
+		return
+	}
+
+	patched, err := apply(doc, body)
+	if errors.Is(err, patch.ErrConflict) {
+		utils.WriteErr(w, http.StatusConflict, "The patch doesn't apply to the snippet", err, s.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "Invalid patch", err, s.log)
+		return
+	}
+
+	var fields types.SnippetFields
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&fields); err != nil {
+		utils.WriteErr(w, http.StatusUnprocessableEntity,
+			"Only the title, description, language, code and is_public of a snippet can be patched", err, s.log)
+		return
+	}
+	if err = utils.Validate.Struct(fields); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusUnprocessableEntity, "Missing parameters", error, s.log)
+		return
+	}
+
+	if !s.canSetVisibility(w, session, sp, access, *fields.IsPublic) {
+		return
+	}
+
+	findings, ok := s.checkSecrets(w, r, fields.Code, *fields.IsPublic, sp.UserID == session.UserID)
+	if !ok {
+		return
+	}
+
+	update := &services.Snippet{
+		ID:          sp.ID,
+		UserID:      sp.UserID,
+		OrgID:       sp.OrgID,
+		Title:       fields.Title,
+		Description: fields.Description,
+		Language:    fields.Language,
+		Code:        fields.Code,
+		IsPublic:    strconv.FormatBool(*fields.IsPublic),
+		Version:     version,
+	}
+	s.scoreSpam(update, 0)
+
+	snippet, err := s.snippets.UpdateSnippetMulti(update, session.UserID)
+	if err != nil {
+		s.writeUpdateErr(w, http.StatusInternalServerError, "Unable to update snippet", err)
+		return
+	}
+
+	s.writeSnippet(w, http.StatusOK, "Updated snippet", snippet, findings)
+	return
+}
+
+// UpdateSnippetOne sets a single title, description or code, it is what PATCH /snippets/{id}
+// does with an application/json body of types.UpdateOneData.
 func (s *SnippetController) UpdateSnippetOne(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(types.AuthSession).(types.Session)
 	id := r.PathValue("id")
@@ -195,7 +532,7 @@ func (s *SnippetController) UpdateSnippetOne(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if session.UserID != sp.UserID {
+	if !policy.CanSnippet(session, sp, s.access(session, sp), policy.Update) {
 		utils.WriteErr(
 			w,
 			http.StatusUnauthorized,
@@ -206,6 +543,11 @@ func (s *SnippetController) UpdateSnippetOne(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	version, ok := s.ifMatch(w, r, sp)
+	if !ok {
+		return
+	}
+
 	if body.Field != "title" && body.Field != "description" && body.Field != "code" {
 		utils.WriteErr(
 			w,
@@ -217,19 +559,46 @@ func (s *SnippetController) UpdateSnippetOne(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	snippet, err := s.snippets.UpdateSnippetSingle(id, body.Field, body.Value)
+	var findings []secrets.Finding
+	if body.Field == "code" {
+		findings, ok = s.checkSecrets(w, r, body.Value, sp.IsPublic == "true", sp.UserID == session.UserID)
+		if !ok {
+			return
+		}
+	}
+
+	// the rest of the snippet is saved as it was fetched, so only over that version of it
+	if version == 0 {
+		version = sp.Version
+	}
+	update := &services.Snippet{
+		ID:          sp.ID,
+		UserID:      sp.UserID,
+		OrgID:       sp.OrgID,
+		Title:       sp.Title,
+		Description: sp.Description,
+		Language:    sp.Language,
+		Code:        sp.Code,
+		IsPublic:    sp.IsPublic,
+		Version:     version,
+	}
+	switch body.Field {
+	case "title":
+		update.Title = body.Value
+	case "description":
+		update.Description = body.Value
+	case "code":
+		update.Code = body.Value
+	}
+	s.scoreSpam(update, 0)
+
+	snippet, err := s.snippets.UpdateSnippetMulti(update, session.UserID)
 	if err != nil {
-		utils.WriteErr(
-			w,
-			http.StatusBadRequest,
-			"An error occured while updating the resource",
-			err,
-			s.log,
-		)
+		s.writeUpdateErr(w, http.StatusBadRequest, "An error occured while updating the resource", err)
 		return
 	}
 
-	utils.WriteRes(w, http.StatusOK, "Updated snippet", snippet, s.log)
+	s.writeSnippet(w, http.StatusOK, "Updated snippet", snippet, findings)
 	return
 }
 
@@ -237,15 +606,16 @@ func (s *SnippetController) UpdateSnippetOne(w http.ResponseWriter, r *http.Requ
 // @Description  Retrieve all snippets created by a specific user, with optional filters.
 // @Tags         snippet
 // @Produce      json
-// @Param        userid  path     string  true   "User ID whose snippets are being retrieved"
+// @Param        id      path     string  true   "User ID whose snippets are being retrieved"
 // @Param        page    query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
 // @Param        param   query    string  false  "Search parameter to filter snippets"
 // @Param        lang    query    string  false  "Programming language to filter snippets"
 // @Success      200     {array} utils.Response  "List of snippets with user details"
 // @Failure      404     {object} utils.Response  "Error fetching snippets"
-// @Router       /users/{userid}/snippets [get]
+// @Router       /users/{id}/snippets [get]
 func (s *SnippetController) GetAllUserSnippets(w http.ResponseWriter, r *http.Request) {
-	user_id := r.PathValue("userid")
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
+	user_id := r.PathValue("id")
 	query := r.URL.Query()
 	page := query.Get("page")
 	param := query.Get("param")
@@ -258,11 +628,19 @@ func (s *SnippetController) GetAllUserSnippets(w http.ResponseWriter, r *http.Re
 	} else {
 		offset = (p - 1) * limit
 	}
-	snippets, err := s.snippets.GetSnippetsUser(user_id, offset, limit, param, lang)
+	snippets, err := s.snippets.GetSnippetsUser(user_id, session.UserID, offset, limit, param, lang)
 	if err != nil {
 		utils.WriteErr(w, http.StatusNotFound, "Error fetching snippets", err, s.log)
 		return
 	}
+	for _, snippet := range *snippets {
+		if snippet.Hidden {
+			snippet.Notice = HiddenNotice
+		}
+	}
+	if utils.NotModified(w, r, utils.BodyETag(snippets)) {
+		return
+	}
 	utils.WriteRes(w, http.StatusOK, "User's snippets found", snippets, s.log)
 	return
 }
@@ -279,6 +657,7 @@ func (s *SnippetController) GetAllUserSnippets(w http.ResponseWriter, r *http.Re
 // @Failure      500    {object}  utils.Response         "Internal server error"
 // @Router       /snippets [get]
 func (s *SnippetController) GetAllSnippets(w http.ResponseWriter, r *http.Request) {
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
 	query := r.URL.Query()
 	page := query.Get("page")
 	param := query.Get("param")
@@ -291,7 +670,7 @@ func (s *SnippetController) GetAllSnippets(w http.ResponseWriter, r *http.Reques
 	} else {
 		offset = (p - 1) * limit
 	}
-	snippets, err := s.snippets.GetSnippets(offset, limit, param, lang)
+	snippets, err := s.snippets.GetSnippets(session.UserID, offset, limit, param, lang)
 	if err != nil {
 		utils.WriteErr(w, http.StatusNotFound, "Error fetching snippets", err, s.log)
 		return
@@ -302,6 +681,9 @@ func (s *SnippetController) GetAllSnippets(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if utils.NotModified(w, r, utils.BodyETag(snippets)) {
+		return
+	}
 	utils.WriteRes(w, http.StatusOK, "Snippets found", snippets, s.log)
 	return
 }
@@ -311,10 +693,13 @@ func (s *SnippetController) GetAllSnippets(w http.ResponseWriter, r *http.Reques
 // @Tags         snippet
 // @Produce      json
 // @Param        id   path     string  true  "Unique identifier for the snippet"
+// @Param        If-None-Match  header  string  false  "ETag of a cached copy"
 // @Success      200  {object} types.SnippetWithUser  "Snippet details along with user information"
+// @Success      304  "The cached copy is still current"
 // @Failure      500  {object} utils.Response         "Internal server error"
 // @Router       /snippets/{id} [get]
 func (s *SnippetController) GetSnippetByID(w http.ResponseWriter, r *http.Request) {
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
 	id := r.PathValue("id")
 	snippet, err := s.snippets.GetSnippet(id)
 	if err != nil {
@@ -322,6 +707,19 @@ func (s *SnippetController) GetSnippetByID(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// snippets the caller can't see are reported as missing so their ids don't leak
+	if !policy.CanSnippet(session, snippet, s.access(session, snippet), policy.Read) {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), errors.New("Not authorized"), s.log)
+		return
+	}
+	if snippet.Hidden && snippet.UserID == session.UserID {
+		snippet.Notice = HiddenNotice
+	}
+
+	// the author's profile and the notice change without the version
+	if utils.NotModified(w, r, utils.RepresentationETag(snippet.Version, snippet)) {
+		return
+	}
 	utils.WriteRes(w, http.StatusOK, "Snippet found", snippet, s.log)
 	return
 }
@@ -335,6 +733,10 @@ func (s *SnippetController) GetSnippetByID(w http.ResponseWriter, r *http.Reques
 // @Param        Authorization  header    string  true  "Bearer token for authentication"
 // @Success      201  {object}  types.SnippetWithUser  "Created snippet details with user information"
 // @Failure      500  {object}  utils.Response         "Internal server error"
+// @Param        acknowledge_secrets  query  bool  false  "Save a public snippet even though credentials were found in it"
+// @Failure      422   {object} utils.Response      "Credentials found in the code of a public snippet"
+// @Param        Idempotency-Key  header  string  false  "Unique key of the request, retries with the same key get the first response back"
+// @Failure      409   {object} utils.Response  "A request with the same Idempotency-Key is still being handled"
 // @Router       /snippets [post]
 func (s *SnippetController) CreateSnippet(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(types.AuthSession).(types.Session)
@@ -356,12 +758,29 @@ func (s *SnippetController) CreateSnippet(w http.ResponseWriter, r *http.Request
 	body.ID = uuid.NewString()
 	body.UserID = session.UserID
 
+	if body.OrgID != nil {
+		if _, err = s.orgs.GetMemberRole(*body.OrgID, session.UserID); err != nil {
+			utils.WriteErr(w, http.StatusForbidden, "You are not a member of that org", err, s.log)
+			return
+		}
+	}
+
+	public, _ := strconv.ParseBool(body.IsPublic)
+	body.IsPublic = strconv.FormatBool(public)
+
+	findings, ok := s.checkSecrets(w, r, body.Code, public, true)
+	if !ok {
+		return
+	}
+
+	s.scoreSpam(&body, 1)
+
 	snippet, err := s.snippets.CreateSnippet(&body)
 	if err != nil {
 		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating snippet", err, s.log)
 		return
 	}
 
-	utils.WriteRes(w, http.StatusCreated, "Snippet created", snippet, s.log)
+	s.writeSnippet(w, http.StatusCreated, "Snippet created", snippet, findings)
 	return
 }
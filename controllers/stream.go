@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+// streamHeartbeat keeps idle streams from being closed by proxies.
+const streamHeartbeat = 25 * time.Second
+
+// serveStream relays the messages published on channels to the client as server-sent
+// events until the client goes away.
+func serveStream(w http.ResponseWriter, r *http.Request, stream services.StreamStore, log *slog.Logger, channels ...string) {
+	// the server's WriteTimeout would cut the stream off after a few seconds
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Streaming is not supported", err, log)
+		return
+	}
+
+	ctx := r.Context()
+	sub := stream.Subscribe(ctx, channels...)
+	defer sub.Close()
+
+	// make sure the subscription is live before telling the client it is connected
+	if _, err := sub.Receive(ctx); err != nil {
+		utils.WriteErr(w, http.StatusServiceUnavailable, "Unable to listen for updates", err, log)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		log.Error("STREAM", slog.String("Unable to flush", err.Error()))
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	messages := sub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var message types.StreamMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+				log.Error("STREAM", slog.String("Invalid message", err.Error()))
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.Event, message.Data)
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// @Summary      Notification Stream
+// @Description  Server-sent events stream of the signed in user's notifications as they happen. Each event is named notification and carries the notification as JSON.
+// @Tags         notifications
+// @Produce      text/event-stream
+// @Param        ticket  query  string  false  "Ticket from POST /stream/tickets, for browsers that can't send an Authorization header"
+// @Success      200  {object} types.Notification  "Stream of notification events"
+// @Failure      401  {object} utils.Response      "Unauthorized access"
+// @Router       /events [get]
+func (n *NotificationController) Events(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	serveStream(w, r, n.stream, n.log, services.UserChannel(session.UserID))
+	return
+}
+
+// @Summary      Snippet Stream
+// @Description  Server-sent events stream of changes to a snippet, such as snippet.updated and snippet.deleted. Clients fetch the snippet again to see what changed.
+// @Tags         snippet
+// @Produce      text/event-stream
+// @Param        id      path   string  true   "Snippet ID"
+// @Param        ticket  query  string  false  "Ticket from POST /stream/tickets, for browsers that can't send an Authorization header"
+// @Success      200  {object} types.SnippetChange  "Stream of snippet events"
+// @Failure      404  {object} utils.Response       "Snippet not found"
+// @Router       /snippets/{id}/events [get]
+func (s *SnippetController) Events(w http.ResponseWriter, r *http.Request) {
+	session, _ := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	snippet, err := s.snippets.GetSnippet(id)
+	if err == nil && !policy.CanSnippet(session, snippet, s.access(session, snippet), policy.Read) {
+		err = errors.New("Not authorized")
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Snippet with %s not found", id), err, s.log)
+		return
+	}
+
+	serveStream(w, r, s.stream, s.log, services.SnippetChannel(snippet.ID))
+	return
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	validator "github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type TokenController struct {
+	tokens services.TokenStore
+	log    *slog.Logger
+}
+
+func NewTokenController(tokens services.TokenStore, log *slog.Logger) *TokenController {
+	return &TokenController{
+		tokens: tokens,
+		log:    log,
+	}
+}
+
+// @Summary      Create Access Token
+// @Description  Create a named personal access token for API and CLI use. The token is only returned once.
+// @Tags         tokens
+// @Accept       json
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Param        body  body     types.CreateTokenBody  true  "Token name, scopes and optional expiry"
+// @Success      201   {object} services.Token         "Created token, including its secret"
+// @Failure      400   {object} utils.Response         "Invalid request or missing parameters"
+// @Failure      401   {object} utils.Response         "Unauthorized access"
+// @Failure      403   {object} utils.Response         "Scope not granted to the token making the request"
+// @Failure      500   {object} utils.Response         "Internal server error"
+// @Router       /tokens [post]
+func (t *TokenController) CreateToken(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.CreateTokenBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, t.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing or invalid parameters", error, t.log)
+		return
+	}
+
+	// a token can't mint a token with more scopes than its own, or any scope would do
+	if scope := session.MissingScope(body.Scopes); scope != "" {
+		utils.WriteErr(w, http.StatusForbidden, "You can't grant a scope your own token doesn't have",
+			fmt.Errorf("Missing scope %s", scope), t.log)
+		return
+	}
+
+	if body.ExpiresAt != nil && body.ExpiresAt.Before(time.Now()) {
+		utils.WriteErr(w, http.StatusBadRequest, "Expiry time must be in the future", errors.New("Invalid expiry"), t.log)
+		return
+	}
+
+	secret, err := utils.GenerateToken()
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating the token", err, t.log)
+		return
+	}
+
+	token, err := t.tokens.CreateToken(&services.Token{
+		ID:        uuid.NewString(),
+		UserID:    session.UserID,
+		Name:      body.Name,
+		Hash:      utils.HashToken(secret),
+		Scopes:    body.Scopes,
+		ExpiresAt: body.ExpiresAt,
+	})
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating the token", err, t.log)
+		return
+	}
+
+	token.Secret = secret
+	utils.WriteRes(w, http.StatusCreated, "Access token created", token, t.log)
+	return
+}
+
+// @Summary      List Access Tokens
+// @Description  List the personal access tokens belonging to the current user.
+// @Tags         tokens
+// @Produce      json
+// @Security     ApiKeyAuth
+// @Success      200  {array}  services.Token   "List of tokens"
+// @Failure      401  {object} utils.Response   "Unauthorized access"
+// @Failure      500  {object} utils.Response   "Internal server error"
+// @Router       /tokens [get]
+func (t *TokenController) GetTokens(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	tokens, err := t.tokens.GetTokens(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching tokens", err, t.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Tokens found", tokens, t.log)
+	return
+}
+
+// @Summary      Revoke Access Token
+// @Description  Revoke one of the current user's personal access tokens.
+// @Tags         tokens
+// @Security     ApiKeyAuth
+// @Param        id   path     string  true  "Token ID to be revoked"
+// @Success      204  "Token revoked, no content returned"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Failure      404  {object} utils.Response  "Token not found"
+// @Failure      500  {object} utils.Response  "Internal server error"
+// @Router       /tokens/{id} [delete]
+func (t *TokenController) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	id := r.PathValue("id")
+
+	err := t.tokens.DeleteToken(id, session.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteErr(w, http.StatusNotFound, "Token not found", err, t.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while revoking the token", err, t.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
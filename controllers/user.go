@@ -1,11 +1,15 @@
 package controllers
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"regexp"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/redis/go-redis/v9"
 
 	utils "snipnet/controllers/responseutils"
@@ -27,30 +31,112 @@ func NewUserController(users services.UserStore, log *slog.Logger, rds *redis.Cl
 	}
 }
 
-// @Summary      Get User
-// @Description  Retrieve details of a specific user by their unique ID.
+// usernamePattern matches the usernames of GitHub, the first identity provider, so
+// usernames taken from it always pass.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,38}$`)
+
+// @Summary      Get Current User
+// @Description  Retrieve the full account of the signed in user, including their email.
 // @Tags         users
 // @Produce      json
-// @Param        id   path      string  true  "Unique ID of the user"
 // @Success      200  {object}  services.User        "User details"
 // @Failure      401  {object}  utils.Response       "Unauthorized access"
-// @Failure      404  {object}  utils.Response       "User not found"
-// @Router       /users/{id} [get]
-func (u *UserController) GetUserByID(w http.ResponseWriter, r *http.Request) {
+// @Router       /me [get]
+func (u *UserController) GetMe(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(types.AuthSession).(types.Session)
-	id := r.PathValue("id")
 
-	user, err := u.users.GetUser("id", id)
+	user, err := u.users.GetUser("id", session.UserID)
 	if err != nil {
-		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User with id %s not found", id), err, u.log)
+		utils.WriteErr(w, http.StatusNotFound, "User not found", err, u.log)
 		return
 	}
 
-	if session.UserID != user.ID {
-		utils.WriteErr(w, http.StatusUnauthorized, "You can't access this resource", errors.New("Unauthorized"), u.log)
+	utils.WriteRes(w, http.StatusOK, "User found", user, u.log)
+	return
+}
+
+// @Summary      Update Profile
+// @Description  Update the profile of the signed in user. Only the fields sent are changed, an empty string clears a field. The old username redirects to the new one until somebody else takes it.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        profile  body      types.UpdateProfileBody  true  "Fields to change"
+// @Success      200      {object}  services.User            "Profile updated"
+// @Failure      400      {object}  utils.Response           "Invalid payload"
+// @Failure      401      {object}  utils.Response           "Unauthorized access"
+// @Failure      409      {object}  utils.Response           "Username already taken"
+// @Router       /me [patch]
+func (u *UserController) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.UpdateProfileBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, u.log)
 		return
 	}
 
-	utils.WriteRes(w, http.StatusOK, "Users found", user, u.log)
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Invalid parameters", error, u.log)
+		return
+	}
+
+	if body.Username != nil {
+		if !usernamePattern.MatchString(*body.Username) {
+			utils.WriteErr(w, http.StatusBadRequest, "Username may only contain letters, digits, dashes and underscores", errors.New("Invalid username"), u.log)
+			return
+		}
+
+		if user, err := u.users.GetUser("username", *body.Username); err == nil && user.ID != session.UserID {
+			utils.WriteErr(w, http.StatusConflict, fmt.Sprintf("Username %s is already taken", *body.Username), errors.New("Duplicate username"), u.log)
+			return
+		}
+	}
+
+	user, err := u.users.UpdateProfile(session.UserID, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while updating the profile", err, u.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Profile updated", user, u.log)
+	return
+}
+
+// @Summary      Get Profile
+// @Description  Retrieve the public profile of a user. Old usernames and user IDs redirect to the current username.
+// @Tags         users
+// @Produce      json
+// @Param        username  path      string         true  "Username of the user"
+// @Success      200       {object}  types.Profile  "Profile"
+// @Success      301       {object}  utils.Response "Moved to the current username"
+// @Failure      404       {object}  utils.Response "User not found"
+// @Router       /users/{username} [get]
+func (u *UserController) GetProfile(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	profile, err := u.users.GetProfile(username)
+	if err == nil {
+		utils.WriteRes(w, http.StatusOK, "Profile found", profile, u.log)
+		return
+	}
+	if err != sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while fetching the profile", err, u.log)
+		return
+	}
+
+	current, err := u.users.GetUsernameRedirect(username)
+	if err != nil {
+		// links used to point at user IDs, send those to the username too
+		user, idErr := u.users.GetUser("id", username)
+		if idErr != nil {
+			utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("User %s not found", username), err, u.log)
+			return
+		}
+		current = user.Username
+	}
+
+	http.Redirect(w, r, "/users/"+url.PathEscape(current), http.StatusMovedPermanently)
 	return
 }
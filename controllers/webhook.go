@@ -0,0 +1,376 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	validator "github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/services"
+	"snipnet/types"
+)
+
+type WebhookController struct {
+	webhooks services.WebhookStore
+	orgs     services.OrgStore
+	log      *slog.Logger
+}
+
+func NewWebhookController(webhooks services.WebhookStore, orgs services.OrgStore, log *slog.Logger) *WebhookController {
+	return &WebhookController{
+		webhooks: webhooks,
+		orgs:     orgs,
+		log:      log,
+	}
+}
+
+// org fetches the org in the path, only its owners manage its webhooks. The error
+// response has been written when ok is false.
+func (wc *WebhookController) org(w http.ResponseWriter, r *http.Request, session types.Session) (org *services.Org, ok bool) {
+	slug := r.PathValue("slug")
+	org, err := wc.orgs.GetOrg(slug)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Org %s not found", slug), err, wc.log)
+		return nil, false
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching org", err, wc.log)
+		return nil, false
+	}
+
+	role, err := wc.orgs.GetMemberRole(org.ID, session.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching org membership", err, wc.log)
+		return nil, false
+	}
+	if !policy.CanOrg(role) {
+		utils.WriteErr(w, http.StatusForbidden, "Only org owners can manage webhooks", errors.New("Not authorized"), wc.log)
+		return nil, false
+	}
+	return org, true
+}
+
+// webhook fetches the webhook in the path if the session may manage it, webhooks of others
+// are reported as not found. The error response has been written when ok is false.
+func (wc *WebhookController) webhook(w http.ResponseWriter, r *http.Request, session types.Session) (hook *types.Webhook, ok bool) {
+	id := r.PathValue("id")
+	hook, err := wc.webhooks.GetWebhook(id)
+	if err != nil && err != sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching webhook", err, wc.log)
+		return nil, false
+	}
+
+	allowed := false
+	if err == nil && hook.UserID != nil {
+		allowed = *hook.UserID == session.UserID
+	} else if err == nil && hook.OrgID != nil {
+		role, _ := wc.orgs.GetMemberRole(*hook.OrgID, session.UserID)
+		allowed = policy.CanOrg(role)
+	}
+	if !allowed {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Webhook with id %s not found", id), sql.ErrNoRows, wc.log)
+		return nil, false
+	}
+	return hook, true
+}
+
+func (wc *WebhookController) create(w http.ResponseWriter, r *http.Request, user_id, org_id *string) {
+	var body types.CreateWebhookBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, wc.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing or invalid parameters", error, wc.log)
+		return
+	}
+
+	secret, err := utils.GenerateToken()
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating the webhook", err, wc.log)
+		return
+	}
+
+	hook, err := wc.webhooks.CreateWebhook(&types.Webhook{
+		ID:     uuid.NewString(),
+		UserID: user_id,
+		OrgID:  org_id,
+		URL:    body.URL,
+		Events: body.Events,
+		Secret: secret,
+	})
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while creating the webhook", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusCreated, "Webhook created", hook, wc.log)
+	return
+}
+
+// @Summary      Create Webhook
+// @Description  Register a webhook for events of your snippets. Deliveries are signed with the returned secret, which is only shown once: the X-Snipnet-Signature header is sha256= followed by the hex HMAC-SHA256 of "<X-Snipnet-Timestamp>.<body>". Failed deliveries are retried with exponential backoff.
+// @Tags         webhooks
+// @Accept       json
+// @Produce      json
+// @Param        body  body     types.CreateWebhookBody  true  "Url and events, e.g. snippet.created"
+// @Success      201   {object} types.Webhook            "Created webhook, including its secret"
+// @Failure      400   {object} utils.Response           "Invalid request or missing parameters"
+// @Failure      401   {object} utils.Response           "Unauthorized access"
+// @Router       /me/webhooks [post]
+func (wc *WebhookController) CreateUserWebhook(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	wc.create(w, r, &session.UserID, nil)
+	return
+}
+
+// @Summary      List Webhooks
+// @Tags         webhooks
+// @Produce      json
+// @Success      200  {array}  types.Webhook   "Your webhooks"
+// @Failure      401  {object} utils.Response  "Unauthorized access"
+// @Router       /me/webhooks [get]
+func (wc *WebhookController) GetUserWebhooks(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	hooks, err := wc.webhooks.GetUserWebhooks(session.UserID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching webhooks", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Webhooks found", hooks, wc.log)
+	return
+}
+
+// @Summary      Create Org Webhook
+// @Description  Register a webhook for events of the org's snippets, only org owners can. See Create Webhook for how deliveries are signed.
+// @Tags         webhooks
+// @Accept       json
+// @Produce      json
+// @Param        slug  path     string                   true  "Org slug"
+// @Param        body  body     types.CreateWebhookBody  true  "Url and events, e.g. snippet.created"
+// @Success      201   {object} types.Webhook            "Created webhook, including its secret"
+// @Failure      400   {object} utils.Response           "Invalid request or missing parameters"
+// @Failure      403   {object} utils.Response           "Not an owner of the org"
+// @Failure      404   {object} utils.Response           "Org not found"
+// @Router       /orgs/{slug}/webhooks [post]
+func (wc *WebhookController) CreateOrgWebhook(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	org, ok := wc.org(w, r, session)
+	if !ok {
+		return
+	}
+
+	wc.create(w, r, nil, &org.ID)
+	return
+}
+
+// @Summary      List Org Webhooks
+// @Tags         webhooks
+// @Produce      json
+// @Param        slug  path     string  true  "Org slug"
+// @Success      200   {array}  types.Webhook   "The org's webhooks"
+// @Failure      403   {object} utils.Response  "Not an owner of the org"
+// @Failure      404   {object} utils.Response  "Org not found"
+// @Router       /orgs/{slug}/webhooks [get]
+func (wc *WebhookController) GetOrgWebhooks(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	org, ok := wc.org(w, r, session)
+	if !ok {
+		return
+	}
+
+	hooks, err := wc.webhooks.GetOrgWebhooks(org.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching webhooks", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Webhooks found", hooks, wc.log)
+	return
+}
+
+// @Summary      Get Webhook
+// @Tags         webhooks
+// @Produce      json
+// @Param        id   path     string  true  "Webhook ID"
+// @Success      200  {object} types.Webhook   "Webhook"
+// @Failure      404  {object} utils.Response  "Webhook not found"
+// @Router       /webhooks/{id} [get]
+func (wc *WebhookController) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	hook, ok := wc.webhook(w, r, session)
+	if !ok {
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Webhook found", hook, wc.log)
+	return
+}
+
+// @Summary      Update Webhook
+// @Description  Change the url or events of a webhook, or pause it by setting active to false. Fields left out keep their value.
+// @Tags         webhooks
+// @Accept       json
+// @Produce      json
+// @Param        id    path     string                   true  "Webhook ID"
+// @Param        body  body     types.UpdateWebhookBody  true  "Fields to change"
+// @Success      200   {object} types.Webhook            "Updated webhook"
+// @Failure      400   {object} utils.Response           "Invalid request"
+// @Failure      404   {object} utils.Response           "Webhook not found"
+// @Router       /webhooks/{id} [patch]
+func (wc *WebhookController) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	var body types.UpdateWebhookBody
+	err := utils.ParseJson(r, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusBadRequest, "No payload attached to req", err, wc.log)
+		return
+	}
+
+	if err = utils.Validate.Struct(body); err != nil {
+		error := err.(validator.ValidationErrors)
+		utils.WriteErr(w, http.StatusBadRequest, "Missing or invalid parameters", error, wc.log)
+		return
+	}
+
+	hook, ok := wc.webhook(w, r, session)
+	if !ok {
+		return
+	}
+
+	hook, err = wc.webhooks.UpdateWebhook(hook.ID, &body)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while updating the webhook", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Webhook updated", hook, wc.log)
+	return
+}
+
+// @Summary      Delete Webhook
+// @Description  Delete a webhook along with its delivery log, pending deliveries are dropped.
+// @Tags         webhooks
+// @Param        id   path     string  true  "Webhook ID"
+// @Success      204  "Webhook deleted, no content returned"
+// @Failure      404  {object} utils.Response  "Webhook not found"
+// @Router       /webhooks/{id} [delete]
+func (wc *WebhookController) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	hook, ok := wc.webhook(w, r, session)
+	if !ok {
+		return
+	}
+
+	if err := wc.webhooks.DeleteWebhook(hook.ID); err != nil && err != sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while deleting the webhook", err, wc.log)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// @Summary      Ping Webhook
+// @Description  Send a ping event to the webhook right away and return how the receiver responded. Pings aren't retried.
+// @Tags         webhooks
+// @Produce      json
+// @Param        id   path     string  true  "Webhook ID"
+// @Success      200  {object} types.WebhookDelivery  "The ping delivery, status tells whether the receiver accepted it"
+// @Failure      404  {object} utils.Response         "Webhook not found"
+// @Router       /webhooks/{id}/ping [post]
+func (wc *WebhookController) Ping(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	hook, ok := wc.webhook(w, r, session)
+	if !ok {
+		return
+	}
+
+	delivery, err := wc.webhooks.Ping(r.Context(), hook.ID)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while pinging the webhook", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Ping sent", delivery, wc.log)
+	return
+}
+
+// @Summary      List Webhook Deliveries
+// @Description  The delivery log of a webhook newest first, with the receiver's response to the last attempt of each delivery.
+// @Tags         webhooks
+// @Produce      json
+// @Param        id    path     string  true   "Webhook ID"
+// @Param        page  query    string  false  "Page number for pagination (e.g., 1, 2, 3, ...)"
+// @Success      200   {array}  types.WebhookDelivery  "Deliveries"
+// @Failure      404   {object} utils.Response         "Webhook not found"
+// @Router       /webhooks/{id}/deliveries [get]
+func (wc *WebhookController) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+
+	hook, ok := wc.webhook(w, r, session)
+	if !ok {
+		return
+	}
+
+	limit := 20
+	offset := utils.PageOffset(r, limit)
+
+	deliveries, err := wc.webhooks.GetDeliveries(hook.ID, offset, limit)
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "Error fetching deliveries", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusOK, "Deliveries found", deliveries, wc.log)
+	return
+}
+
+// @Summary      Redeliver Webhook Delivery
+// @Description  Queue the payload of a past delivery again. The payload id is unchanged, so receivers can recognise events they already handled.
+// @Tags         webhooks
+// @Produce      json
+// @Param        id           path     string  true  "Webhook ID"
+// @Param        delivery_id  path     string  true  "Delivery ID"
+// @Success      202          {object} types.WebhookDelivery  "The new, queued delivery"
+// @Failure      404          {object} utils.Response         "Webhook or delivery not found"
+// @Router       /webhooks/{id}/deliveries/{delivery_id}/redeliver [post]
+func (wc *WebhookController) Redeliver(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(types.AuthSession).(types.Session)
+	delivery_id := r.PathValue("delivery_id")
+
+	hook, ok := wc.webhook(w, r, session)
+	if !ok {
+		return
+	}
+
+	delivery, err := wc.webhooks.Redeliver(hook.ID, delivery_id)
+	if err == sql.ErrNoRows {
+		utils.WriteErr(w, http.StatusNotFound, fmt.Sprintf("Delivery with id %s not found", delivery_id), err, wc.log)
+		return
+	}
+	if err != nil {
+		utils.WriteErr(w, http.StatusInternalServerError, "An error occured while queueing the delivery", err, wc.log)
+		return
+	}
+
+	utils.WriteRes(w, http.StatusAccepted, "Delivery queued", delivery, wc.log)
+	return
+}
@@ -0,0 +1,105 @@
+// Package events lets controllers announce what happened without knowing who cares about
+// it, subscribers such as notifications react to the events they are interested in.
+package events
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// SnippetShared is sent to a user when a snippet is shared with them.
+	SnippetShared = "snippet.shared"
+	// SnippetCreated, SnippetUpdated and SnippetDeleted go out to everyone viewing the
+	// snippet and to the webhooks of its owner.
+	SnippetCreated = "snippet.created"
+	SnippetUpdated = "snippet.updated"
+	SnippetDeleted = "snippet.deleted"
+	// SnippetHidden is sent to the author of a snippet a moderator took down.
+	SnippetHidden = "snippet.hidden"
+	// OrgInvited is sent to a user invited to join an org.
+	OrgInvited = "org.invited"
+	// UserFollowed is sent to a user somebody started following.
+	UserFollowed = "user.followed"
+	// UserCreated, UserUpdated and UserDeleted follow changes to accounts and profiles.
+	UserCreated = "user.created"
+	UserUpdated = "user.updated"
+	UserDeleted = "user.deleted"
+)
+
+// All subscribes a handler to every event.
+const All = "*"
+
+type Event struct {
+	// ID is the same every time an event is handed out again, subscribers use it to tell
+	// they have already handled it.
+	ID   string
+	Type string
+	// UserID is the user the event concerns, ActorID the user who caused it.
+	UserID    string
+	ActorID   string
+	SnippetID string
+	OrgID     string
+	At        time.Time
+}
+
+type Handler func(ctx context.Context, event Event) error
+
+// Publisher is what controllers depend on, Dispatcher implements it.
+type Publisher interface {
+	Publish(ctx context.Context, event Event)
+}
+
+type Dispatcher struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+	log      *slog.Logger
+}
+
+func NewDispatcher(log *slog.Logger) *Dispatcher {
+	return &Dispatcher{handlers: map[string][]Handler{}, log: log}
+}
+
+// Subscribe calls handler for every event of type t, or for every event when t is All.
+func (d *Dispatcher) Subscribe(t string, handler Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[t] = append(d.handlers[t], handler)
+}
+
+// Publish hands event to its subscribers in the order they subscribed. The action that
+// caused the event has already happened, so a failing subscriber is logged and doesn't
+// stop the others.
+func (d *Dispatcher) Publish(ctx context.Context, event Event) {
+	if err := d.Dispatch(ctx, event); err != nil {
+		d.log.Error("EVENTS", slog.String("type", event.Type), slog.String("Subscriber failed", err.Error()))
+	}
+}
+
+// Dispatch is Publish for callers that retry, it returns the errors of the subscribers
+// that failed. Every subscriber still sees the event, a retry hands it to all of them again.
+func (d *Dispatcher) Dispatch(ctx context.Context, event Event) error {
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	d.mu.RLock()
+	handlers := append(append([]Handler{}, d.handlers[event.Type]...), d.handlers[All]...)
+	d.mu.RUnlock()
+
+	var errs []error
+	for _, handler := range handlers {
+		if err := handler(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,64 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	d := NewDispatcher(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	got := []string{}
+
+	d.Subscribe(UserFollowed, func(ctx context.Context, e Event) error {
+		got = append(got, "followed:"+e.UserID)
+		return errors.New("failing subscriber")
+	})
+	d.Subscribe(All, func(ctx context.Context, e Event) error {
+		if e.At.IsZero() {
+			t.Error("expected the event time to be set")
+		}
+		got = append(got, "all:"+e.Type)
+		return nil
+	})
+
+	d.Publish(context.Background(), Event{Type: UserFollowed, UserID: "u1", ActorID: "u2"})
+	d.Publish(context.Background(), Event{Type: OrgInvited, UserID: "u1"})
+
+	want := []string{"followed:u1", "all:" + UserFollowed, "all:" + OrgInvited}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	d := NewDispatcher(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ids := []string{}
+
+	d.Subscribe(All, func(ctx context.Context, e Event) error {
+		ids = append(ids, e.ID)
+		return errors.New("failing subscriber")
+	})
+	d.Subscribe(All, func(ctx context.Context, e Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+
+	if err := d.Dispatch(context.Background(), Event{ID: "e1", Type: SnippetCreated}); err == nil {
+		t.Error("expected the failing subscriber's error")
+	}
+	if err := d.Dispatch(context.Background(), Event{Type: SnippetCreated}); err == nil {
+		t.Error("expected the failing subscriber's error")
+	}
+
+	if len(ids) != 4 || ids[0] != "e1" || ids[1] != "e1" || ids[2] == "" || ids[2] != ids[3] {
+		t.Errorf("expected every subscriber to see the same id, got %v", ids)
+	}
+}
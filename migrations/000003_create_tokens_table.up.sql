@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS tokens (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	user_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL DEFAULT '{}',
+	expires_at TIMESTAMP,
+	last_used_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS tokens_user_idx ON tokens (user_id);
@@ -0,0 +1,16 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oauth_id TEXT;
+UPDATE users SET oauth_id = identities.subject
+FROM identities
+WHERE identities.user_id = users.id AND identities.provider = 'github';
+
+-- accounts without a GitHub identity get their own id so oauth_id can be unique again
+UPDATE users SET oauth_id = id WHERE oauth_id IS NULL;
+ALTER TABLE users ALTER COLUMN oauth_id SET NOT NULL;
+ALTER TABLE users ADD CONSTRAINT users_oauth_id_key UNIQUE (oauth_id);
+
+-- avatars shared by several accounts keep working with a query string telling them apart
+UPDATE users SET avatar = avatar || '?u=' || id
+WHERE id NOT IN (SELECT MIN(id) FROM users GROUP BY avatar);
+ALTER TABLE users ADD CONSTRAINT users_avatar_key UNIQUE (avatar);
+
+DROP TABLE IF EXISTS identities;
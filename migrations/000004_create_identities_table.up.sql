@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS identities (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	user_id TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	username TEXT NOT NULL DEFAULT '',
+	email TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (provider, subject),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS identities_user_idx ON identities (user_id);
+
+-- oauth_id used to be written as a single rune holding the GitHub id, recover the ones that survived it.
+-- Accounts whose id was mangled are linked again by email on their next GitHub sign-in.
+INSERT INTO identities (id, user_id, provider, subject, username, email, created_at)
+SELECT gen_random_uuid()::TEXT, id, 'github', ascii(oauth_id)::TEXT, username, email, created_at
+FROM users
+WHERE oauth_id <> '' AND ascii(oauth_id) <> 65533
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS oauth_id;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_avatar_key;
@@ -0,0 +1 @@
+ALTER TABLE users DROP COLUMN IF EXISTS role, DROP COLUMN IF EXISTS suspended_at;
@@ -0,0 +1,3 @@
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin')),
+	ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP;
@@ -0,0 +1,4 @@
+ALTER TABLE snippets DROP COLUMN IF EXISTS org_id;
+DROP TABLE IF EXISTS org_invites;
+DROP TABLE IF EXISTS org_members;
+DROP TABLE IF EXISTS orgs;
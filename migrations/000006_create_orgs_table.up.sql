@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS orgs (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	slug TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS org_members (
+	org_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'maintainer', 'member')),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (org_id, user_id),
+	FOREIGN KEY (org_id) REFERENCES orgs (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS org_members_user_idx ON org_members (user_id);
+
+CREATE TABLE IF NOT EXISTS org_invites (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	org_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'maintainer', 'member')),
+	invited_by TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (org_id, user_id),
+	FOREIGN KEY (org_id) REFERENCES orgs (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id),
+	FOREIGN KEY (invited_by) REFERENCES users (id)
+);
+
+-- a snippet owned by an org stays with its author, deleting the org hands it back to them
+ALTER TABLE snippets ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES orgs (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS snippets_org_idx ON snippets (org_id);
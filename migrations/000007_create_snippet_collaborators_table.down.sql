@@ -0,0 +1 @@
+DROP TABLE IF EXISTS snippet_collaborators;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS snippet_collaborators (
+	snippet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	permission TEXT NOT NULL DEFAULT 'read' CHECK (permission IN ('read', 'write')),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (snippet_id, user_id),
+	FOREIGN KEY (snippet_id) REFERENCES snippets (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS snippet_collaborators_user_idx ON snippet_collaborators (user_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS moderation_audit;
+DROP TABLE IF EXISTS reports;
+ALTER TABLE snippets DROP COLUMN IF EXISTS hidden_at;
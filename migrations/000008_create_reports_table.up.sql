@@ -0,0 +1,36 @@
+-- hidden snippets are taken down by a moderator, only their author can still see them
+ALTER TABLE snippets ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS reports (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	snippet_id TEXT NOT NULL,
+	reporter_id TEXT,
+	reason TEXT NOT NULL CHECK (reason IN ('spam', 'abuse', 'malware', 'copyright', 'other')),
+	details TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'dismissed', 'actioned')),
+	resolved_by TEXT,
+	resolved_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (snippet_id) REFERENCES snippets (id) ON DELETE CASCADE,
+	FOREIGN KEY (reporter_id) REFERENCES users (id),
+	FOREIGN KEY (resolved_by) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS reports_status_idx ON reports (status, created_at);
+-- a user can only have one open report per snippet
+CREATE UNIQUE INDEX IF NOT EXISTS reports_open_reporter_idx ON reports (snippet_id, reporter_id) WHERE status = 'open';
+
+-- the audit trail outlives the snippets and reports it refers to, so it has no foreign keys on them
+CREATE TABLE IF NOT EXISTS moderation_audit (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	moderator_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	report_id TEXT,
+	snippet_id TEXT,
+	user_id TEXT,
+	note TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (moderator_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS moderation_audit_created_idx ON moderation_audit (created_at);
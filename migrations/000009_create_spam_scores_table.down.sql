@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS spam_scores;
+DROP INDEX IF EXISTS snippets_user_created_idx;
+DROP INDEX IF EXISTS snippets_code_md5_idx;
+ALTER TABLE snippets DROP COLUMN IF EXISTS quarantined_at;
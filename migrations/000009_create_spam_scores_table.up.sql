@@ -0,0 +1,18 @@
+-- quarantined snippets scored as spam, they are kept off the public feed until a moderator releases them
+ALTER TABLE snippets ADD COLUMN IF NOT EXISTS quarantined_at TIMESTAMP;
+
+-- finds the same code posted from other accounts
+CREATE INDEX IF NOT EXISTS snippets_code_md5_idx ON snippets (md5(code));
+CREATE INDEX IF NOT EXISTS snippets_user_created_idx ON snippets (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS spam_scores (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	snippet_id TEXT NOT NULL,
+	score REAL NOT NULL,
+	signals JSONB NOT NULL DEFAULT '[]',
+	quarantined BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (snippet_id) REFERENCES snippets (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS spam_scores_snippet_idx ON spam_scores (snippet_id, created_at);
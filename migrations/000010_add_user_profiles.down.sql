@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS username_redirects;
+ALTER TABLE users
+	DROP COLUMN IF EXISTS display_name,
+	DROP COLUMN IF EXISTS bio,
+	DROP COLUMN IF EXISTS website,
+	DROP COLUMN IF EXISTS avatar_override;
@@ -0,0 +1,14 @@
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS website TEXT NOT NULL DEFAULT '',
+	-- avatar_override replaces the avatar of the identity provider when set
+	ADD COLUMN IF NOT EXISTS avatar_override TEXT NOT NULL DEFAULT '';
+
+-- old usernames keep pointing at their user until somebody else takes them
+CREATE TABLE IF NOT EXISTS username_redirects (
+	old_username TEXT PRIMARY KEY NOT NULL,
+	user_id TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,28 @@
+-- rows that only make sense for their user go away with them
+ALTER TABLE snippets DROP CONSTRAINT IF EXISTS snippets_user_id_fkey,
+	ADD CONSTRAINT snippets_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE tokens DROP CONSTRAINT IF EXISTS tokens_user_id_fkey,
+	ADD CONSTRAINT tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE identities DROP CONSTRAINT IF EXISTS identities_user_id_fkey,
+	ADD CONSTRAINT identities_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE org_members DROP CONSTRAINT IF EXISTS org_members_user_id_fkey,
+	ADD CONSTRAINT org_members_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE org_invites DROP CONSTRAINT IF EXISTS org_invites_user_id_fkey,
+	ADD CONSTRAINT org_invites_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE org_invites DROP CONSTRAINT IF EXISTS org_invites_invited_by_fkey,
+	ADD CONSTRAINT org_invites_invited_by_fkey FOREIGN KEY (invited_by) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE snippet_collaborators DROP CONSTRAINT IF EXISTS snippet_collaborators_user_id_fkey,
+	ADD CONSTRAINT snippet_collaborators_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+
+-- reports outlive the people who filed and resolved them
+ALTER TABLE reports DROP CONSTRAINT IF EXISTS reports_reporter_id_fkey,
+	ADD CONSTRAINT reports_reporter_id_fkey FOREIGN KEY (reporter_id) REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE reports DROP CONSTRAINT IF EXISTS reports_resolved_by_fkey,
+	ADD CONSTRAINT reports_resolved_by_fkey FOREIGN KEY (resolved_by) REFERENCES users (id) ON DELETE SET NULL;
+
+-- the ghost takes over the public snippets and audit entries of anonymised accounts, it has
+-- no identities so nobody can sign in as it
+INSERT INTO users (id, username, email, avatar, role, suspended_at, created_at, updated_at)
+VALUES ('00000000-0000-0000-0000-000000000000', '[deleted]', 'ghost@snipnet.invalid', '', 'user',
+	CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+ON CONFLICT (id) DO NOTHING;
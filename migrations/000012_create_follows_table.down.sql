@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS snippets_user_updated_idx;
+DROP TABLE IF EXISTS follows;
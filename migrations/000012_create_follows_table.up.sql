@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS follows (
+	follower_id TEXT NOT NULL,
+	followee_id TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (follower_id, followee_id),
+	CHECK (follower_id <> followee_id),
+	FOREIGN KEY (follower_id) REFERENCES users (id) ON DELETE CASCADE,
+	FOREIGN KEY (followee_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS follows_followee_idx ON follows (followee_id, created_at);
+-- the feed walks the snippets of followed users newest first
+CREATE INDEX IF NOT EXISTS snippets_user_updated_idx ON snippets (user_id, updated_at DESC, id DESC);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS notifications (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	user_id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	actor_id TEXT,
+	snippet_id TEXT,
+	org_id TEXT,
+	read_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	FOREIGN KEY (actor_id) REFERENCES users (id) ON DELETE SET NULL,
+	FOREIGN KEY (snippet_id) REFERENCES snippets (id) ON DELETE CASCADE,
+	FOREIGN KEY (org_id) REFERENCES orgs (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+
+-- every type is enabled until the user turns it off
+CREATE TABLE IF NOT EXISTS notification_preferences (
+	user_id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL,
+	PRIMARY KEY (user_id, type),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	user_id TEXT,
+	org_id TEXT,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT[] NOT NULL DEFAULT '{}',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	FOREIGN KEY (org_id) REFERENCES orgs (id) ON DELETE CASCADE,
+	-- a webhook belongs to a user or to an org, never both
+	CHECK ((user_id IS NULL) <> (org_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_user_idx ON webhooks (user_id);
+CREATE INDEX IF NOT EXISTS webhooks_org_idx ON webhooks (org_id);
+
+-- the delivery queue and log, the payload is kept as sent so replays are byte for byte
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	webhook_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP,
+	response_status INTEGER,
+	response_body TEXT,
+	error TEXT,
+	duration_ms BIGINT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_attempt_at TIMESTAMP,
+	FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
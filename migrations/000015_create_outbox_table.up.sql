@@ -0,0 +1,18 @@
+-- events are written here in the same transaction as the change they describe and relayed
+-- to subscribers afterwards, there are no foreign keys since events outlive their rows
+CREATE TABLE IF NOT EXISTS outbox (
+	id TEXT PRIMARY KEY NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	user_id TEXT,
+	actor_id TEXT,
+	snippet_id TEXT,
+	org_id TEXT,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_error TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	dispatched_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_attempt_at) WHERE dispatched_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_dispatched_idx ON outbox (dispatched_at) WHERE dispatched_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- version goes up with every change to a snippet, it is the snippet's ETag
+ALTER TABLE snippets ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
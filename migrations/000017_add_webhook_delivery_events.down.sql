@@ -0,0 +1,2 @@
+ALTER TABLE webhook_deliveries DROP CONSTRAINT IF EXISTS webhook_deliveries_event_key;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS event_id;
@@ -0,0 +1,4 @@
+-- the outbox event a delivery was queued for, an event handed out again doesn't queue a
+-- second delivery to the same webhook. Pings and redeliveries have none.
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS event_id TEXT;
+ALTER TABLE webhook_deliveries ADD CONSTRAINT webhook_deliveries_event_key UNIQUE (webhook_id, event_id);
@@ -1,19 +1,43 @@
 package routes
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/cors"
 	"github.com/swaggo/http-swagger"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"golang.org/x/oauth2"
 
 	"snipnet/controllers"
 	"snipnet/controllers/middleware"
+	"snipnet/controllers/policy"
+	utils "snipnet/controllers/responseutils"
+	"snipnet/events"
 	"snipnet/services"
+	"snipnet/services/oauth"
+	"snipnet/services/spam"
+	"snipnet/services/webhook"
+	"snipnet/types"
+)
+
+// Rate limits per route, they apply per user, per access token or per IP for anonymous clients.
+var (
+	// authLimit guards sign in, which is only ever needed a handful of times.
+	authLimit = middleware.Limit{Name: "auth", Rate: 10, Period: time.Minute}
+	// searchLimit guards the listings, which run full-text searches.
+	searchLimit = middleware.Limit{Name: "search", Rate: 60, Period: time.Minute, Burst: 20}
+	readLimit   = middleware.Limit{Name: "read", Rate: 300, Period: time.Minute, Burst: 60}
+	writeLimit  = middleware.Limit{Name: "write", Rate: 30, Period: time.Minute, Burst: 10}
+	exportLimit = middleware.Limit{Name: "export", Rate: 5, Period: time.Hour}
+	reportLimit = middleware.Limit{Name: "report", Rate: 10, Period: time.Hour}
+	// batchLimit guards batches, each of which can change up to 100 snippets.
+	batchLimit = middleware.Limit{Name: "batch", Rate: 10, Period: time.Minute}
 )
 
 func Routes(rds *redis.Client) http.Handler {
@@ -24,16 +48,7 @@ func Routes(rds *redis.Client) http.Handler {
 	}
 
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
-	oauthConfig := oauth2.Config{
-		ClientID:     os.Getenv("GH_CLIENT_ID"),
-		ClientSecret: os.Getenv("GH_CLIENT_SECRET"),
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://github.com/login/oauth/authorize",
-			TokenURL: "https://github.com/login/oauth/access_token",
-		},
-		RedirectURL: os.Getenv("GH_REDIRECT_URL"),
-		Scopes:      []string{"user"},
-	}
+	providers := oauthProviders(logger)
 
 	// swagger
 	handleFunc("GET /swagger/*", httpSwagger.Handler())
@@ -43,29 +58,184 @@ func Routes(rds *redis.Client) http.Handler {
 		w.Write([]byte("Up and ready to rumble!!!\n"))
 	})
 
+	tokens := services.Token{}
+	sessions := services.NewSessions(
+		rds,
+		durationEnv("SESSION_IDLE_TIMEOUT", logger),
+		durationEnv("SESSION_ABSOLUTE_TIMEOUT", logger),
+	)
 	users := services.User{}
-	auth_controller := controllers.NewAuthController(&users, &oauthConfig, logger, rds)
-	handleFunc("POST /signin", auth_controller.GitHubOauth)
-	handleFunc("POST /signout", middleware.IsAuthenticated(auth_controller.Signout, logger, rds))
+	cookies := utils.CookieConfigFromEnv()
+	auth := middleware.NewAuth(logger, sessions, &tokens, &users, cookies)
+	limits := middleware.NewRateLimit(middleware.NewRedisLimiter(rds), logger)
+	limit := limits.Limit
+	idempotent := middleware.NewIdempotency(middleware.NewRedisIdempotencyStore(rds), logger).Idempotent
+
+	auth_controller := controllers.NewAuthController(&users, sessions, providers, rds, os.Getenv("FRONTEND_URL"), cookies, logger)
+	handleFunc("GET /auth/{provider}/login", limit(auth.OptionalAuth(auth_controller.OauthLogin), authLimit))
+	handleFunc("GET /auth/{provider}/callback", limit(auth_controller.OauthCallback, authLimit))
+	handleFunc("POST /token/refresh", limit(auth_controller.RefreshToken, authLimit))
+	handleFunc("POST /signout", auth.IsAuthenticated(auth_controller.Signout))
+	handleFunc("GET /me/identities", auth.IsAuthenticated(auth_controller.GetIdentities, types.ScopeUserRead))
+	handleFunc("POST /me/identities", auth.IsAuthenticated(auth_controller.LinkIdentity, types.ScopeUserWrite))
+	handleFunc("DELETE /me/identities/{id}", auth.IsAuthenticated(auth_controller.DeleteIdentity, types.ScopeUserWrite))
+
+	session_controller := controllers.NewSessionController(sessions, logger)
+	handleFunc("GET /sessions", auth.IsAuthenticated(session_controller.GetSessions, types.ScopeUserRead))
+	handleFunc("DELETE /sessions", auth.IsAuthenticated(session_controller.DeleteOtherSessions, types.ScopeUserWrite))
+	handleFunc("DELETE /sessions/{id}", auth.IsAuthenticated(session_controller.DeleteSession, types.ScopeUserWrite))
+	handleFunc("POST /stream/tickets", auth.IsAuthenticated(limit(session_controller.CreateTicket, writeLimit)))
+
+	stream := services.NewStream(rds)
+	notifications := services.NewNotifications(stream)
+	dispatcher := events.NewDispatcher(logger)
+	dispatcher.Subscribe(events.All, notifications.Notify)
+	dispatcher.Subscribe(events.SnippetUpdated, stream.SnippetChanged)
+	dispatcher.Subscribe(events.SnippetDeleted, stream.SnippetChanged)
+	dispatcher.Subscribe(events.SnippetHidden, stream.SnippetChanged)
 
 	snippets := services.Snippet{}
-	snippet_controller := controllers.NewSnippetController(&snippets, logger, rds)
-	handleFunc("GET /snippets/{id}", snippet_controller.GetSnippetByID)
-	handleFunc("GET /snippets", snippet_controller.GetAllSnippets)
-	handleFunc("POST /snippets", middleware.IsAuthenticated(snippet_controller.CreateSnippet, logger, rds))
-	handleFunc("DELETE /snippets/{id}", middleware.IsAuthenticated(snippet_controller.DeleteSnippet, logger, rds))
-	handleFunc("PUT /snippets/{id}", middleware.IsAuthenticated(snippet_controller.UpdateSnippetMulti, logger, rds))
-	handleFunc("PATCH /snippets/{id}", middleware.IsAuthenticated(snippet_controller.UpdateSnippetOne, logger, rds))
+	orgs := services.Org{}
+	collaborators := services.Collaborators{}
+	spamScores := services.Spam{}
+	snippet_controller := controllers.NewSnippetController(
+		&snippets,
+		&orgs,
+		&collaborators,
+		&users,
+		&spamScores,
+		spamRules(logger),
+		dispatcher,
+		stream,
+		logger,
+		rds,
+	)
+	handleFunc("GET /snippets/{id}", auth.OptionalAuth(limit(snippet_controller.GetSnippetByID, readLimit), types.ScopeSnippetsRead))
+	handleFunc("GET /snippets/{id}/events", auth.Tickets(auth.OptionalAuth(limit(snippet_controller.Events, readLimit), types.ScopeSnippetsRead)))
+	collab_controller := controllers.NewCollabController(snippet_controller, services.NewRooms(rds), allowedOrigins(), logger)
+	handleFunc("GET /snippets/{id}/live", auth.Tickets(auth.IsAuthenticated(limit(collab_controller.Live, readLimit), types.ScopeSnippetsRead)))
+	handleFunc("GET /snippets", auth.OptionalAuth(limit(snippet_controller.GetAllSnippets, searchLimit), types.ScopeSnippetsRead))
+	handleFunc("POST /snippets", auth.IsAuthenticated(limit(idempotent(snippet_controller.CreateSnippet), writeLimit), types.ScopeSnippetsWrite))
+	handleFunc("POST /snippets/batch", auth.IsAuthenticated(limit(idempotent(snippet_controller.Batch), batchLimit), types.ScopeSnippetsWrite))
+	handleFunc("DELETE /snippets/{id}", auth.IsAuthenticated(limit(snippet_controller.DeleteSnippet, writeLimit), types.ScopeSnippetsWrite))
+	handleFunc("PUT /snippets/{id}", auth.IsAuthenticated(limit(snippet_controller.UpdateSnippetMulti, writeLimit), types.ScopeSnippetsWrite))
+	handleFunc("PATCH /snippets/{id}", auth.IsAuthenticated(limit(snippet_controller.PatchSnippet, writeLimit), types.ScopeSnippetsWrite))
+	handleFunc("GET /snippets/{id}/collaborators", auth.IsAuthenticated(snippet_controller.GetCollaborators, types.ScopeSnippetsRead))
+	handleFunc("POST /snippets/{id}/collaborators", auth.IsAuthenticated(idempotent(snippet_controller.AddCollaborator), types.ScopeSnippetsWrite))
+	handleFunc("DELETE /snippets/{id}/collaborators/{user_id}", auth.IsAuthenticated(snippet_controller.RemoveCollaborator, types.ScopeSnippetsWrite))
+	moderation := services.Moderation{}
+	moderation_controller := controllers.NewModerationController(&moderation, &snippets, &spamScores, sessions, logger)
+	handleFunc("POST /snippets/{id}/report", auth.OptionalAuth(limit(idempotent(moderation_controller.ReportSnippet), reportLimit), types.ScopeSnippetsRead))
+	handleFunc("GET /me/shared", auth.IsAuthenticated(snippet_controller.GetSharedSnippets, types.ScopeSnippetsRead))
 
 	user_controller := controllers.NewUserController(&users, logger, rds)
-	handleFunc("GET /users/{id}", middleware.IsAuthenticated(user_controller.GetUserByID, logger, rds))
-	handleFunc("GET /users/{id}/snippets", middleware.IsAuthenticated(snippet_controller.GetAllUserSnippets, logger, rds))
+	handleFunc("GET /me", auth.IsAuthenticated(user_controller.GetMe, types.ScopeUserRead))
+	handleFunc("PATCH /me", auth.IsAuthenticated(limit(user_controller.UpdateMe, writeLimit), types.ScopeUserWrite))
+	accounts := services.Account{}
+	account_controller := controllers.NewAccountController(&accounts, sessions, cookies, logger)
+	handleFunc("GET /me/export", auth.IsAuthenticated(limit(account_controller.Export, exportLimit), types.ScopeUserRead))
+	handleFunc("DELETE /me", auth.IsAuthenticated(limit(account_controller.DeleteAccount, writeLimit), types.ScopeUserWrite))
+	handleFunc("GET /users/{username}", limit(user_controller.GetProfile, readLimit))
+	notification_controller := controllers.NewNotificationController(notifications, stream, logger)
+	handleFunc("GET /events", auth.Tickets(auth.IsAuthenticated(limit(notification_controller.Events, readLimit), types.ScopeUserRead)))
+	handleFunc("GET /notifications", auth.IsAuthenticated(limit(notification_controller.GetNotifications, readLimit), types.ScopeUserRead))
+	handleFunc("POST /notifications/read", auth.IsAuthenticated(notification_controller.MarkAllRead, types.ScopeUserWrite))
+	handleFunc("POST /notifications/{id}/read", auth.IsAuthenticated(notification_controller.MarkRead, types.ScopeUserWrite))
+	handleFunc("GET /me/notification-preferences", auth.IsAuthenticated(notification_controller.GetPreferences, types.ScopeUserRead))
+	handleFunc("PATCH /me/notification-preferences", auth.IsAuthenticated(notification_controller.UpdatePreferences, types.ScopeUserWrite))
+
+	follows := services.Follows{}
+	follow_controller := controllers.NewFollowController(&follows, &users, dispatcher, logger)
+	handleFunc("POST /users/{id}/follow", auth.IsAuthenticated(limit(follow_controller.Follow, writeLimit), types.ScopeUserWrite))
+	handleFunc("DELETE /users/{id}/follow", auth.IsAuthenticated(limit(follow_controller.Unfollow, writeLimit), types.ScopeUserWrite))
+	handleFunc("GET /users/{id}/followers", limit(follow_controller.GetFollowers, readLimit))
+	handleFunc("GET /users/{id}/following", limit(follow_controller.GetFollowing, readLimit))
+	handleFunc("GET /feed", auth.IsAuthenticated(limit(follow_controller.GetFeed, readLimit), types.ScopeSnippetsRead))
+	handleFunc("GET /users/{id}/snippets", auth.OptionalAuth(limit(snippet_controller.GetAllUserSnippets, searchLimit), types.ScopeSnippetsRead))
+
+	org_controller := controllers.NewOrgController(&orgs, &users, &snippets, dispatcher, logger)
+	handleFunc("POST /orgs", auth.IsAuthenticated(idempotent(org_controller.CreateOrg), types.ScopeUserWrite))
+	handleFunc("GET /orgs", auth.IsAuthenticated(org_controller.GetOrgs, types.ScopeUserRead))
+	handleFunc("GET /orgs/{slug}", auth.OptionalAuth(org_controller.GetOrg, types.ScopeUserRead))
+	handleFunc("PATCH /orgs/{slug}", auth.IsAuthenticated(org_controller.UpdateOrg, types.ScopeUserWrite))
+	handleFunc("DELETE /orgs/{slug}", auth.IsAuthenticated(org_controller.DeleteOrg, types.ScopeUserWrite))
+	handleFunc("GET /orgs/{slug}/members", auth.IsAuthenticated(org_controller.GetMembers, types.ScopeUserRead))
+	handleFunc("PATCH /orgs/{slug}/members/{id}", auth.IsAuthenticated(org_controller.UpdateMemberRole, types.ScopeUserWrite))
+	handleFunc("DELETE /orgs/{slug}/members/{id}", auth.IsAuthenticated(org_controller.RemoveMember, types.ScopeUserWrite))
+	handleFunc("POST /orgs/{slug}/invites", auth.IsAuthenticated(idempotent(org_controller.CreateInvite), types.ScopeUserWrite))
+	handleFunc("GET /orgs/{slug}/snippets", auth.OptionalAuth(limit(org_controller.GetOrgSnippets, searchLimit), types.ScopeSnippetsRead))
+	handleFunc("GET /me/invites", auth.IsAuthenticated(org_controller.GetInvites, types.ScopeUserRead))
+	handleFunc("POST /me/invites/{id}/accept", auth.IsAuthenticated(org_controller.AcceptInvite, types.ScopeUserWrite))
+	handleFunc("DELETE /me/invites/{id}", auth.IsAuthenticated(org_controller.DeclineInvite, types.ScopeUserWrite))
+
+	token_controller := controllers.NewTokenController(&tokens, logger)
+	handleFunc("GET /tokens", auth.IsAuthenticated(token_controller.GetTokens, types.ScopeUserRead))
+	handleFunc("POST /tokens", auth.IsAuthenticated(token_controller.CreateToken, types.ScopeUserWrite))
+	handleFunc("DELETE /tokens/{id}", auth.IsAuthenticated(token_controller.DeleteToken, types.ScopeUserWrite))
+
+	webhooks := services.NewWebhooks(&snippets, webhook.NewSender(10*time.Second, os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"))
+	for _, t := range services.WebhookEvents {
+		dispatcher.Subscribe(t, webhooks.Enqueue)
+	}
+	go webhooks.Run(context.Background(), logger)
+	// the stores write snippet and user events to the outbox along with the change, this
+	// relays them to the subscribers above
+	go services.NewOutbox(dispatcher).Run(context.Background(), logger)
+	webhook_controller := controllers.NewWebhookController(webhooks, &orgs, logger)
+	handleFunc("GET /me/webhooks", auth.IsAuthenticated(webhook_controller.GetUserWebhooks, types.ScopeUserRead))
+	handleFunc("POST /me/webhooks", auth.IsAuthenticated(limit(webhook_controller.CreateUserWebhook, writeLimit), types.ScopeUserWrite))
+	handleFunc("GET /orgs/{slug}/webhooks", auth.IsAuthenticated(webhook_controller.GetOrgWebhooks, types.ScopeUserRead))
+	handleFunc("POST /orgs/{slug}/webhooks", auth.IsAuthenticated(limit(webhook_controller.CreateOrgWebhook, writeLimit), types.ScopeUserWrite))
+	handleFunc("GET /webhooks/{id}", auth.IsAuthenticated(webhook_controller.GetWebhook, types.ScopeUserRead))
+	handleFunc("PATCH /webhooks/{id}", auth.IsAuthenticated(limit(webhook_controller.UpdateWebhook, writeLimit), types.ScopeUserWrite))
+	handleFunc("DELETE /webhooks/{id}", auth.IsAuthenticated(limit(webhook_controller.DeleteWebhook, writeLimit), types.ScopeUserWrite))
+	handleFunc("POST /webhooks/{id}/ping", auth.IsAuthenticated(limit(webhook_controller.Ping, writeLimit), types.ScopeUserWrite))
+	handleFunc("GET /webhooks/{id}/deliveries", auth.IsAuthenticated(webhook_controller.GetDeliveries, types.ScopeUserRead))
+	handleFunc("POST /webhooks/{id}/deliveries/{delivery_id}/redeliver", auth.IsAuthenticated(limit(webhook_controller.Redeliver, writeLimit), types.ScopeUserWrite))
+
+	admin_controller := controllers.NewAdminController(&users, sessions, logger)
+	admin := func(handlerFunc http.HandlerFunc, scope string) http.HandlerFunc {
+		return auth.IsAuthenticated(auth.RequirePermission(handlerFunc, policy.ManageUsers), scope)
+	}
+	handleFunc("GET /admin/users", admin(admin_controller.GetUsers, types.ScopeUserRead))
+	handleFunc("PATCH /admin/users/{id}/role", admin(admin_controller.UpdateUserRole, types.ScopeUserWrite))
+	handleFunc("POST /admin/users/{id}/suspend", admin(admin_controller.SuspendUser, types.ScopeUserWrite))
+	handleFunc("DELETE /admin/users/{id}/suspend", admin(admin_controller.UnsuspendUser, types.ScopeUserWrite))
+
+	moderator := func(handlerFunc http.HandlerFunc, scope string) http.HandlerFunc {
+		return auth.IsAuthenticated(auth.RequirePermission(handlerFunc, policy.ModerateSnippets), scope)
+	}
+	handleFunc("GET /moderation/reports", moderator(moderation_controller.GetReports, types.ScopeSnippetsRead))
+	handleFunc("POST /moderation/reports/{id}/dismiss", moderator(moderation_controller.DismissReport, types.ScopeSnippetsWrite))
+	handleFunc("POST /moderation/reports/{id}/hide", moderator(moderation_controller.HideReportedSnippet, types.ScopeSnippetsWrite))
+	handleFunc("POST /moderation/reports/{id}/suspend", moderator(moderation_controller.SuspendReportedAuthor, types.ScopeSnippetsWrite))
+	handleFunc("POST /moderation/snippets/{id}/hide", moderator(moderation_controller.HideSnippet, types.ScopeSnippetsWrite))
+	handleFunc("DELETE /moderation/snippets/{id}/hide", moderator(moderation_controller.UnhideSnippet, types.ScopeSnippetsWrite))
+	handleFunc("GET /moderation/audit", moderator(moderation_controller.GetAudit, types.ScopeSnippetsRead))
+	handleFunc("GET /moderation/quarantine", moderator(moderation_controller.GetQuarantined, types.ScopeSnippetsRead))
+	handleFunc("GET /moderation/snippets/{id}/spam", moderator(moderation_controller.GetSpamScores, types.ScopeSnippetsRead))
+	handleFunc("POST /moderation/snippets/{id}/release", moderator(moderation_controller.ReleaseSnippet, types.ScopeSnippetsWrite))
 
 	// add cors
 	handler := otelhttp.NewHandler(mux, "/")
+	// credentials are only ever shared with the configured origins, an empty list must not
+	// fall back to the library's default of allowing every origin
+	origins := allowedOrigins()
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowOriginFunc: func(origin string) bool {
+			return slices.Contains(origins, origin)
+		},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", utils.CSRFHeader, "If-Match", "If-None-Match", middleware.IdempotencyKeyHeader},
+		ExposedHeaders: []string{
+			"RateLimit-Limit",
+			"RateLimit-Remaining",
+			"RateLimit-Reset",
+			"RateLimit-Policy",
+			"Retry-After",
+			"ETag",
+			middleware.IdempotentReplayedHeader,
+		},
 		AllowCredentials: true,
 		Debug:            true,
 	})
@@ -73,3 +243,87 @@ func Routes(rds *redis.Client) http.Handler {
 
 	return router
 }
+
+// allowedOrigins reads the comma separated ALLOWED_ORIGINS, e.g https://snipnet.dev,http://localhost:3000
+func allowedOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" && origin != "*" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// oauthProviders enables every identity provider that has a client id configured.
+func oauthProviders(log *slog.Logger) oauth.Providers {
+	providers := oauth.Providers{}
+
+	if id := os.Getenv("GH_CLIENT_ID"); id != "" {
+		providers["github"] = oauth.NewGitHub(id, os.Getenv("GH_CLIENT_SECRET"), os.Getenv("GH_REDIRECT_URL"))
+	}
+
+	if id := os.Getenv("GITLAB_CLIENT_ID"); id != "" {
+		providers["gitlab"] = oauth.NewGitLab(
+			os.Getenv("GITLAB_URL"),
+			id,
+			os.Getenv("GITLAB_CLIENT_SECRET"),
+			os.Getenv("GITLAB_REDIRECT_URL"),
+		)
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		name := os.Getenv("OIDC_PROVIDER_NAME")
+		if name == "" {
+			name = "oidc"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		provider, err := oauth.NewOIDC(
+			ctx,
+			name,
+			issuer,
+			os.Getenv("OIDC_CLIENT_ID"),
+			os.Getenv("OIDC_CLIENT_SECRET"),
+			os.Getenv("OIDC_REDIRECT_URL"),
+		)
+		if err != nil {
+			log.Error("CONFIG", slog.String("Unable to set up the OIDC provider", err.Error()))
+		} else {
+			providers[name] = provider
+		}
+	}
+
+	return providers
+}
+
+// spamRules loads the spam scoring rules from the JSON file in SPAM_RULES_FILE, the
+// built-in rules are used when it isn't set.
+func spamRules(log *slog.Logger) spam.Config {
+	path := os.Getenv("SPAM_RULES_FILE")
+	if path == "" {
+		return spam.DefaultConfig()
+	}
+
+	rules, err := spam.LoadConfig(path)
+	if err != nil {
+		log.Error("CONFIG", slog.String("SPAM_RULES_FILE", err.Error()))
+	}
+	return rules
+}
+
+// durationEnv reads a duration such as 30m or 24h from the environment, zero means use the default.
+func durationEnv(key string, log *slog.Logger) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Error("CONFIG", slog.String(key, err.Error()))
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"snipnet/events"
+	"snipnet/types"
+)
+
+const (
+	// AccountDelete removes the user along with everything they created.
+	AccountDelete = "delete"
+	// AccountAnonymise hands the user's public and org snippets to the ghost before
+	// removing the user, their private snippets are deleted.
+	AccountAnonymise = "anonymise"
+)
+
+// GhostUserID is the account that keeps the content of anonymised users, see migration
+// 000011_cascade_user_deletes.
+const GhostUserID = "00000000-0000-0000-0000-000000000000"
+
+// ErrSoleOwner is returned when deleting an account would leave an org with members but
+// no owner.
+var ErrSoleOwner = errors.New("Account is the only owner of an org with other members")
+
+type AccountStore interface {
+	GetExport(user_id string) (*Export, error)
+	DeleteAccount(user_id, mode string) error
+}
+
+type Account struct{}
+
+// Export is everything stored about a user in the database. Sessions live in Redis and are
+// filled in by the caller.
+type Export struct {
+	ExportedAt     time.Time             `json:"exported_at"`
+	User           *User                 `json:"user"`
+	Identities     []*types.Identity     `json:"identities"`
+	Tokens         []*Token              `json:"tokens"`
+	Sessions       []*types.Session      `json:"sessions"`
+	Orgs           []*Org                `json:"orgs"`
+	Snippets       []*Snippet            `json:"snippets"`
+	Collaborations []*types.Collaborator `json:"collaborations"`
+	Reports        []*types.Report       `json:"reports"`
+}
+
+func (a *Account) GetExport(user_id string) (*Export, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var users User
+	var tokens Token
+	var orgs Org
+	export := Export{ExportedAt: time.Now()}
+
+	user, err := users.GetUser("id", user_id)
+	if err != nil {
+		return nil, err
+	}
+	export.User = user
+
+	identities, err := users.GetIdentities(user_id)
+	if err != nil {
+		return nil, err
+	}
+	export.Identities = *identities
+
+	userTokens, err := tokens.GetTokens(user_id)
+	if err != nil {
+		return nil, err
+	}
+	export.Tokens = *userTokens
+
+	userOrgs, err := orgs.GetUserOrgs(user_id)
+	if err != nil {
+		return nil, err
+	}
+	export.Orgs = *userOrgs
+
+	if export.Snippets, err = exportSnippets(ctx, user_id); err != nil {
+		return nil, err
+	}
+	if export.Collaborations, err = exportCollaborations(ctx, user_id); err != nil {
+		return nil, err
+	}
+	if export.Reports, err = exportReports(ctx, user_id); err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+// exportSnippets lists every snippet of the user, hidden and quarantined ones included.
+func exportSnippets(ctx context.Context, user_id string) ([]*Snippet, error) {
+	snippets := []*Snippet{}
+
+	query := fmt.Sprintf("SELECT %s FROM snippets WHERE user_id = $1 ORDER BY created_at;", snippetColumns)
+	row, err := db.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		snippet, err := scanSnippet(row)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, nil
+}
+
+func exportCollaborations(ctx context.Context, user_id string) ([]*types.Collaborator, error) {
+	collaborations := []*types.Collaborator{}
+
+	query := `
+		SELECT snippet_collaborators.snippet_id, snippet_collaborators.user_id, users.username,
+			users.avatar, snippet_collaborators.permission, snippet_collaborators.created_at
+		FROM snippet_collaborators
+		INNER JOIN users ON users.id = snippet_collaborators.user_id
+		WHERE snippet_collaborators.user_id = $1
+		ORDER BY snippet_collaborators.created_at;
+	`
+	row, err := db.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var collaborator types.Collaborator
+		err = row.Scan(
+			&collaborator.SnippetID,
+			&collaborator.UserID,
+			&collaborator.Username,
+			&collaborator.Avatar,
+			&collaborator.Permission,
+			&collaborator.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		collaborations = append(collaborations, &collaborator)
+	}
+	return collaborations, nil
+}
+
+// exportReports lists the reports the user filed.
+func exportReports(ctx context.Context, user_id string) ([]*types.Report, error) {
+	reports := []*types.Report{}
+
+	query := `
+		SELECT ` + reportColumns + `
+		FROM reports
+		INNER JOIN snippets ON snippets.id = reports.snippet_id
+		WHERE reports.reporter_id = $1
+		ORDER BY reports.created_at;
+	`
+	row, err := db.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		report, err := scanReport(row)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// DeleteAccount removes the user, mode is AccountDelete or AccountAnonymise. Orgs the user
+// is the last member of are deleted with them, ErrSoleOwner is returned when an org would
+// be left without an owner. Everything else the user owns is removed by the foreign keys.
+func (a *Account) DeleteAccount(user_id, mode string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orphaned bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM org_members AS owner
+			WHERE owner.user_id = $1 AND owner.role = 'owner'
+			AND NOT EXISTS (
+				SELECT 1 FROM org_members
+				WHERE org_id = owner.org_id AND user_id <> $1 AND role = 'owner'
+			)
+			AND EXISTS (SELECT 1 FROM org_members WHERE org_id = owner.org_id AND user_id <> $1)
+		);
+	`
+	if err = tx.QueryRowContext(ctx, query, user_id).Scan(&orphaned); err != nil {
+		return err
+	}
+	if orphaned {
+		return ErrSoleOwner
+	}
+
+	query = `
+		DELETE FROM orgs
+		WHERE id IN (SELECT org_id FROM org_members WHERE user_id = $1)
+		AND NOT EXISTS (SELECT 1 FROM org_members WHERE org_id = orgs.id AND user_id <> $1);
+	`
+	if _, err = tx.ExecContext(ctx, query, user_id); err != nil {
+		return err
+	}
+
+	// snippets are handed over or deleted here rather than by the foreign keys, so that
+	// subscribers hear about each of them
+	if mode == AccountAnonymise {
+		query = `
+			UPDATE snippets SET user_id = $1, version = version + 1 WHERE user_id = $2 AND (is_public OR org_id IS NOT NULL)
+			RETURNING id, user_id, org_id;
+		`
+		if err = recordSnippetEvents(ctx, tx, events.SnippetUpdated, user_id, query, GhostUserID, user_id); err != nil {
+			return err
+		}
+	}
+	query = "DELETE FROM snippets WHERE user_id = $1 RETURNING id, user_id, org_id;"
+	if err = recordSnippetEvents(ctx, tx, events.SnippetDeleted, user_id, query, user_id); err != nil {
+		return err
+	}
+
+	// the audit trail has to survive, it keeps the actions without the moderator
+	query = "UPDATE moderation_audit SET moderator_id = $1 WHERE moderator_id = $2;"
+	if _, err = tx.ExecContext(ctx, query, GhostUserID, user_id); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1;", user_id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return commitUserEvent(ctx, tx, events.UserDeleted, user_id)
+}
+
+// recordSnippetEvents runs query, which returns the id, user_id and org_id of the snippets
+// it changed, and records an event of type t for each of them.
+func recordSnippetEvents(ctx context.Context, tx *sql.Tx, t, actor_id, query string, args ...any) error {
+	row, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	changed := []Snippet{}
+	for row.Next() {
+		var snippet Snippet
+		if err = row.Scan(&snippet.ID, &snippet.UserID, &snippet.OrgID); err != nil {
+			row.Close()
+			return err
+		}
+		changed = append(changed, snippet)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return err
+	}
+
+	for _, snippet := range changed {
+		if err = recordEvent(ctx, tx, snippetEvent(t, &snippet, actor_id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"snipnet/types"
+)
+
+// Batch operations, changing a snippet's visibility is an update of the whole snippet.
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// batchTimeout bounds an atomic batch, which holds its transaction for all of its operations.
+const batchTimeout = 10 * time.Second
+
+// ErrBatchAborted is the result of the operations of an atomic batch that weren't applied
+// because another one failed.
+var ErrBatchAborted = errors.New("Not applied, another operation of the batch failed")
+
+// BatchOp is one change of a batch. Snippet is the snippet to create or the new content of
+// the one to update, only its ID and Version are used by deletes.
+type BatchOp struct {
+	Op      string
+	Snippet *Snippet
+}
+
+// BatchResult is the outcome of a BatchOp, Snippet is the saved snippet for creates and
+// updates.
+type BatchResult struct {
+	Snippet *Snippet
+	Err     error
+}
+
+// GetSnippetsByID fetches the snippets with the given ids in a single query, the ones that
+// don't exist are missing from the map.
+func (s *Snippet) GetSnippetsByID(ids []string) (map[string]*types.SnippetWithUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM snippets
+		INNER JOIN users ON snippets.user_id = users.id
+		WHERE snippets.id = ANY($1);
+	`, snippetWithUserColumns)
+	snippets, err := querySnippets(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*types.SnippetWithUser, len(*snippets))
+	for _, snippet := range *snippets {
+		found[snippet.ID] = snippet
+	}
+	return found, nil
+}
+
+// ApplyBatch applies ops in order and returns a result for each of them. An atomic batch
+// runs in a single transaction and is applied in full or not at all, otherwise each
+// operation is applied on its own and the ones that fail don't stop the others. Deleting a
+// snippet that doesn't exist fails with sql.ErrNoRows.
+func (s *Snippet) ApplyBatch(ops []BatchOp, actor_id string, atomic bool) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	if !atomic {
+		for i, op := range ops {
+			results[i] = applyBatchOp(op, actor_id)
+		}
+		return results
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+
+	abort := func(failed int, err error) []BatchResult {
+		for i := range results {
+			results[i] = BatchResult{Err: ErrBatchAborted}
+		}
+		if failed >= 0 {
+			results[failed].Err = err
+		}
+		return results
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return abort(-1, err)
+	}
+	defer tx.Rollback()
+
+	for i, op := range ops {
+		snippet, err := batchOp(ctx, tx, op, actor_id)
+		if err != nil {
+			return abort(i, err)
+		}
+		results[i].Snippet = snippet
+	}
+
+	if err = commitSnippets(tx); err != nil {
+		for i := range results {
+			results[i] = BatchResult{Err: err}
+		}
+	}
+	return results
+}
+
+func applyBatchOp(op BatchOp, actor_id string) BatchResult {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+	defer tx.Rollback()
+
+	snippet, err := batchOp(ctx, tx, op, actor_id)
+	if err == nil {
+		err = commitSnippets(tx)
+	}
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+	return BatchResult{Snippet: snippet}
+}
+
+func batchOp(ctx context.Context, tx *sql.Tx, op BatchOp, actor_id string) (*Snippet, error) {
+	switch op.Op {
+	case BatchCreate:
+		return insertSnippet(ctx, tx, op.Snippet)
+	case BatchUpdate:
+		return updateSnippet(ctx, tx, op.Snippet, actor_id)
+	case BatchDelete:
+		return nil, deleteSnippet(ctx, tx, op.Snippet.ID, actor_id, op.Snippet.Version)
+	default:
+		return nil, fmt.Errorf("Unknown batch operation %q", op.Op)
+	}
+}
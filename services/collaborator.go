@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"snipnet/types"
+)
+
+type CollaboratorStore interface {
+	GetCollaborators(snippet_id string) (*[]*types.Collaborator, error)
+	GetPermission(snippet_id, user_id string) (string, error)
+	SetCollaborator(snippet_id, user_id, permission string) (*types.Collaborator, error)
+	RemoveCollaborator(snippet_id, user_id string) error
+	GetSharedSnippets(user_id string, offset, limit int) (*[]*types.SnippetWithUser, error)
+}
+
+type Collaborators struct{}
+
+func (c *Collaborators) GetCollaborators(snippet_id string) (*[]*types.Collaborator, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	collaborators := []*types.Collaborator{}
+
+	query := `
+		SELECT snippet_collaborators.snippet_id, snippet_collaborators.user_id, users.username,
+			users.avatar, snippet_collaborators.permission, snippet_collaborators.created_at
+		FROM snippet_collaborators
+		INNER JOIN users ON users.id = snippet_collaborators.user_id
+		WHERE snippet_collaborators.snippet_id = $1
+		ORDER BY snippet_collaborators.created_at;
+	`
+	row, err := db.QueryContext(ctx, query, snippet_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var collaborator types.Collaborator
+		err = row.Scan(
+			&collaborator.SnippetID,
+			&collaborator.UserID,
+			&collaborator.Username,
+			&collaborator.Avatar,
+			&collaborator.Permission,
+			&collaborator.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		collaborators = append(collaborators, &collaborator)
+	}
+
+	return &collaborators, nil
+}
+
+// GetPermission returns sql.ErrNoRows when the snippet hasn't been shared with the user.
+func (c *Collaborators) GetPermission(snippet_id, user_id string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var permission string
+	query := "SELECT permission FROM snippet_collaborators WHERE snippet_id = $1 AND user_id = $2;"
+	err := db.QueryRowContext(ctx, query, snippet_id, user_id).Scan(&permission)
+	return permission, err
+}
+
+// SetCollaborator shares the snippet with the user, or changes their permission if it
+// already is.
+func (c *Collaborators) SetCollaborator(snippet_id, user_id, permission string) (*types.Collaborator, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO snippet_collaborators (snippet_id, user_id, permission, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (snippet_id, user_id) DO UPDATE SET permission = EXCLUDED.permission
+		RETURNING snippet_id, user_id, permission, created_at;
+	`
+	var collaborator types.Collaborator
+	row := db.QueryRowContext(ctx, query, snippet_id, user_id, permission, time.Now())
+	err := row.Scan(
+		&collaborator.SnippetID,
+		&collaborator.UserID,
+		&collaborator.Permission,
+		&collaborator.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &collaborator, nil
+}
+
+func (c *Collaborators) RemoveCollaborator(snippet_id, user_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "DELETE FROM snippet_collaborators WHERE snippet_id = $1 AND user_id = $2;"
+	return execOne(ctx, query, snippet_id, user_id)
+}
+
+// GetSharedSnippets lists the snippets other users have shared with user_id.
+func (c *Collaborators) GetSharedSnippets(user_id string, offset, limit int) (*[]*types.SnippetWithUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM snippets
+		INNER JOIN users ON snippets.user_id = users.id
+		INNER JOIN snippet_collaborators ON snippet_collaborators.snippet_id = snippets.id
+		WHERE snippet_collaborators.user_id = $1 AND snippets.hidden_at IS NULL
+		ORDER BY snippets.updated_at DESC
+		LIMIT $2
+		OFFSET $3;
+	`, snippetWithUserColumns)
+	return querySnippets(ctx, query, user_id, limit, offset)
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"snipnet/types"
+)
+
+type FollowStore interface {
+	Follow(follower_id, followee_id string) (bool, error)
+	Unfollow(follower_id, followee_id string) error
+	GetFollowers(user_id string, offset, limit int) (*[]*types.Follow, error)
+	GetFollowing(user_id string, offset, limit int) (*[]*types.Follow, error)
+	GetFeed(user_id string, cursor *FeedCursor, limit int) (*types.Feed, error)
+}
+
+type Follows struct{}
+
+// ErrInvalidCursor is returned by ParseFeedCursor for cursors it didn't hand out.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// FeedCursor points at the last item of a feed page, the next page starts right after it.
+type FeedCursor struct {
+	At time.Time
+	ID string
+}
+
+func (c FeedCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.At.UTC().Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func ParseFeedCursor(s string) (*FeedCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	at, id, ok := strings.Cut(string(data), "|")
+	if !ok || id == "" {
+		return nil, ErrInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &FeedCursor{At: t, ID: id}, nil
+}
+
+// Follow is a no-op when follower_id already follows followee_id, it returns whether a
+// follow was added.
+func (f *Follows) Follow(follower_id, followee_id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO follows (follower_id, followee_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING;
+	`
+	res, err := db.ExecContext(ctx, query, follower_id, followee_id, time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Unfollow returns sql.ErrNoRows when follower_id wasn't following followee_id.
+func (f *Follows) Unfollow(follower_id, followee_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2;"
+	return execOne(ctx, query, follower_id, followee_id)
+}
+
+func (f *Follows) GetFollowers(user_id string, offset, limit int) (*[]*types.Follow, error) {
+	return queryFollows("follows.follower_id", "follows.followee_id", user_id, offset, limit)
+}
+
+func (f *Follows) GetFollowing(user_id string, offset, limit int) (*[]*types.Follow, error) {
+	return queryFollows("follows.followee_id", "follows.follower_id", user_id, offset, limit)
+}
+
+// queryFollows lists the users in column of the follows where match is user_id.
+func queryFollows(column, match, user_id string, offset, limit int) (*[]*types.Follow, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	follows := []*types.Follow{}
+
+	query := fmt.Sprintf(`
+		SELECT users.id, users.username, users.display_name,
+			COALESCE(NULLIF(users.avatar_override, ''), users.avatar), follows.created_at
+		FROM follows
+		INNER JOIN users ON users.id = %s
+		WHERE %s = $1
+		ORDER BY follows.created_at DESC
+		LIMIT $2
+		OFFSET $3;
+	`, column, match)
+	row, err := db.QueryContext(ctx, query, user_id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var follow types.Follow
+		err = row.Scan(&follow.ID, &follow.Username, &follow.DisplayName, &follow.Avatar, &follow.FollowedAt)
+		if err != nil {
+			return nil, err
+		}
+		follows = append(follows, &follow)
+	}
+
+	return &follows, nil
+}
+
+// GetFeed lists the public snippets of the users user_id follows, most recently created or
+// updated first. Each snippet appears once, at its latest change.
+func (f *Follows) GetFeed(user_id string, cursor *FeedCursor, limit int) (*types.Feed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	args := []any{user_id, limit + 1}
+	after := ""
+	if cursor != nil {
+		after = "AND (snippets.updated_at, snippets.id) < ($3, $4)"
+		args = append(args, cursor.At, cursor.ID)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM snippets
+		INNER JOIN users ON snippets.user_id = users.id
+		INNER JOIN follows ON follows.followee_id = snippets.user_id
+		WHERE follows.follower_id = $1
+		AND snippets.is_public AND snippets.hidden_at IS NULL AND snippets.quarantined_at IS NULL
+		%s
+		ORDER BY snippets.updated_at DESC, snippets.id DESC
+		LIMIT $2;
+	`, snippetWithUserColumns, after)
+	snippets, err := querySnippets(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// one extra row is fetched to tell whether there is a next page
+	feed := types.Feed{Items: []*types.FeedItem{}}
+	for i, snippet := range *snippets {
+		if i == limit {
+			last := feed.Items[len(feed.Items)-1]
+			feed.NextCursor = FeedCursor{At: last.At, ID: last.Snippet.ID}.String()
+			break
+		}
+
+		item := types.FeedItem{Type: types.FeedSnippetUpdated, At: snippet.UpdatedAt, Snippet: snippet}
+		if !snippet.UpdatedAt.After(snippet.CreatedAt) {
+			item.Type = types.FeedSnippetCreated
+		}
+		feed.Items = append(feed.Items, &item)
+	}
+
+	return &feed, nil
+}
@@ -0,0 +1,386 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"snipnet/events"
+	"snipnet/types"
+)
+
+// Decisions a moderator can take, they double as the actions in the audit trail.
+const (
+	ModerationDismiss = "dismiss"
+	ModerationHide    = "hide"
+	ModerationUnhide  = "unhide"
+	ModerationSuspend = "suspend"
+	ModerationRelease = "release"
+)
+
+// ErrProtectedAccount is returned when a report asks to suspend a moderator or an admin,
+// whoever resolves it. Staff accounts are only suspended through the admin user routes.
+var ErrProtectedAccount = errors.New("Staff accounts can't be suspended through a report")
+
+type ModerationStore interface {
+	CreateReport(report *types.Report) (*types.Report, error)
+	GetReports(status string, offset, limit int) (*[]*types.Report, error)
+	ResolveReport(id, moderator_id, decision, note string) (*types.Report, error)
+	SetSnippetHidden(snippet_id, moderator_id string, hidden bool, note string) error
+	GetAudit(offset, limit int) (*[]*types.AuditEntry, error)
+	GetQuarantined(offset, limit int) (*[]*types.SnippetWithUser, error)
+	ReleaseSnippet(snippet_id, moderator_id, note string) error
+}
+
+type Moderation struct{}
+
+const reportColumns = `
+	reports.id, reports.snippet_id, snippets.title, snippets.user_id, reports.reporter_id,
+	reports.reason, reports.details, reports.status, reports.resolved_by, reports.resolved_at,
+	reports.created_at
+`
+
+func scanReport(row scanner) (*types.Report, error) {
+	var report types.Report
+	err := row.Scan(
+		&report.ID,
+		&report.SnippetID,
+		&report.SnippetTitle,
+		&report.AuthorID,
+		&report.ReporterID,
+		&report.Reason,
+		&report.Details,
+		&report.Status,
+		&report.ResolvedBy,
+		&report.ResolvedAt,
+		&report.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// CreateReport files a report, sql.ErrNoRows is returned when the reporter already has an
+// open report on the snippet.
+func (m *Moderation) CreateReport(report *types.Report) (*types.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO reports (id, snippet_id, reporter_id, reason, details, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (snippet_id, reporter_id) WHERE status = 'open' DO NOTHING
+		RETURNING id, snippet_id, reporter_id, reason, details, status, created_at;
+	`
+	var saved types.Report
+	row := db.QueryRowContext(ctx, query, report.ID, report.SnippetID, report.ReporterID,
+		report.Reason, report.Details, time.Now())
+	err := row.Scan(
+		&saved.ID,
+		&saved.SnippetID,
+		&saved.ReporterID,
+		&saved.Reason,
+		&saved.Details,
+		&saved.Status,
+		&saved.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saved, nil
+}
+
+// GetReports lists reports with the given status, oldest first so the queue is worked in order.
+func (m *Moderation) GetReports(status string, offset, limit int) (*[]*types.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	reports := []*types.Report{}
+
+	query := `
+		SELECT ` + reportColumns + `
+		FROM reports
+		INNER JOIN snippets ON snippets.id = reports.snippet_id
+		WHERE reports.status = $1
+		ORDER BY reports.created_at
+		LIMIT $2
+		OFFSET $3;
+	`
+	row, err := db.QueryContext(ctx, query, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		report, err := scanReport(row)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return &reports, nil
+}
+
+// ResolveReport applies a moderator's decision on an open report. Hiding the snippet or
+// suspending its author also closes every other open report on the snippet. The decision
+// is written to the audit trail in the same transaction, sql.ErrNoRows is returned when
+// there is no open report with that id.
+func (m *Moderation) ResolveReport(id, moderator_id, decision, note string) (*types.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	now := time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var snippet_id, author_id string
+	query := `
+		SELECT reports.snippet_id, snippets.user_id
+		FROM reports
+		INNER JOIN snippets ON snippets.id = reports.snippet_id
+		WHERE reports.id = $1 AND reports.status = 'open'
+		FOR UPDATE OF reports;
+	`
+	if err = tx.QueryRowContext(ctx, query, id).Scan(&snippet_id, &author_id); err != nil {
+		return nil, err
+	}
+
+	var audit_user *string
+	if decision == ModerationDismiss {
+		query = "UPDATE reports SET status = 'dismissed', resolved_by = $1, resolved_at = $2 WHERE id = $3;"
+		_, err = tx.ExecContext(ctx, query, moderator_id, now, id)
+	} else {
+		query = `
+			UPDATE reports SET status = 'actioned', resolved_by = $1, resolved_at = $2
+			WHERE snippet_id = $3 AND status = 'open';
+		`
+		if _, err = tx.ExecContext(ctx, query, moderator_id, now, snippet_id); err != nil {
+			return nil, err
+		}
+
+		query = "UPDATE snippets SET hidden_at = COALESCE(hidden_at, $1), version = version + 1 WHERE id = $2;"
+		if _, err = tx.ExecContext(ctx, query, now, snippet_id); err != nil {
+			return nil, err
+		}
+
+		err = recordEvent(ctx, tx, events.Event{
+			Type:      events.SnippetHidden,
+			UserID:    author_id,
+			ActorID:   moderator_id,
+			SnippetID: snippet_id,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if decision == ModerationSuspend {
+		query = `
+			UPDATE users SET suspended_at = COALESCE(suspended_at, $1), updated_at = $1
+			WHERE id = $2 AND role = 'user';
+		`
+		res, err := tx.ExecContext(ctx, query, now, author_id)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, ErrProtectedAccount
+		}
+		audit_user = &author_id
+	}
+
+	err = writeAudit(ctx, tx, &types.AuditEntry{
+		ModeratorID: moderator_id,
+		Action:      decision,
+		ReportID:    &id,
+		SnippetID:   &snippet_id,
+		UserID:      audit_user,
+		Note:        note,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT ` + reportColumns + `
+		FROM reports
+		INNER JOIN snippets ON snippets.id = reports.snippet_id
+		WHERE reports.id = $1;
+	`
+	report, err := scanReport(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = commitSnippets(tx); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// SetSnippetHidden hides or restores a snippet outside of a report, sql.ErrNoRows is
+// returned when the snippet doesn't exist. Hiding it records a snippet.hidden event for its
+// author.
+func (m *Moderation) SetSnippetHidden(snippet_id, moderator_id string, hidden bool, note string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hiddenAt *time.Time
+	action := ModerationUnhide
+	if hidden {
+		now := time.Now()
+		hiddenAt = &now
+		action = ModerationHide
+	}
+
+	var author_id string
+	query := "UPDATE snippets SET hidden_at = $1, version = version + 1 WHERE id = $2 RETURNING user_id;"
+	if err = tx.QueryRowContext(ctx, query, hiddenAt, snippet_id).Scan(&author_id); err != nil {
+		return err
+	}
+
+	if hidden {
+		err = recordEvent(ctx, tx, events.Event{
+			Type:      events.SnippetHidden,
+			UserID:    author_id,
+			ActorID:   moderator_id,
+			SnippetID: snippet_id,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeAudit(ctx, tx, &types.AuditEntry{
+		ModeratorID: moderator_id,
+		Action:      action,
+		SnippetID:   &snippet_id,
+		Note:        note,
+	})
+	if err != nil {
+		return err
+	}
+
+	return commitSnippets(tx)
+}
+
+// GetQuarantined lists the snippets waiting for review after scoring as spam, oldest first.
+func (m *Moderation) GetQuarantined(offset, limit int) (*[]*types.SnippetWithUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT ` + snippetWithUserColumns + `
+		FROM snippets
+		INNER JOIN users ON snippets.user_id = users.id
+		WHERE snippets.quarantined_at IS NOT NULL
+		ORDER BY snippets.quarantined_at
+		LIMIT $1
+		OFFSET $2;
+	`
+	return querySnippets(ctx, query, limit, offset)
+}
+
+// ReleaseSnippet lifts the quarantine of a snippet, sql.ErrNoRows is returned when it isn't
+// quarantined.
+func (m *Moderation) ReleaseSnippet(snippet_id, moderator_id, note string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE snippets SET quarantined_at = NULL, version = version + 1 WHERE id = $1 AND quarantined_at IS NOT NULL;"
+	res, err := tx.ExecContext(ctx, query, snippet_id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = writeAudit(ctx, tx, &types.AuditEntry{
+		ModeratorID: moderator_id,
+		Action:      ModerationRelease,
+		SnippetID:   &snippet_id,
+		Note:        note,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *Moderation) GetAudit(offset, limit int) (*[]*types.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	entries := []*types.AuditEntry{}
+
+	query := `
+		SELECT id, moderator_id, action, report_id, snippet_id, user_id, note, created_at
+		FROM moderation_audit
+		ORDER BY created_at DESC
+		LIMIT $1
+		OFFSET $2;
+	`
+	row, err := db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var entry types.AuditEntry
+		err = row.Scan(
+			&entry.ID,
+			&entry.ModeratorID,
+			&entry.Action,
+			&entry.ReportID,
+			&entry.SnippetID,
+			&entry.UserID,
+			&entry.Note,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	return &entries, nil
+}
+
+func writeAudit(ctx context.Context, tx *sql.Tx, entry *types.AuditEntry) error {
+	query := `
+		INSERT INTO moderation_audit (id, moderator_id, action, report_id, snippet_id, user_id, note, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+	`
+	_, err := tx.ExecContext(ctx, query, uuid.NewString(), entry.ModeratorID, entry.Action,
+		entry.ReportID, entry.SnippetID, entry.UserID, entry.Note, time.Now())
+	return err
+}
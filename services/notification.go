@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+
+	"snipnet/events"
+	"snipnet/types"
+)
+
+// NotificationTypes are the events users are notified about, a notification has the type
+// of the event it was made from.
+var NotificationTypes = []string{
+	events.SnippetShared,
+	events.SnippetHidden,
+	events.OrgInvited,
+	events.UserFollowed,
+}
+
+type NotificationStore interface {
+	Notify(ctx context.Context, event events.Event) error
+	GetNotifications(user_id string, unread bool, offset, limit int) (*types.Notifications, error)
+	MarkRead(id, user_id string) error
+	MarkAllRead(user_id string) error
+	GetPreferences(user_id string) (types.NotificationPreferences, error)
+	SetPreferences(user_id string, preferences types.NotificationPreferences) (types.NotificationPreferences, error)
+}
+
+type Notifications struct {
+	stream StreamStore
+}
+
+func NewNotifications(stream StreamStore) *Notifications {
+	return &Notifications{stream: stream}
+}
+
+// Notify is an events.Handler. It stores a notification for the user the event concerns,
+// unless they caused it themselves or turned the type off, and sends it to the clients
+// they have listening for live updates. The notification takes the id of the event, so an
+// event handed out twice is only stored once.
+func (n *Notifications) Notify(ctx context.Context, event events.Event) error {
+	if event.UserID == "" || event.UserID == event.ActorID || !slices.Contains(NotificationTypes, event.Type) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	notification := types.Notification{
+		ID:        event.ID,
+		Type:      event.Type,
+		ActorID:   nullable(event.ActorID),
+		SnippetID: nullable(event.SnippetID),
+		OrgID:     nullable(event.OrgID),
+		CreatedAt: event.At,
+	}
+
+	query := `
+		INSERT INTO notifications (id, user_id, type, actor_id, snippet_id, org_id, created_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7
+		WHERE NOT EXISTS (
+			SELECT 1 FROM notification_preferences
+			WHERE user_id = $2 AND type = $3 AND NOT enabled
+		)
+		ON CONFLICT (id) DO NOTHING;
+	`
+	res, err := db.ExecContext(ctx, query, notification.ID, event.UserID, notification.Type,
+		notification.ActorID, notification.SnippetID, notification.OrgID, notification.CreatedAt)
+	// the user, actor, snippet or org is gone by the time the event is relayed, retrying
+	// won't bring it back
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+
+	return n.stream.Publish(ctx, UserChannel(event.UserID), "notification", notification)
+}
+
+// nullable stores empty ids as NULL so they don't trip the foreign keys.
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// GetNotifications lists the notifications of user_id newest first, along with how many of
+// them are unread.
+func (n *Notifications) GetNotifications(user_id string, unread bool, offset, limit int) (*types.Notifications, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	list := types.Notifications{Notifications: []*types.Notification{}}
+
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL;", user_id).Scan(&list.Unread)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT notifications.id, notifications.type, notifications.actor_id, users.username,
+			notifications.snippet_id, snippets.title, notifications.org_id, orgs.slug,
+			notifications.read_at, notifications.created_at
+		FROM notifications
+		LEFT JOIN users ON users.id = notifications.actor_id
+		LEFT JOIN snippets ON snippets.id = notifications.snippet_id
+		LEFT JOIN orgs ON orgs.id = notifications.org_id
+		WHERE notifications.user_id = $1 AND (NOT $2 OR notifications.read_at IS NULL)
+		ORDER BY notifications.created_at DESC
+		LIMIT $3
+		OFFSET $4;
+	`
+	row, err := db.QueryContext(ctx, query, user_id, unread, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var notification types.Notification
+		err = row.Scan(
+			&notification.ID,
+			&notification.Type,
+			&notification.ActorID,
+			&notification.ActorUsername,
+			&notification.SnippetID,
+			&notification.SnippetTitle,
+			&notification.OrgID,
+			&notification.OrgSlug,
+			&notification.ReadAt,
+			&notification.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		list.Notifications = append(list.Notifications, &notification)
+	}
+
+	return &list, nil
+}
+
+// MarkRead returns sql.ErrNoRows when user_id has no unread notification with that id.
+func (n *Notifications) MarkRead(id, user_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "UPDATE notifications SET read_at = $1 WHERE id = $2 AND user_id = $3 AND read_at IS NULL;"
+	return execOne(ctx, query, time.Now(), id, user_id)
+}
+
+func (n *Notifications) MarkAllRead(user_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "UPDATE notifications SET read_at = $1 WHERE user_id = $2 AND read_at IS NULL;"
+	_, err := db.ExecContext(ctx, query, time.Now(), user_id)
+	return err
+}
+
+// GetPreferences returns every notification type, the ones the user never set are enabled.
+func (n *Notifications) GetPreferences(user_id string) (types.NotificationPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	preferences := types.NotificationPreferences{}
+	for _, t := range NotificationTypes {
+		preferences[t] = true
+	}
+
+	row, err := db.QueryContext(ctx, "SELECT type, enabled FROM notification_preferences WHERE user_id = $1;", user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var t string
+		var enabled bool
+		if err = row.Scan(&t, &enabled); err != nil {
+			return nil, err
+		}
+		if _, ok := preferences[t]; ok {
+			preferences[t] = enabled
+		}
+	}
+
+	return preferences, nil
+}
+
+// SetPreferences changes the types in preferences and leaves the others as they are, the
+// caller makes sure every type is one of NotificationTypes.
+func (n *Notifications) SetPreferences(user_id string, preferences types.NotificationPreferences) (types.NotificationPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO notification_preferences (user_id, type, enabled) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, type) DO UPDATE SET enabled = EXCLUDED.enabled;
+	`
+	for t, enabled := range preferences {
+		if _, err = tx.ExecContext(ctx, query, user_id, t, enabled); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return n.GetPreferences(user_id)
+}
@@ -0,0 +1,75 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"golang.org/x/oauth2"
+
+	"snipnet/types"
+)
+
+type GitHub struct {
+	base
+	apiURL string
+}
+
+func NewGitHub(clientID, clientSecret, redirectURL string) *GitHub {
+	return &GitHub{
+		base: base{
+			name: "github",
+			config: &oauth2.Config{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://github.com/login/oauth/authorize",
+					TokenURL: "https://github.com/login/oauth/access_token",
+				},
+				RedirectURL: redirectURL,
+				Scopes:      []string{"user"},
+			},
+		},
+		apiURL: "https://api.github.com",
+	}
+}
+
+type ghEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func (g *GitHub) FetchIdentity(ctx context.Context, token *oauth2.Token) (*types.Identity, error) {
+	var user types.GHUser
+	err := g.getJSON(ctx, token, g.apiURL+"/user", &user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ID == 0 {
+		return nil, errors.New("github did not return a user id")
+	}
+
+	// users with a private email address only expose it through the emails endpoint
+	if user.Email == "" {
+		var emails []ghEmail
+		err = g.getJSON(ctx, token, g.apiURL+"/user/emails", &emails)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				user.Email = e.Email
+			}
+		}
+	}
+
+	return &types.Identity{
+		Provider: g.name,
+		Subject:  strconv.Itoa(user.ID),
+		Username: user.Login,
+		Email:    user.Email,
+		Avatar:   user.AvatarURL,
+	}, nil
+}
@@ -0,0 +1,69 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"snipnet/types"
+)
+
+// GitLab works with gitlab.com as well as self-hosted instances.
+type GitLab struct {
+	base
+	baseURL string
+}
+
+type glUser struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+func NewGitLab(baseURL, clientID, clientSecret, redirectURL string) *GitLab {
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return &GitLab{
+		base: base{
+			name: "gitlab",
+			config: &oauth2.Config{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  baseURL + "/oauth/authorize",
+					TokenURL: baseURL + "/oauth/token",
+				},
+				RedirectURL: redirectURL,
+				Scopes:      []string{"read_user"},
+			},
+		},
+		baseURL: baseURL,
+	}
+}
+
+func (g *GitLab) FetchIdentity(ctx context.Context, token *oauth2.Token) (*types.Identity, error) {
+	var user glUser
+	err := g.getJSON(ctx, token, g.baseURL+"/api/v4/user", &user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ID == 0 {
+		return nil, errors.New("gitlab did not return a user id")
+	}
+
+	return &types.Identity{
+		Provider: g.name,
+		Subject:  strconv.Itoa(user.ID),
+		Username: user.Username,
+		Email:    user.Email,
+		Avatar:   user.AvatarURL,
+	}, nil
+}
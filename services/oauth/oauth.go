@@ -0,0 +1,72 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+
+	"snipnet/types"
+)
+
+// Provider is an OAuth identity provider users can sign in with.
+type Provider interface {
+	Name() string
+	AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string
+	Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	FetchIdentity(ctx context.Context, token *oauth2.Token) (*types.Identity, error)
+}
+
+var ErrUnknownProvider = errors.New("Unknown identity provider")
+
+type Providers map[string]Provider
+
+func (p Providers) Get(name string) (Provider, error) {
+	provider, ok := p[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return provider, nil
+}
+
+// base implements the parts of Provider that only depend on the oauth2 config.
+type base struct {
+	name   string
+	config *oauth2.Config
+}
+
+func (b *base) Name() string {
+	return b.name
+}
+
+func (b *base) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return b.config.AuthCodeURL(state, opts...)
+}
+
+func (b *base) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return b.config.Exchange(ctx, code, opts...)
+}
+
+// getJSON fetches url with the user's access token and decodes the response into v.
+func (b *base) getJSON(ctx context.Context, token *oauth2.Token, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := b.config.Client(ctx, token).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", b.name, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,136 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// stubOIDC serves just enough of an OpenID Connect provider to sign a user in.
+func stubOIDC(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("GET /userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]string{
+			"sub":                "user-123",
+			"preferred_username": "jdoe",
+			"email":              "jdoe@example.com",
+		})
+	})
+
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOIDC(t *testing.T) {
+	srv := stubOIDC(t)
+	ctx := context.Background()
+
+	provider, err := NewOIDC(ctx, "corp", srv.URL, "client", "secret", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should build the auth url from discovery", func(t *testing.T) {
+		u, err := url.Parse(provider.AuthCodeURL("state"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path != "/authorize" || u.Query().Get("state") != "state" {
+			t.Fatalf("unexpected auth url %s", u)
+		}
+	})
+
+	t.Run("should fetch the identity for a valid code", func(t *testing.T) {
+		token, err := provider.Exchange(ctx, "good-code")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identity, err := provider.FetchIdentity(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity.Provider != "corp" || identity.Subject != "user-123" || identity.Username != "jdoe" {
+			t.Fatalf("unexpected identity %+v", identity)
+		}
+	})
+
+	t.Run("should fail for an invalid code", func(t *testing.T) {
+		if _, err := provider.Exchange(ctx, "bad-code"); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("should reject a mismatched issuer", func(t *testing.T) {
+		if _, err := NewOIDC(ctx, "corp", srv.URL+"/other", "client", "secret", ""); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestGitLab(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mux.HandleFunc("POST /oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("GET /api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":42,"username":"jdoe","email":"jdoe@example.com"}`))
+	})
+
+	ctx := context.Background()
+	provider := NewGitLab(srv.URL+"/", "client", "secret", "")
+
+	token, err := provider.Exchange(ctx, "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := provider.FetchIdentity(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "gitlab" || identity.Subject != "42" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
@@ -0,0 +1,111 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"snipnet/types"
+)
+
+// OIDC is a generic OpenID Connect provider configured through discovery.
+type OIDC struct {
+	base
+	userinfoURL string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcUserinfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Nickname          string `json:"nickname"`
+	Email             string `json:"email"`
+	Picture           string `json:"picture"`
+}
+
+// NewOIDC fetches the issuer's discovery document and builds a provider from it.
+func NewOIDC(ctx context.Context, name, issuer, clientID, clientSecret, redirectURL string) (*OIDC, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery responded with %s", resp.Status)
+	}
+
+	var doc oidcDiscovery
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch, expected %s got %s", issuer, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+		return nil, errors.New("oidc discovery document is missing required endpoints")
+	}
+
+	return &OIDC{
+		base: base{
+			name: name,
+			config: &oauth2.Config{
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  doc.AuthorizationEndpoint,
+					TokenURL: doc.TokenEndpoint,
+				},
+				RedirectURL: redirectURL,
+				Scopes:      []string{"openid", "profile", "email"},
+			},
+		},
+		userinfoURL: doc.UserinfoEndpoint,
+	}, nil
+}
+
+func (o *OIDC) FetchIdentity(ctx context.Context, token *oauth2.Token) (*types.Identity, error) {
+	var info oidcUserinfo
+	err := o.getJSON(ctx, token, o.userinfoURL, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Subject == "" {
+		return nil, errors.New("oidc userinfo did not return a subject")
+	}
+
+	username := info.PreferredUsername
+	if username == "" {
+		username = info.Nickname
+	}
+	if username == "" {
+		username, _, _ = strings.Cut(info.Email, "@")
+	}
+
+	return &types.Identity{
+		Provider: o.name,
+		Subject:  info.Subject,
+		Username: username,
+		Email:    info.Email,
+		Avatar:   info.Picture,
+	}, nil
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"snipnet/types"
+)
+
+type OrgStore interface {
+	CreateOrg(org *Org, owner_id string) (*Org, error)
+	GetOrg(slug string) (*Org, error)
+	GetUserOrgs(user_id string) (*[]*Org, error)
+	UpdateOrg(org *Org) (*Org, error)
+	DeleteOrg(id string) error
+	GetMembers(org_id string) (*[]*types.OrgMember, error)
+	GetMemberRole(org_id, user_id string) (string, error)
+	UpdateMemberRole(org_id, user_id, role string) error
+	RemoveMember(org_id, user_id string) error
+	CreateInvite(invite *types.OrgInvite) (*types.OrgInvite, error)
+	GetUserInvites(user_id string) (*[]*types.OrgInvite, error)
+	AcceptInvite(id, user_id string) (*types.OrgMember, error)
+	DeleteInvite(id, user_id string) error
+}
+
+type Org struct {
+	ID          string `json:"id"`
+	Slug        string `json:"slug" validate:"required,min=2,max=40"`
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description"`
+	// Role is the role of the user the org was fetched for, if any.
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateOrg creates the org and makes owner_id its first owner.
+func (o *Org) CreateOrg(org *Org, owner_id string) (*Org, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	var saved Org
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO orgs (id, slug, name, description, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, slug, name, description, created_at, updated_at;
+	`
+	row := tx.QueryRowContext(ctx, query, org.ID, org.Slug, org.Name, org.Description, time.Now(), time.Now())
+	err = row.Scan(
+		&saved.ID,
+		&saved.Slug,
+		&saved.Name,
+		&saved.Description,
+		&saved.CreatedAt,
+		&saved.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO org_members (org_id, user_id, role, created_at) VALUES ($1, $2, 'owner', $3);
+	`, saved.ID, owner_id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	saved.Role = "owner"
+	return &saved, nil
+}
+
+func (o *Org) GetOrg(slug string) (*Org, error) {
+	var org Org
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "SELECT id, slug, name, description, created_at, updated_at FROM orgs WHERE slug = $1;"
+	row := db.QueryRowContext(ctx, query, slug)
+	err := row.Scan(
+		&org.ID,
+		&org.Slug,
+		&org.Name,
+		&org.Description,
+		&org.CreatedAt,
+		&org.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &org, nil
+}
+
+func (o *Org) GetUserOrgs(user_id string) (*[]*Org, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	orgs := []*Org{}
+
+	query := `
+		SELECT orgs.id, orgs.slug, orgs.name, orgs.description, org_members.role,
+			orgs.created_at, orgs.updated_at
+		FROM orgs
+		INNER JOIN org_members ON org_members.org_id = orgs.id
+		WHERE org_members.user_id = $1
+		ORDER BY orgs.name;
+	`
+	row, err := db.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var org Org
+		err = row.Scan(
+			&org.ID,
+			&org.Slug,
+			&org.Name,
+			&org.Description,
+			&org.Role,
+			&org.CreatedAt,
+			&org.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &org)
+	}
+
+	return &orgs, nil
+}
+
+func (o *Org) UpdateOrg(org *Org) (*Org, error) {
+	var saved Org
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE orgs SET name = $1, description = $2, updated_at = $3 WHERE id = $4
+		RETURNING id, slug, name, description, created_at, updated_at;
+	`
+	row := db.QueryRowContext(ctx, query, org.Name, org.Description, time.Now(), org.ID)
+	err := row.Scan(
+		&saved.ID,
+		&saved.Slug,
+		&saved.Name,
+		&saved.Description,
+		&saved.CreatedAt,
+		&saved.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saved, nil
+}
+
+func (o *Org) DeleteOrg(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM orgs WHERE id = $1;", id)
+	return err
+}
+
+func (o *Org) GetMembers(org_id string) (*[]*types.OrgMember, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	members := []*types.OrgMember{}
+
+	query := `
+		SELECT org_members.org_id, org_members.user_id, users.username, users.avatar,
+			org_members.role, org_members.created_at
+		FROM org_members
+		INNER JOIN users ON users.id = org_members.user_id
+		WHERE org_members.org_id = $1
+		ORDER BY org_members.created_at;
+	`
+	row, err := db.QueryContext(ctx, query, org_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var member types.OrgMember
+		err = row.Scan(
+			&member.OrgID,
+			&member.UserID,
+			&member.Username,
+			&member.Avatar,
+			&member.Role,
+			&member.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+
+	return &members, nil
+}
+
+// GetMemberRole returns sql.ErrNoRows when the user isn't a member of the org.
+func (o *Org) GetMemberRole(org_id, user_id string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var role string
+	query := "SELECT role FROM org_members WHERE org_id = $1 AND user_id = $2;"
+	err := db.QueryRowContext(ctx, query, org_id, user_id).Scan(&role)
+	return role, err
+}
+
+func (o *Org) UpdateMemberRole(org_id, user_id, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "UPDATE org_members SET role = $1 WHERE org_id = $2 AND user_id = $3;"
+	return execOne(ctx, query, role, org_id, user_id)
+}
+
+func (o *Org) RemoveMember(org_id, user_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "DELETE FROM org_members WHERE org_id = $1 AND user_id = $2;"
+	return execOne(ctx, query, org_id, user_id)
+}
+
+func (o *Org) CreateInvite(invite *types.OrgInvite) (*types.OrgInvite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO org_invites (id, org_id, user_id, role, invited_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by
+		RETURNING id, org_id, user_id, role, invited_by, created_at;
+	`
+	var saved types.OrgInvite
+	row := db.QueryRowContext(ctx, query, invite.ID, invite.OrgID, invite.UserID, invite.Role,
+		invite.InvitedBy, time.Now())
+	err := row.Scan(
+		&saved.ID,
+		&saved.OrgID,
+		&saved.UserID,
+		&saved.Role,
+		&saved.InvitedBy,
+		&saved.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saved, nil
+}
+
+func (o *Org) GetUserInvites(user_id string) (*[]*types.OrgInvite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	invites := []*types.OrgInvite{}
+
+	query := `
+		SELECT org_invites.id, org_invites.org_id, orgs.slug, org_invites.user_id, org_invites.role,
+			org_invites.invited_by, org_invites.created_at
+		FROM org_invites
+		INNER JOIN orgs ON orgs.id = org_invites.org_id
+		WHERE org_invites.user_id = $1
+		ORDER BY org_invites.created_at DESC;
+	`
+	row, err := db.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var invite types.OrgInvite
+		err = row.Scan(
+			&invite.ID,
+			&invite.OrgID,
+			&invite.OrgSlug,
+			&invite.UserID,
+			&invite.Role,
+			&invite.InvitedBy,
+			&invite.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, &invite)
+	}
+
+	return &invites, nil
+}
+
+// AcceptInvite turns the invite into a membership, only the invited user can accept it.
+func (o *Org) AcceptInvite(id, user_id string) (*types.OrgMember, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	var member types.OrgMember
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM org_invites WHERE id = $1 AND user_id = $2 RETURNING org_id, role;"
+	err = tx.QueryRowContext(ctx, query, id, user_id).Scan(&member.OrgID, &member.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO org_members (org_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING user_id, created_at;
+	`
+	err = tx.QueryRowContext(ctx, query, member.OrgID, user_id, member.Role, time.Now()).
+		Scan(&member.UserID, &member.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+func (o *Org) DeleteInvite(id, user_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return execOne(ctx, "DELETE FROM org_invites WHERE id = $1 AND user_id = $2;", id, user_id)
+}
+
+// execOne runs a statement that is expected to touch a row, sql.ErrNoRows is returned if it didn't.
+func execOne(ctx context.Context, query string, args ...any) error {
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
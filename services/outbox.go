@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"snipnet/events"
+)
+
+const (
+	// outboxPoll is how often the outbox is checked when nothing wakes the relay sooner.
+	outboxPoll = 5 * time.Second
+	// outboxLease is how long a claimed event is held back from other relays, it is
+	// dispatched again after that if the relay claiming it went away.
+	outboxLease = time.Minute
+	outboxBatch = 100
+	// outboxMaxAttempts is how many times an event is handed out before the relay gives up
+	// on it, about two days with the backoff.
+	outboxMaxAttempts = 300
+	// outboxRetention is how long dispatched events are kept around for debugging.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// outboxWake lets a commit nudge the relay of this instance, so events don't wait for the
+// next poll. Relays of other instances still pick them up on theirs.
+var outboxWake = make(chan struct{}, 1)
+
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// recordEvent writes event to the outbox as part of tx, it is dispatched once tx commits.
+// Callers call wakeOutbox after the commit.
+func recordEvent(ctx context.Context, tx *sql.Tx, event events.Event) error {
+	query := `
+		INSERT INTO outbox (id, type, user_id, actor_id, snippet_id, org_id, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7);
+	`
+	_, err := tx.ExecContext(ctx, query, uuid.NewString(), event.Type, nullable(event.UserID),
+		nullable(event.ActorID), nullable(event.SnippetID), nullable(event.OrgID), time.Now())
+	return err
+}
+
+// Dispatcher is implemented by events.Dispatcher.
+type Dispatcher interface {
+	Dispatch(ctx context.Context, event events.Event) error
+}
+
+// Outbox relays the events recorded by the stores to the dispatcher's subscribers. Delivery
+// is at least once: an event is handed out again until every subscriber has taken it, so
+// subscribers use the event id to skip the ones they have already handled.
+type Outbox struct {
+	dispatcher Dispatcher
+}
+
+func NewOutbox(dispatcher Dispatcher) *Outbox {
+	return &Outbox{dispatcher: dispatcher}
+}
+
+// Run relays events until ctx is done. Any number of instances can run it, each event is
+// claimed by one of them at a time.
+func (o *Outbox) Run(ctx context.Context, log *slog.Logger) {
+	ticker := time.NewTicker(outboxPoll)
+	defer ticker.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prune.C:
+			if err := o.prune(); err != nil {
+				log.Error("OUTBOX", slog.String("Unable to prune the outbox", err.Error()))
+			}
+			continue
+		case <-ticker.C:
+		case <-outboxWake:
+		}
+
+		for {
+			n, err := o.relay(ctx, log)
+			if err != nil {
+				log.Error("OUTBOX", slog.String("Unable to relay events", err.Error()))
+			}
+			if err != nil || n < outboxBatch {
+				break
+			}
+		}
+	}
+}
+
+// relay dispatches a batch of the events that are due and returns how many it claimed.
+func (o *Outbox) relay(ctx context.Context, log *slog.Logger) (int, error) {
+	dbCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	query := `
+		UPDATE outbox
+		SET next_attempt_at = $1, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE dispatched_at IS NULL AND next_attempt_at <= $2
+			ORDER BY created_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, type, user_id, actor_id, snippet_id, org_id, created_at, attempts;
+	`
+	row, err := db.QueryContext(dbCtx, query, now.Add(outboxLease), now, outboxBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	type claimed struct {
+		event    events.Event
+		attempts int
+	}
+	batch := []claimed{}
+	for row.Next() {
+		var c claimed
+		var user_id, actor_id, snippet_id, org_id sql.NullString
+		err = row.Scan(&c.event.ID, &c.event.Type, &user_id, &actor_id, &snippet_id, &org_id, &c.event.At, &c.attempts)
+		if err != nil {
+			row.Close()
+			return 0, err
+		}
+		c.event.UserID, c.event.ActorID = user_id.String, actor_id.String
+		c.event.SnippetID, c.event.OrgID = snippet_id.String, org_id.String
+		batch = append(batch, c)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return 0, err
+	}
+
+	// sorted by created_at, but events relayed by other instances can overtake these
+	for _, c := range batch {
+		dispatchErr := o.dispatcher.Dispatch(ctx, c.event)
+		if dispatchErr != nil {
+			log.Error("OUTBOX", slog.String("type", c.event.Type), slog.String("Subscriber failed", dispatchErr.Error()))
+		}
+		if dispatchErr != nil && c.attempts >= outboxMaxAttempts {
+			log.Error("OUTBOX", slog.String("id", c.event.ID), slog.String("Giving up on event", c.event.Type))
+		}
+		if err = o.done(c.event.ID, c.attempts, dispatchErr); err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// done marks an event as dispatched, or schedules it again when a subscriber failed. Retries
+// back off from a second up to ten minutes, after outboxMaxAttempts the event is marked as
+// dispatched with its last error kept.
+func (o *Outbox) done(id string, attempts int, dispatchErr error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	if dispatchErr == nil {
+		_, err := db.ExecContext(ctx, "UPDATE outbox SET dispatched_at = $1, last_error = NULL WHERE id = $2;", now, id)
+		return err
+	}
+	if attempts >= outboxMaxAttempts {
+		query := "UPDATE outbox SET dispatched_at = $1, last_error = $2 WHERE id = $3;"
+		_, err := db.ExecContext(ctx, query, now, dispatchErr.Error(), id)
+		return err
+	}
+
+	backoff := 10 * time.Minute
+	if attempts < 10 {
+		backoff = min(time.Second<<attempts, backoff)
+	}
+	query := "UPDATE outbox SET next_attempt_at = $1, last_error = $2 WHERE id = $3;"
+	_, err := db.ExecContext(ctx, query, now.Add(backoff), dispatchErr.Error(), id)
+	return err
+}
+
+func (o *Outbox) prune() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM outbox WHERE dispatched_at < $1;", time.Now().Add(-outboxRetention))
+	return err
+}
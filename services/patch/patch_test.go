@@ -0,0 +1,122 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func equalJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"replace member", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add member", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"remove member", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"replace array", `{"a":["b"]}`, `{"a":["c"]}`, `{"a":["c"]}`},
+		{"merge nested", `{"a":{"b":"c","d":"e"}}`, `{"a":{"d":null,"f":"g"}}`, `{"a":{"b":"c","f":"g"}}`},
+		{"object over scalar", `{"a":"b"}`, `{"a":{"c":null,"d":"e"}}`, `{"a":{"d":"e"}}`},
+		{"non-object patch", `{"a":"b"}`, `["c"]`, `["c"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Merge([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equalJSON(t, got, tt.want)
+		})
+	}
+
+	if _, err := Merge([]byte(`{}`), []byte(`{`)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	doc := `{"title":"a","tags":["x","y"],"meta":{"a/b":1,"m~n":2}}`
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{"add member", `[{"op":"add","path":"/code","value":"c"}]`, `{"title":"a","tags":["x","y"],"meta":{"a/b":1,"m~n":2},"code":"c"}`},
+		{"insert into array", `[{"op":"add","path":"/tags/1","value":"z"}]`, `{"title":"a","tags":["x","z","y"],"meta":{"a/b":1,"m~n":2}}`},
+		{"append to array", `[{"op":"add","path":"/tags/-","value":"z"}]`, `{"title":"a","tags":["x","y","z"],"meta":{"a/b":1,"m~n":2}}`},
+		{"remove", `[{"op":"remove","path":"/tags/0"}]`, `{"title":"a","tags":["y"],"meta":{"a/b":1,"m~n":2}}`},
+		{"replace", `[{"op":"replace","path":"/title","value":null}]`, `{"title":null,"tags":["x","y"],"meta":{"a/b":1,"m~n":2}}`},
+		{"escaped pointer", `[{"op":"remove","path":"/meta/a~1b"},{"op":"replace","path":"/meta/m~0n","value":3}]`, `{"title":"a","tags":["x","y"],"meta":{"m~n":3}}`},
+		{"move", `[{"op":"move","from":"/title","path":"/name"}]`, `{"name":"a","tags":["x","y"],"meta":{"a/b":1,"m~n":2}}`},
+		{"copy", `[{"op":"copy","from":"/tags","path":"/meta/tags"}]`, `{"title":"a","tags":["x","y"],"meta":{"a/b":1,"m~n":2,"tags":["x","y"]}}`},
+		{"test passes", `[{"op":"test","path":"/tags","value":["x","y"]},{"op":"replace","path":"/title","value":"b"}]`, `{"title":"b","tags":["x","y"],"meta":{"a/b":1,"m~n":2}}`},
+		{"replace document", `[{"op":"replace","path":"","value":{"title":"b"}}]`, `{"title":"b"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equalJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	doc := `{"title":"a","tags":["x"]}`
+	tests := []struct {
+		name  string
+		patch string
+		want  error
+	}{
+		{"not a list", `{"op":"add"}`, ErrInvalid},
+		{"unknown op", `[{"op":"frobnicate","path":"/title"}]`, ErrInvalid},
+		{"missing value", `[{"op":"add","path":"/title"}]`, ErrInvalid},
+		{"bad pointer", `[{"op":"remove","path":"title"}]`, ErrInvalid},
+		{"bad index", `[{"op":"remove","path":"/tags/01"}]`, ErrInvalid},
+		{"move into itself", `[{"op":"move","from":"/tags","path":"/tags/0"}]`, ErrInvalid},
+		{"missing member", `[{"op":"replace","path":"/code","value":"c"}]`, ErrConflict},
+		{"missing parent", `[{"op":"add","path":"/meta/a","value":1}]`, ErrConflict},
+		{"index out of range", `[{"op":"add","path":"/tags/2","value":"z"}]`, ErrConflict},
+		{"test fails", `[{"op":"test","path":"/title","value":"b"}]`, ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Apply([]byte(doc), []byte(tt.patch)); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestApplyIsAtomic(t *testing.T) {
+	doc := []byte(`{"title":"a"}`)
+	patch := `[{"op":"replace","path":"/title","value":"b"},{"op":"test","path":"/title","value":"a"}]`
+	if _, err := Apply(doc, []byte(patch)); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if string(doc) != `{"title":"a"}` {
+		t.Errorf("expected the document to be left alone, got %s", doc)
+	}
+}
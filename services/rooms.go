@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RoomStore keeps track of which API instance holds the live editing room of a snippet.
+// Rooms live in the memory of an instance, so a snippet is only edited on one of them at a
+// time. Claims expire unless they are refreshed, a room of an instance that went away is
+// free again after that.
+type RoomStore interface {
+	// Claim takes the room of snippet_id for owner, it returns false when another owner
+	// holds it. Claiming a room owner already holds extends it.
+	Claim(ctx context.Context, snippet_id, owner string, ttl time.Duration) (bool, error)
+	// Owner returns who holds the room of snippet_id, or "" when nobody does.
+	Owner(ctx context.Context, snippet_id string) (string, error)
+	Release(ctx context.Context, snippet_id, owner string) error
+}
+
+type Rooms struct {
+	cache *redis.Client
+}
+
+func NewRooms(rds *redis.Client) *Rooms {
+	return &Rooms{cache: rds}
+}
+
+func roomKey(snippet_id string) string {
+	return "collab:room:" + snippet_id
+}
+
+// claimRoom sets the key to the owner unless somebody else holds it.
+var claimRoom = redis.NewScript(`
+	local owner = redis.call("GET", KEYS[1])
+	if owner and owner ~= ARGV[1] then
+		return 0
+	end
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+`)
+
+// releaseRoom deletes the key if the owner still holds it.
+var releaseRoom = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+func (r *Rooms) Claim(ctx context.Context, snippet_id, owner string, ttl time.Duration) (bool, error) {
+	claimed, err := claimRoom.Run(ctx, r.cache, []string{roomKey(snippet_id)}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+func (r *Rooms) Owner(ctx context.Context, snippet_id string) (string, error) {
+	owner, err := r.cache.Get(ctx, roomKey(snippet_id)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+func (r *Rooms) Release(ctx context.Context, snippet_id, owner string) error {
+	return releaseRoom.Run(ctx, r.cache, []string{roomKey(snippet_id)}, owner).Err()
+}
@@ -0,0 +1,149 @@
+// Package secrets looks for credentials in snippet code before it is saved.
+package secrets
+
+import (
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Finding is a credential found in the code. Match is redacted so responses and logs
+// don't repeat the secret.
+type Finding struct {
+	Rule  string `json:"rule"`
+	Line  int    `json:"line"`
+	Match string `json:"match"`
+}
+
+// Rule matches a kind of credential on a single line. Valid, when set, filters out
+// matches that only look like the credential.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Valid   func(match string) bool
+}
+
+// Rules is the built-in ruleset, the first rule that matches a line wins so specific
+// rules come before the generic ones.
+var Rules = []Rule{
+	{
+		Name:    "private-key",
+		Pattern: regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`),
+	},
+	{
+		Name:    "aws-access-key-id",
+		Pattern: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		Name:    "aws-secret-access-key",
+		Pattern: regexp.MustCompile(`(?i)aws.{0,20}secret.{0,20}?['"]?\s*[:=]\s*['"]?([A-Za-z0-9/+]{40})\b`),
+	},
+	{
+		Name:    "github-token",
+		Pattern: regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`),
+	},
+	{
+		Name:    "jwt",
+		Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`),
+	},
+	{
+		Name:    "env-password",
+		Pattern: regexp.MustCompile(`^\s*(export\s+)?[A-Z0-9_]*(PASSWORD|PASSWD|PWD|SECRET|TOKEN|API_KEY|APIKEY)[A-Z0-9_]*\s*=\s*['"]?([^\s'"#]+)`),
+		Valid: func(match string) bool {
+			_, value, _ := strings.Cut(match, "=")
+			return !placeholder(strings.Trim(strings.TrimSpace(value), `'"`))
+		},
+	},
+	{
+		Name:    "high-entropy-string",
+		Pattern: regexp.MustCompile(`[A-Za-z0-9+/_=-]{32,}`),
+		Valid:   highEntropy,
+	},
+}
+
+// Scan runs every rule over each line of code and reports at most one finding per line.
+func Scan(code string) []Finding {
+	findings := []Finding{}
+	for i, line := range strings.Split(code, "\n") {
+		for _, rule := range Rules {
+			if match, ok := rule.find(line); ok {
+				findings = append(findings, Finding{Rule: rule.Name, Line: i + 1, Match: redact(match)})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+func (r Rule) find(line string) (string, bool) {
+	for _, match := range r.Pattern.FindAllString(line, -1) {
+		if r.Valid == nil || r.Valid(match) {
+			return match, true
+		}
+	}
+	return "", false
+}
+
+// placeholder reports whether value is an example rather than a real password.
+func placeholder(value string) bool {
+	if len(value) < 6 {
+		return true
+	}
+
+	lower := strings.ToLower(value)
+	if strings.HasPrefix(value, "$") || strings.HasPrefix(value, "<") || strings.HasPrefix(value, "{{") ||
+		strings.HasPrefix(lower, "your") || strings.HasPrefix(lower, "change") || strings.HasPrefix(lower, "example") {
+		return true
+	}
+
+	for _, word := range []string{"password", "secret", "placeholder", "xxxx", "****", "redacted"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// highEntropy reports whether s looks randomly generated. Hex strings such as commit hashes
+// stay below the threshold since they only use 16 symbols.
+func highEntropy(s string) bool {
+	var upper, lower, digit bool
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	return entropy(s) >= 4.5
+}
+
+// entropy is the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+
+	var e float64
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+func redact(match string) string {
+	if len(match) <= 8 {
+		return strings.Repeat("*", len(match))
+	}
+	return match[:4] + strings.Repeat("*", 8)
+}
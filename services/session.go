@@ -0,0 +1,433 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"snipnet/types"
+)
+
+const (
+	DefaultSessionIdleTimeout     = time.Hour * 24
+	DefaultSessionAbsoluteTimeout = time.Hour * 24 * 7
+)
+
+// lastSeenInterval limits how often a session's last-seen time is written back to redis.
+const lastSeenInterval = time.Minute
+
+// StreamTicketTTL is how long a stream ticket can be redeemed for.
+const StreamTicketTTL = 30 * time.Second
+
+var (
+	ErrSessionExpired      = errors.New("Session has expired")
+	ErrRefreshTokenInvalid = errors.New("Refresh token is invalid or has expired")
+	ErrRefreshTokenReused  = errors.New("Refresh token has already been used")
+	ErrTicketInvalid       = errors.New("Ticket is invalid or has expired")
+)
+
+type SessionStore interface {
+	CreateSession(user_id, user_agent, ip string) (*types.Session, error)
+	RefreshSession(refresh_token, user_agent, ip string) (*types.Session, error)
+	GetSession(session_id string) (*types.Session, error)
+	TouchSession(session *types.Session) error
+	GetUserSessions(user_id string) (*[]*types.Session, error)
+	DeleteSession(user_id, id string) error
+	DeleteUserSessions(user_id, except string) error
+	CreateTicket(session *types.Session) (*types.StreamTicket, error)
+	RedeemTicket(ticket string) (*types.Session, error)
+}
+
+// Sessions keeps each session under session:<session_id> and indexes them per user
+// in the user_sessions:<user_id> hash, which maps the public session id to the secret one.
+//
+// Every sign-in starts a family of sessions that share the same absolute expiry. Refresh
+// tokens are single use, each one is swapped for a new session and refresh token in the
+// same family. Replaying a spent refresh token revokes the whole family.
+type Sessions struct {
+	cache    *redis.Client
+	idle     time.Duration
+	absolute time.Duration
+}
+
+// ticketRecord is what a stream ticket stands for. Scopes is nil for browser sessions, like
+// on types.Session.
+type ticketRecord struct {
+	UserID    string   `json:"user_id"`
+	ID        string   `json:"id"`
+	SessionID string   `json:"session_id"`
+	Scopes    []string `json:"scopes"`
+}
+
+type refreshRecord struct {
+	UserID     string    `json:"user_id"`
+	SessionID  string    `json:"session_id"`
+	FamilyID   string    `json:"family_id"`
+	ExpiryTime time.Time `json:"expiry_time"`
+}
+
+func NewSessions(rds *redis.Client, idle, absolute time.Duration) *Sessions {
+	if idle <= 0 {
+		idle = DefaultSessionIdleTimeout
+	}
+	if absolute <= 0 {
+		absolute = DefaultSessionAbsoluteTimeout
+	}
+	return &Sessions{
+		cache:    rds,
+		idle:     idle,
+		absolute: absolute,
+	}
+}
+
+func sessionKey(session_id string) string {
+	return "session:" + session_id
+}
+
+func userSessionsKey(user_id string) string {
+	return "user_sessions:" + user_id
+}
+
+func refreshKey(hash string) string {
+	return "refresh:" + hash
+}
+
+func refreshUsedKey(hash string) string {
+	return "refresh_used:" + hash
+}
+
+func familyKey(family_id string) string {
+	return "session_family:" + family_id
+}
+
+func ticketKey(hash string) string {
+	return "stream_ticket:" + hash
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ttl is how long the session should live from now, whichever of the idle or
+// absolute timeout comes first.
+func (s *Sessions) ttl(session *types.Session) time.Duration {
+	remaining := time.Until(session.ExpiryTime)
+	if remaining < s.idle {
+		return remaining
+	}
+	return s.idle
+}
+
+func (s *Sessions) CreateSession(user_id, user_agent, ip string) (*types.Session, error) {
+	return s.newSession(user_id, user_agent, ip, uuid.NewString(), time.Now().Add(s.absolute))
+}
+
+func (s *Sessions) newSession(user_id, user_agent, ip, family_id string, expiry time.Time) (*types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	session := types.Session{
+		ID:           uuid.NewString(),
+		UserID:       user_id,
+		SessionID:    uuid.NewString(),
+		FamilyID:     family_id,
+		UserAgent:    user_agent,
+		IP:           ip,
+		CreatedAt:    now,
+		LastSeen:     now,
+		ExpiryTime:   expiry,
+		RefreshToken: uuid.NewString(),
+	}
+
+	val, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := json.Marshal(refreshRecord{
+		UserID:     user_id,
+		SessionID:  session.ID,
+		FamilyID:   family_id,
+		ExpiryTime: expiry,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashRefreshToken(session.RefreshToken)
+	lifetime := time.Until(expiry)
+	_, err = s.cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(session.SessionID), val, s.ttl(&session))
+		pipe.HSet(ctx, userSessionsKey(user_id), session.ID, session.SessionID)
+		pipe.Expire(ctx, userSessionsKey(user_id), s.absolute)
+		pipe.Set(ctx, refreshKey(hash), refresh, lifetime)
+		pipe.SAdd(ctx, familyKey(family_id), hash)
+		pipe.Expire(ctx, familyKey(family_id), lifetime)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (s *Sessions) RefreshSession(refresh_token, user_agent, ip string) (*types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hash := hashRefreshToken(refresh_token)
+	val, err := s.cache.Get(ctx, refreshKey(hash)).Result()
+	if err == redis.Nil {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var record refreshRecord
+	if err = json.Unmarshal([]byte(val), &record); err != nil {
+		return nil, err
+	}
+
+	// the spent marker outlives the rotation so a replayed token can still be detected
+	fresh, err := s.cache.SetNX(ctx, refreshUsedKey(hash), 1, time.Until(record.ExpiryTime)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		if err = s.revokeFamily(ctx, record.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	err = s.deleteSession(ctx, record.UserID, record.SessionID)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	return s.newSession(record.UserID, user_agent, ip, record.FamilyID, record.ExpiryTime)
+}
+
+func (s *Sessions) GetSession(session_id string) (*types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	val, err := s.cache.Get(ctx, sessionKey(session_id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var session types.Session
+	if err = json.Unmarshal([]byte(val), &session); err != nil {
+		return nil, err
+	}
+	session.SessionID = session_id
+
+	return &session, nil
+}
+
+// TouchSession slides the idle timeout forward, it never extends a session past its absolute expiry.
+func (s *Sessions) TouchSession(session *types.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	ttl := s.ttl(session)
+	if ttl <= 0 {
+		s.deleteSession(ctx, session.UserID, session.ID)
+		return ErrSessionExpired
+	}
+
+	if time.Since(session.LastSeen) < lastSeenInterval {
+		return s.cache.Expire(ctx, sessionKey(session.SessionID), ttl).Err()
+	}
+
+	session.LastSeen = time.Now()
+	val, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return s.cache.SetArgs(ctx, sessionKey(session.SessionID), val, redis.SetArgs{TTL: ttl, Mode: "XX"}).Err()
+}
+
+func (s *Sessions) GetUserSessions(user_id string) (*[]*types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	sessions := []*types.Session{}
+
+	index, err := s.cache.HGetAll(ctx, userSessionsKey(user_id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for id, session_id := range index {
+		session, err := s.GetSession(session_id)
+		if err == redis.Nil {
+			// the session expired on its own, drop it from the index
+			s.cache.HDel(ctx, userSessionsKey(user_id), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return &sessions, nil
+}
+
+// DeleteSession signs a session out and revokes the refresh tokens issued alongside it.
+func (s *Sessions) DeleteSession(user_id, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	session_id, err := s.cache.HGet(ctx, userSessionsKey(user_id), id).Result()
+	if err != nil {
+		return err
+	}
+
+	session, err := s.GetSession(session_id)
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if session != nil && session.FamilyID != "" {
+		return s.revokeFamily(ctx, session.FamilyID)
+	}
+
+	return s.deleteSession(ctx, user_id, id)
+}
+
+func (s *Sessions) DeleteUserSessions(user_id, except string) error {
+	index, err := s.cache.HGetAll(context.Background(), userSessionsKey(user_id)).Result()
+	if err != nil {
+		return err
+	}
+
+	for id := range index {
+		if id == except {
+			continue
+		}
+		err = s.DeleteSession(user_id, id)
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sessions) deleteSession(ctx context.Context, user_id, id string) error {
+	session_id, err := s.cache.HGet(ctx, userSessionsKey(user_id), id).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(session_id))
+		pipe.HDel(ctx, userSessionsKey(user_id), id)
+		return nil
+	})
+	return err
+}
+
+// revokeFamily deletes every session and refresh token descended from the same sign-in.
+func (s *Sessions) revokeFamily(ctx context.Context, family_id string) error {
+	hashes, err := s.cache.SMembers(ctx, familyKey(family_id)).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		val, err := s.cache.Get(ctx, refreshKey(hash)).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var record refreshRecord
+		if err = json.Unmarshal([]byte(val), &record); err != nil {
+			return err
+		}
+
+		err = s.deleteSession(ctx, record.UserID, record.SessionID)
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		// keep the spent marker so later replays are still rejected
+		if err = s.cache.Del(ctx, refreshKey(hash)).Err(); err != nil {
+			return err
+		}
+	}
+
+	return s.cache.Del(ctx, familyKey(family_id)).Err()
+}
+
+// CreateTicket issues a single use ticket standing for session, for the WebSocket and event
+// stream routes browsers can't send an Authorization header to. Only its hash is kept.
+func (s *Sessions) CreateTicket(session *types.Session) (*types.StreamTicket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	val, err := json.Marshal(ticketRecord{
+		UserID:    session.UserID,
+		ID:        session.ID,
+		SessionID: session.SessionID,
+		Scopes:    session.Scopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ticket := uuid.NewString()
+	if err = s.cache.Set(ctx, ticketKey(hashRefreshToken(ticket)), val, StreamTicketTTL).Err(); err != nil {
+		return nil, err
+	}
+	return &types.StreamTicket{Ticket: ticket, ExpiresAt: time.Now().Add(StreamTicketTTL)}, nil
+}
+
+// RedeemTicket uses up a ticket and returns the session it stands for, ErrTicketInvalid is
+// returned for unknown, spent and expired tickets and for browser sessions signed out since.
+func (s *Sessions) RedeemTicket(ticket string) (*types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	val, err := s.cache.GetDel(ctx, ticketKey(hashRefreshToken(ticket))).Result()
+	if err == redis.Nil {
+		return nil, ErrTicketInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var record ticketRecord
+	if err = json.Unmarshal([]byte(val), &record); err != nil {
+		return nil, err
+	}
+
+	if record.Scopes != nil {
+		return &types.Session{
+			UserID:    record.UserID,
+			ID:        record.ID,
+			SessionID: record.SessionID,
+			Scopes:    record.Scopes,
+		}, nil
+	}
+
+	session, err := s.GetSession(record.SessionID)
+	if err == redis.Nil {
+		return nil, ErrTicketInvalid
+	}
+	return session, err
+}
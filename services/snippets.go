@@ -2,274 +2,420 @@ package services
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
+	"snipnet/events"
+	"snipnet/services/spam"
 	"snipnet/types"
 )
 
 type SnippetStore interface {
 	GetSnippet(id string) (*types.SnippetWithUser, error)
 	CreateSnippet(snippet *Snippet) (*Snippet, error)
-	DeleteSnippet(id string) error
-	UpdateSnippetMulti(snippet *Snippet) (*Snippet, error)
-	UpdateSnippetSingle(id, field, value string) (*Snippet, error)
-	GetSnippetsUser(user_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error)
-	GetSnippets(offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error)
+	DeleteSnippet(id, actor_id string, version int) error
+	UpdateSnippetMulti(snippet *Snippet, actor_id string) (*Snippet, error)
+	GetSnippetsByID(ids []string) (map[string]*types.SnippetWithUser, error)
+	ApplyBatch(ops []BatchOp, actor_id string, atomic bool) []BatchResult
+	GetSnippetsUser(user_id, viewer_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error)
+	GetSnippets(viewer_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error)
+	GetOrgSnippets(org_id, viewer_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error)
 }
 
 type Snippet struct {
-	ID          string    `json:"id"`
-	UserID      string    `json:"user_id"`
-	Title       string    `json:"title" validate:"required"`
-	Description string    `json:"description" validate:"required"`
-	Language    string    `json:"language" validate:"required"`
-	Code        string    `json:"code" validate:"required"`
-	IsPublic    string    `json:"is_public" validate:"boolean"`
+	ID          string  `json:"id"`
+	UserID      string  `json:"user_id"`
+	OrgID       *string `json:"org_id"`
+	Title       string  `json:"title" validate:"required"`
+	Description string  `json:"description" validate:"required"`
+	Language    string  `json:"language" validate:"required"`
+	Code        string  `json:"code" validate:"required"`
+	IsPublic    string  `json:"is_public" validate:"boolean"`
+	// Quarantined snippets scored as spam and stay off the public feed until released.
+	Quarantined bool      `json:"quarantined"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	// Version goes up with every change. Updates with a Version only apply to that version
+	// of the snippet, ErrVersionMismatch is returned when it has changed since.
+	Version int `json:"version"`
+	// Spam is the spam check of the content being saved, set by the caller. It is stored
+	// along with the snippet, which is saved quarantined when it is public and the check
+	// calls for it.
+	Spam *spam.Result `json:"-"`
 }
 
-func (s *Snippet) GetSnippetsUser(user_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-	var snippets []*types.SnippetWithUser
+// quarantinedAt is when the snippet is quarantined by saving it at now, nil when it isn't.
+func (s *Snippet) quarantinedAt(now time.Time) *time.Time {
+	// the validator takes any boolean spelling, Postgres stores "1" or "TRUE" as public too
+	public, _ := strconv.ParseBool(s.IsPublic)
+	if s.Spam == nil || !s.Spam.Quarantine || !public {
+		return nil
+	}
+	return &now
+}
 
-	query := `
-		SELECT snippets.id, snippets.user_id, snippets.title, snippets.description,
-			snippets.language, snippets.code, snippets.is_public, users.username, users.email, users.avatar,
-			snippets.created_at, snippets.updated_at
-		FROM snippets
-		INNER JOIN users ON snippets.user_id = users.id
-		WHERE snippets.user_id = $1
-			AND ($2 = '' OR document @@ to_tsquery($2))
-			AND ($3 = '' OR snippets.language = $3)
-			AND snippets.is_public
-    ORDER BY snippets.updated_at DESC
-		LIMIT $4
-		OFFSET $5;
+// saveSpam stores the spam check of a snippet that has just been saved as part of tx.
+func saveSpam(ctx context.Context, tx *sql.Tx, snippet *Snippet) error {
+	if snippet.Spam == nil {
+		return nil
+	}
+	return saveSpamScore(ctx, tx, snippet.ID, snippet.Spam)
+}
+
+// ErrVersionMismatch is returned by conditional updates of a snippet that has changed.
+var ErrVersionMismatch = errors.New("Snippet has been changed since")
+
+// snippetWithUserColumns is scanned by scanSnippetWithUser. A snippet that isn't public, or is
+// quarantined as spam, but is owned by an org is visible to the org's members, otherwise only
+// to its author.
+const snippetWithUserColumns = `
+	snippets.id, snippets.user_id, snippets.org_id, snippets.title, snippets.description,
+	snippets.language, snippets.code, snippets.is_public,
+	CASE
+		WHEN snippets.is_public AND snippets.quarantined_at IS NULL THEN 'public'
+		WHEN snippets.org_id IS NOT NULL THEN 'org'
+		ELSE 'private'
+	END,
+	snippets.hidden_at IS NOT NULL, snippets.quarantined_at IS NOT NULL, users.username, users.email, users.avatar, snippets.created_at, snippets.updated_at,
+	snippets.version
+`
+
+// snippetColumns is scanned by scanSnippet.
+const snippetColumns = `
+	id, user_id, org_id, title, description, language, code, is_public, quarantined_at IS NOT NULL,
+	created_at, updated_at, version
 `
-	row, err := db.QueryContext(ctx, query, user_id, param, lang, limit, offset)
+
+func scanSnippetWithUser(row scanner) (*types.SnippetWithUser, error) {
+	var snippet types.SnippetWithUser
+	err := row.Scan(
+		&snippet.ID,
+		&snippet.UserID,
+		&snippet.OrgID,
+		&snippet.Title,
+		&snippet.Description,
+		&snippet.Language,
+		&snippet.Code,
+		&snippet.IsPublic,
+		&snippet.Visibility,
+		&snippet.Hidden,
+		&snippet.Quarantined,
+		&snippet.Username,
+		&snippet.Email,
+		&snippet.Avatar,
+		&snippet.CreatedAt,
+		&snippet.UpdatedAt,
+		&snippet.Version,
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	return &snippet, nil
+}
+
+func scanSnippet(row scanner) (*Snippet, error) {
+	var snip Snippet
+	err := row.Scan(
+		&snip.ID,
+		&snip.UserID,
+		&snip.OrgID,
+		&snip.Title,
+		&snip.Description,
+		&snip.Language,
+		&snip.Code,
+		&snip.IsPublic,
+		&snip.Quarantined,
+		&snip.CreatedAt,
+		&snip.UpdatedAt,
+		&snip.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snip, nil
+}
+
+func querySnippets(ctx context.Context, query string, args ...any) (*[]*types.SnippetWithUser, error) {
+	var snippets []*types.SnippetWithUser
+
+	row, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
 	for row.Next() {
-		var snippet types.SnippetWithUser
-
-		err := row.Scan(
-			&snippet.ID,
-			&snippet.UserID,
-			&snippet.Title,
-			&snippet.Description,
-			&snippet.Language,
-			&snippet.Code,
-			&snippet.IsPublic,
-			&snippet.Username,
-			&snippet.Email,
-			&snippet.Avatar,
-			&snippet.CreatedAt,
-			&snippet.UpdatedAt,
-		)
+		snippet, err := scanSnippetWithUser(row)
 		if err != nil {
 			return nil, err
 		}
 
-		snippets = append(snippets, &snippet)
+		snippets = append(snippets, snippet)
 	}
 
 	return &snippets, nil
 }
 
-func (s *Snippet) GetSnippets(offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error) {
+// GetSnippetsUser lists a user's snippets that viewer_id is allowed to see, an empty
+// viewer_id only sees public snippets. Hidden snippets are only listed for their author.
+func (s *Snippet) GetSnippetsUser(user_id, viewer_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
-	var snippets []*types.SnippetWithUser
 
-	query := `
-		SELECT snippets.id, snippets.user_id, snippets.title, snippets.description,
-			snippets.language, snippets.code, snippets.is_public, users.username, users.email, users.avatar,
-			snippets.created_at, snippets.updated_at
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM snippets
+		INNER JOIN users ON snippets.user_id = users.id
+		WHERE snippets.user_id = $1
+			AND ($2 = '' OR document @@ to_tsquery($2))
+			AND ($3 = '' OR snippets.language = $3)
+			AND (snippets.hidden_at IS NULL OR snippets.user_id = $6)
+			AND (
+				(snippets.is_public AND snippets.quarantined_at IS NULL)
+				OR snippets.user_id = $6
+				OR snippets.org_id IN (SELECT org_id FROM org_members WHERE user_id = $6)
+				OR snippets.id IN (SELECT snippet_id FROM snippet_collaborators WHERE user_id = $6)
+			)
+		ORDER BY snippets.updated_at DESC
+		LIMIT $4
+		OFFSET $5;
+	`, snippetWithUserColumns)
+	return querySnippets(ctx, query, user_id, param, lang, limit, offset, viewer_id)
+}
+
+// GetSnippets lists public snippets along with the org snippets viewer_id can see.
+func (s *Snippet) GetSnippets(viewer_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM snippets
 		INNER JOIN users ON snippets.user_id = users.id
 		WHERE ($1 = '' OR document @@ to_tsquery($1))
 			AND ($2 = '' OR snippets.language = $2)
-			AND snippets.is_public
+			AND snippets.hidden_at IS NULL
+			AND (
+				(snippets.is_public AND snippets.quarantined_at IS NULL)
+				OR snippets.org_id IN (SELECT org_id FROM org_members WHERE user_id = $5)
+			)
 		ORDER BY snippets.updated_at DESC
 		LIMIT $3
 		OFFSET $4;
-	`
-	row, err := db.QueryContext(ctx, query, param, lang, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-
-	for row.Next() {
-		var snippet types.SnippetWithUser
-
-		err := row.Scan(
-			&snippet.ID,
-			&snippet.UserID,
-			&snippet.Title,
-			&snippet.Description,
-			&snippet.Language,
-			&snippet.Code,
-			&snippet.IsPublic,
-			&snippet.Username,
-			&snippet.Email,
-			&snippet.Avatar,
-			&snippet.CreatedAt,
-			&snippet.UpdatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
+	`, snippetWithUserColumns)
+	return querySnippets(ctx, query, param, lang, limit, offset, viewer_id)
+}
 
-		snippets = append(snippets, &snippet)
-	}
+// GetOrgSnippets lists the snippets owned by an org, non-members only see the public ones.
+func (s *Snippet) GetOrgSnippets(org_id, viewer_id string, offset, limit int, param, lang string) (*[]*types.SnippetWithUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
 
-	return &snippets, nil
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM snippets
+		INNER JOIN users ON snippets.user_id = users.id
+		WHERE snippets.org_id = $1
+			AND ($2 = '' OR document @@ to_tsquery($2))
+			AND ($3 = '' OR snippets.language = $3)
+			AND (snippets.hidden_at IS NULL OR snippets.user_id = $6)
+			AND (
+				(snippets.is_public AND snippets.quarantined_at IS NULL)
+				OR EXISTS (SELECT 1 FROM org_members WHERE org_id = $1 AND user_id = $6)
+			)
+		ORDER BY snippets.updated_at DESC
+		LIMIT $4
+		OFFSET $5;
+	`, snippetWithUserColumns)
+	return querySnippets(ctx, query, org_id, param, lang, limit, offset, viewer_id)
 }
 
 func (s *Snippet) GetSnippet(id string) (*types.SnippetWithUser, error) {
-	var snippet types.SnippetWithUser
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `
-		SELECT snippets.id, snippets.user_id, snippets.title, snippets.description,
-			snippets.language, snippets.code, snippets.is_public, users.username, users.email, users.avatar,
-			snippets.created_at, snippets.updated_at
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM snippets
 		INNER JOIN users ON snippets.user_id = users.id
 		WHERE snippets.id = $1;
-	`
-
-	row := db.QueryRowContext(ctx, query, id)
-
-	err := row.Scan(
-		&snippet.ID,
-		&snippet.UserID,
-		&snippet.Title,
-		&snippet.Description,
-		&snippet.Language,
-		&snippet.Code,
-		&snippet.IsPublic,
-		&snippet.Username,
-		&snippet.Email,
-		&snippet.Avatar,
-		&snippet.CreatedAt,
-		&snippet.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
+	`, snippetWithUserColumns)
 
-	return &snippet, nil
+	return scanSnippetWithUser(db.QueryRowContext(ctx, query, id))
 }
 
 func (s *Snippet) CreateSnippet(snippet *Snippet) (*Snippet, error) {
-	var snip Snippet
-
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `
-		INSERT INTO snippets (id, user_id, title, description, language ,code, is_public, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, user_id, title, description, language, code, is_public, created_at, updated_at;
-	`
-
-	row := db.QueryRowContext(ctx, query, snippet.ID, snippet.UserID,
-		snippet.Title, snippet.Description, snippet.Language, snippet.Code, snippet.IsPublic,
-		time.Now(), time.Now())
-	err := row.Scan(
-		&snip.ID,
-		&snip.UserID,
-		&snip.Title,
-		&snip.Description,
-		&snip.Language,
-		&snip.Code,
-		&snip.IsPublic,
-		&snip.CreatedAt,
-		&snip.UpdatedAt,
-	)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	return &snip, nil
+	created, err := insertSnippet(ctx, tx, snippet)
+	if err != nil {
+		return nil, err
+	}
+	if err = commitSnippets(tx); err != nil {
+		return nil, err
+	}
+	return created, nil
 }
 
-func (s *Snippet) DeleteSnippet(id string) error {
+// DeleteSnippet is a no-op when there is no snippet with that id. A version other than 0
+// only deletes that version of the snippet.
+func (s *Snippet) DeleteSnippet(id, actor_id string, version int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := "DELETE from snippets WHERE id =$1;"
-	_, err := db.ExecContext(ctx, query, id)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	err = deleteSnippet(ctx, tx, id, actor_id, version)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return commitSnippets(tx)
 }
 
-func (s *Snippet) UpdateSnippetSingle(id, field, value string) (*Snippet, error) {
+// UpdateSnippetMulti replaces the content of the snippet, only that version of it when
+// snippet.Version is set.
+func (s *Snippet) UpdateSnippetMulti(snippet *Snippet, actor_id string) (*Snippet, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	var snip Snippet
-	query := fmt.Sprintf(`
-		UPDATE snippets
-		SET %s = $1, updated_at = $2 WHERE id = $3
-		RETURNING id, user_id, title, description, language, code, is_public, created_at,
-			updated_at;
-		`, field)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	row := db.QueryRowContext(ctx, query, value, time.Now(), id)
-	err := row.Scan(
-		&snip.ID,
-		&snip.UserID,
-		&snip.Title,
-		&snip.Description,
-		&snip.Language,
-		&snip.Code,
-		&snip.IsPublic,
-		&snip.CreatedAt,
-		&snip.UpdatedAt,
-	)
+	updated, err := updateSnippet(ctx, tx, snippet, actor_id)
 	if err != nil {
 		return nil, err
 	}
+	if err = commitSnippets(tx); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
 
-	return &snip, nil
+// insertSnippet, deleteSnippet and updateSnippet make a change as part of tx, along with the
+// event about it in the outbox. Callers commit tx with commitSnippets.
+
+func insertSnippet(ctx context.Context, tx *sql.Tx, snippet *Snippet) (*Snippet, error) {
+	// the feed tells new snippets from updated ones by comparing both timestamps
+	now := time.Now()
+	query := fmt.Sprintf(`
+		INSERT INTO snippets (id, user_id, org_id, title, description, language ,code, is_public, created_at, updated_at,
+			quarantined_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9, $10)
+		RETURNING %s;
+	`, snippetColumns)
+
+	row := tx.QueryRowContext(ctx, query, snippet.ID, snippet.UserID, snippet.OrgID,
+		snippet.Title, snippet.Description, snippet.Language, snippet.Code, snippet.IsPublic, now,
+		snippet.quarantinedAt(now))
+	created, err := scanSnippet(row)
+	if err != nil {
+		return nil, err
+	}
+	if err = saveSpam(ctx, tx, snippet); err != nil {
+		return nil, err
+	}
+
+	if err = recordEvent(ctx, tx, snippetEvent(events.SnippetCreated, created, created.UserID)); err != nil {
+		return nil, err
+	}
+	return created, nil
 }
 
-func (s *Snippet) UpdateSnippetMulti(snippet *Snippet) (*Snippet, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// deleteSnippet returns sql.ErrNoRows when there is no snippet with that id.
+func deleteSnippet(ctx context.Context, tx *sql.Tx, id, actor_id string, version int) error {
+	// the snippet is gone by the time subscribers see the event, so it says who owned it
+	deleted := Snippet{ID: id}
+	query := "DELETE from snippets WHERE id =$1 AND ($2 = 0 OR version = $2) RETURNING user_id, org_id;"
+	err := tx.QueryRowContext(ctx, query, id, version).Scan(&deleted.UserID, &deleted.OrgID)
+	if err == sql.ErrNoRows {
+		return versionMismatch(ctx, tx, id)
+	}
+	if err != nil {
+		return err
+	}
 
-	var snip Snippet
-	query := `
+	return recordEvent(ctx, tx, snippetEvent(events.SnippetDeleted, &deleted, actor_id))
+}
+
+func updateSnippet(ctx context.Context, tx *sql.Tx, snippet *Snippet, actor_id string) (*Snippet, error) {
+	query := fmt.Sprintf(`
 		UPDATE snippets
-		SET title = $1, description = $2, language = $3, code = $4, updated_at = $5
-		WHERE id = $6
-		RETURNING id, user_id, title, description, code, is_public, created_at, updated_at;
-	`
-	row := db.QueryRowContext(ctx, query, snippet.Title, snippet.Description,
-		snippet.Language, snippet.Code, time.Now(), snippet.ID)
-	err := row.Scan(
-		&snip.ID,
-		&snip.UserID,
-		&snip.Title,
-		&snip.Description,
-		&snip.Language,
-		&snip.Code,
-		&snip.IsPublic,
-		&snip.CreatedAt,
-		&snip.UpdatedAt,
-	)
+		SET title = $1, description = $2, language = $3, code = $4, is_public = $5, updated_at = $6,
+			quarantined_at = COALESCE(quarantined_at, $9), version = version + 1
+		WHERE id = $7 AND ($8 = 0 OR version = $8)
+		RETURNING %s;
+	`, snippetColumns)
+	now := time.Now()
+	row := tx.QueryRowContext(ctx, query, snippet.Title, snippet.Description,
+		snippet.Language, snippet.Code, snippet.IsPublic, now, snippet.ID, snippet.Version,
+		snippet.quarantinedAt(now))
+	updated, err := scanSnippet(row)
+	if err == sql.ErrNoRows {
+		return nil, versionMismatch(ctx, tx, snippet.ID)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &snip, nil
+	if err = saveSpam(ctx, tx, snippet); err != nil {
+		return nil, err
+	}
+
+	if err = recordEvent(ctx, tx, snippetEvent(events.SnippetUpdated, updated, actor_id)); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// versionMismatch tells why a conditional change of a snippet matched no row: it is
+// ErrVersionMismatch when the snippet exists and sql.ErrNoRows when it doesn't.
+func versionMismatch(ctx context.Context, tx *sql.Tx, id string) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM snippets WHERE id = $1);", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return sql.ErrNoRows
+}
+
+// commitSnippets commits changes made along with their events in the outbox, so they are
+// stored together or not at all.
+func commitSnippets(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// snippetEvent is an event of type t about snippet, UserID is the snippet's owner.
+func snippetEvent(t string, snippet *Snippet, actor_id string) events.Event {
+	event := events.Event{Type: t, UserID: snippet.UserID, ActorID: actor_id, SnippetID: snippet.ID}
+	if snippet.OrgID != nil {
+		event.OrgID = *snippet.OrgID
+	}
+	return event
 }
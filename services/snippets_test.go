@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"snipnet/services/spam"
+)
+
+func TestQuarantinedAt(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		public     string
+		quarantine bool
+		want       bool
+	}{
+		{"true", true, true},
+		{"1", true, true},
+		{"TRUE", true, true},
+		{"t", true, true},
+		{"false", true, false},
+		{"0", true, false},
+		{"true", false, false},
+	}
+
+	for _, tt := range tests {
+		snippet := Snippet{IsPublic: tt.public, Spam: &spam.Result{Quarantine: tt.quarantine}}
+		if got := snippet.quarantinedAt(now) != nil; got != tt.want {
+			t.Errorf("is_public %q quarantine %v: expected quarantined %v, got %v", tt.public, tt.quarantine, tt.want, got)
+		}
+	}
+
+	if (&Snippet{IsPublic: "true"}).quarantinedAt(now) != nil {
+		t.Error("expected a snippet without a spam check not to be quarantined")
+	}
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+
+	"snipnet/services/spam"
+	"snipnet/types"
+)
+
+type SpamStore interface {
+	GetSpamInput(user_id, code string) (*spam.Input, error)
+	GetSpamScores(snippet_id string) (*[]*types.SpamScore, error)
+}
+
+type Spam struct{}
+
+// GetSpamInput gathers the account activity a snippet is scored on, the caller fills in
+// the snippet itself.
+func (s *Spam) GetSpamInput(user_id, code string) (*spam.Input, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var input spam.Input
+	var created_at time.Time
+	query := `
+		SELECT
+			(SELECT count(DISTINCT user_id) FROM snippets WHERE md5(code) = md5($2) AND user_id <> $1),
+			(SELECT count(*) FROM snippets WHERE user_id = $1 AND created_at > $3),
+			created_at
+		FROM users
+		WHERE id = $1;
+	`
+	row := db.QueryRowContext(ctx, query, user_id, code, time.Now().Add(-time.Hour))
+	if err := row.Scan(&input.DuplicateAccounts, &input.RecentPosts, &created_at); err != nil {
+		return nil, err
+	}
+
+	input.AccountAge = time.Since(created_at)
+	return &input, nil
+}
+
+// saveSpamScore stores the breakdown of the check of a snippet as part of tx, the snippet
+// itself is quarantined by the statement saving it.
+func saveSpamScore(ctx context.Context, tx *sql.Tx, snippet_id string, result *spam.Result) error {
+	signals, err := json.Marshal(result.Signals)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO spam_scores (id, snippet_id, score, signals, quarantined, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`
+	_, err = tx.ExecContext(ctx, query, uuid.NewString(), snippet_id, result.Score, signals,
+		result.Quarantine, time.Now())
+	return err
+}
+
+func (s *Spam) GetSpamScores(snippet_id string) (*[]*types.SpamScore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	scores := []*types.SpamScore{}
+
+	query := `
+		SELECT id, snippet_id, score, signals, quarantined, created_at
+		FROM spam_scores
+		WHERE snippet_id = $1
+		ORDER BY created_at DESC;
+	`
+	row, err := db.QueryContext(ctx, query, snippet_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var score types.SpamScore
+		err = row.Scan(
+			&score.ID,
+			&score.SnippetID,
+			&score.Score,
+			&score.Signals,
+			&score.Quarantined,
+			&score.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, &score)
+	}
+
+	return &scores, nil
+}
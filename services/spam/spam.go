@@ -0,0 +1,154 @@
+// Package spam scores snippets for spam so the worst of it can be quarantined before it
+// reaches the public feed. Scoring is pure, the caller gathers the account activity.
+package spam
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config holds the rules, a snippet is quarantined once the weights of the signals it
+// trips add up to Threshold.
+type Config struct {
+	Threshold float64 `json:"threshold"`
+
+	// link_density trips when there are at least MinLinks links and more than
+	// MaxLinksPerLine links per line of text.
+	MinLinks        int     `json:"min_links"`
+	MaxLinksPerLine float64 `json:"max_links_per_line"`
+	LinkWeight      float64 `json:"link_weight"`
+
+	// duplicate_content adds DuplicateWeight for every other account that posted the same
+	// code, up to MaxDuplicates accounts.
+	DuplicateWeight float64 `json:"duplicate_weight"`
+	MaxDuplicates   int     `json:"max_duplicates"`
+
+	// new_account_velocity trips when an account younger than NewAccountAge has posted
+	// VelocityLimit snippets within the last hour.
+	NewAccountAge  Duration `json:"new_account_age"`
+	VelocityLimit  int      `json:"velocity_limit"`
+	VelocityWeight float64  `json:"velocity_weight"`
+
+	// banned_phrase adds PhraseWeight for every phrase found, matching is case insensitive.
+	BannedPhrases []string `json:"banned_phrases"`
+	PhraseWeight  float64  `json:"phrase_weight"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Threshold:       1,
+		MinLinks:        3,
+		MaxLinksPerLine: 0.3,
+		LinkWeight:      0.5,
+		DuplicateWeight: 0.35,
+		MaxDuplicates:   3,
+		NewAccountAge:   Duration(72 * time.Hour),
+		VelocityLimit:   5,
+		VelocityWeight:  0.5,
+		BannedPhrases:   []string{"buy followers", "casino bonus", "free crypto", "work from home and earn"},
+		PhraseWeight:    0.5,
+	}
+}
+
+// LoadConfig reads the rules from a JSON file, anything the file leaves out keeps its default.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return DefaultConfig(), fmt.Errorf("invalid spam rules in %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Duration reads durations such as "72h" from JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Input is what a snippet is scored on.
+type Input struct {
+	Title       string
+	Description string
+	Code        string
+	// DuplicateAccounts is the number of other accounts that posted the exact same code.
+	DuplicateAccounts int
+	// AccountAge is how long ago the author signed up.
+	AccountAge time.Duration
+	// RecentPosts is the number of snippets the author posted within the last hour.
+	RecentPosts int
+}
+
+// Signal is one rule that contributed to a score.
+type Signal struct {
+	Name   string  `json:"name"`
+	Score  float64 `json:"score"`
+	Detail string  `json:"detail"`
+}
+
+type Result struct {
+	Score      float64  `json:"score"`
+	Signals    []Signal `json:"signals"`
+	Quarantine bool     `json:"quarantine"`
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)[^\s"'<>]+`)
+
+func Score(cfg Config, in Input) Result {
+	res := Result{Signals: []Signal{}}
+	add := func(name string, score float64, detail string) {
+		res.Signals = append(res.Signals, Signal{Name: name, Score: score, Detail: detail})
+		res.Score += score
+	}
+
+	text := strings.Join([]string{in.Title, in.Description, in.Code}, "\n")
+
+	links := len(linkPattern.FindAllString(text, -1))
+	lines := len(strings.Split(strings.TrimSpace(text), "\n"))
+	if density := float64(links) / float64(lines); links >= cfg.MinLinks && density > cfg.MaxLinksPerLine {
+		add("link_density", cfg.LinkWeight, fmt.Sprintf("%d links in %d lines", links, lines))
+	}
+
+	if in.DuplicateAccounts > 0 {
+		n := min(in.DuplicateAccounts, cfg.MaxDuplicates)
+		add("duplicate_content", cfg.DuplicateWeight*float64(n),
+			fmt.Sprintf("same code posted by %d other accounts", in.DuplicateAccounts))
+	}
+
+	if in.AccountAge < time.Duration(cfg.NewAccountAge) && in.RecentPosts >= cfg.VelocityLimit {
+		add("new_account_velocity", cfg.VelocityWeight,
+			fmt.Sprintf("%d snippets in the last hour from an account created %s ago", in.RecentPosts, in.AccountAge.Round(time.Minute)))
+	}
+
+	lower := strings.ToLower(text)
+	for _, phrase := range cfg.BannedPhrases {
+		if phrase != "" && strings.Contains(lower, strings.ToLower(phrase)) {
+			add("banned_phrase", cfg.PhraseWeight, fmt.Sprintf("contains %q", phrase))
+		}
+	}
+
+	res.Quarantine = res.Score >= cfg.Threshold
+	return res
+}
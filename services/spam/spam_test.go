@@ -0,0 +1,90 @@
+package spam
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signalNames(res Result) []string {
+	names := []string{}
+	for _, s := range res.Signals {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestScoreOrdinarySnippet(t *testing.T) {
+	res := Score(DefaultConfig(), Input{
+		Title:       "Reverse a slice",
+		Description: "See https://go.dev/wiki/SliceTricks",
+		Code:        "for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {\n\ts[i], s[j] = s[j], s[i]\n}",
+		AccountAge:  time.Hour,
+		RecentPosts: 1,
+	})
+
+	if res.Quarantine || len(res.Signals) != 0 {
+		t.Errorf("expected a clean score, got %+v", res)
+	}
+}
+
+func TestScoreSignals(t *testing.T) {
+	cfg := DefaultConfig()
+	links := strings.Repeat("https://spam.example/offer\n", 5)
+
+	tests := []struct {
+		name       string
+		in         Input
+		signal     string
+		quarantine bool
+	}{
+		{"link density", Input{Code: links, AccountAge: 365 * 24 * time.Hour}, "link_density", false},
+		{"duplicates", Input{Code: "x", DuplicateAccounts: 5, AccountAge: 365 * 24 * time.Hour}, "duplicate_content", true},
+		{"velocity", Input{Code: "x", AccountAge: time.Hour, RecentPosts: 6}, "new_account_velocity", false},
+		{"velocity from an old account", Input{Code: "x", AccountAge: 30 * 24 * time.Hour, RecentPosts: 50}, "", false},
+		{"banned phrase", Input{Title: "FREE CRYPTO today", AccountAge: 365 * 24 * time.Hour}, "banned_phrase", false},
+		{"combined", Input{Title: "Casino bonus", Code: links, AccountAge: time.Hour, RecentPosts: 10}, "link_density", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Score(cfg, tt.in)
+			names := signalNames(res)
+			if tt.signal == "" && len(names) != 0 {
+				t.Errorf("expected no signals, got %v", names)
+			}
+			if tt.signal != "" && (len(names) == 0 || names[0] != tt.signal) {
+				t.Errorf("expected %s first, got %v", tt.signal, names)
+			}
+			if res.Quarantine != tt.quarantine {
+				t.Errorf("expected quarantine %v with score %v", tt.quarantine, res.Score)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spam.json")
+	rules := `{"threshold": 0.5, "banned_phrases": ["cheap watches"], "new_account_age": "24h"}`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Threshold != 0.5 || time.Duration(cfg.NewAccountAge) != 24*time.Hour {
+		t.Errorf("rules were not applied: %+v", cfg)
+	}
+	if cfg.LinkWeight != DefaultConfig().LinkWeight {
+		t.Errorf("missing rules should keep their default, got %v", cfg.LinkWeight)
+	}
+
+	res := Score(cfg, Input{Code: "Cheap Watches here", AccountAge: 365 * 24 * time.Hour})
+	if !res.Quarantine {
+		t.Errorf("expected the configured phrase to quarantine, got %+v", res)
+	}
+}
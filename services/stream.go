@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+
+	"snipnet/events"
+	"snipnet/types"
+)
+
+// StreamStore fans live updates out over Redis pub/sub so a client connected to any API
+// instance gets them.
+type StreamStore interface {
+	Publish(ctx context.Context, channel, event string, data any) error
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	SnippetChanged(ctx context.Context, event events.Event) error
+}
+
+type Stream struct {
+	cache *redis.Client
+}
+
+func NewStream(rds *redis.Client) *Stream {
+	return &Stream{cache: rds}
+}
+
+func UserChannel(user_id string) string {
+	return "stream:user:" + user_id
+}
+
+func SnippetChannel(snippet_id string) string {
+	return "stream:snippet:" + snippet_id
+}
+
+func (s *Stream) Publish(ctx context.Context, channel, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(types.StreamMessage{Event: event, Data: payload})
+	if err != nil {
+		return err
+	}
+	return s.cache.Publish(ctx, channel, msg).Err()
+}
+
+// Subscribe listens on channels until the returned subscription is closed.
+func (s *Stream) Subscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return s.cache.Subscribe(ctx, channels...)
+}
+
+// SnippetChanged is an events.Handler that tells the viewers of a snippet it changed.
+func (s *Stream) SnippetChanged(ctx context.Context, event events.Event) error {
+	if event.SnippetID == "" {
+		return nil
+	}
+	return s.Publish(ctx, SnippetChannel(event.SnippetID), event.Type, types.SnippetChange{
+		Type:      event.Type,
+		SnippetID: event.SnippetID,
+		ActorID:   event.ActorID,
+		At:        event.At,
+	})
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type TokenStore interface {
+	CreateToken(token *Token) (*Token, error)
+	GetTokens(user_id string) (*[]*Token, error)
+	GetTokenByHash(hash string) (*Token, error)
+	TouchToken(id string) error
+	DeleteToken(id, user_id string) error
+}
+
+type Token struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Secret is only populated when the token is first created, it is never stored.
+	Secret string `json:"token,omitempty"`
+}
+
+func (t *Token) CreateToken(token *Token) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO tokens (id, user_id, name, token_hash, scopes, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at;
+	`
+
+	row := db.QueryRowContext(ctx, query, token.ID, token.UserID, token.Name, token.Hash,
+		pq.Array(token.Scopes), token.ExpiresAt, time.Now())
+	return scanToken(row)
+}
+
+func (t *Token) GetTokens(user_id string) (*[]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	tokens := []*Token{}
+
+	query := `
+		SELECT id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at
+		FROM tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC;
+	`
+	row, err := db.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		token, err := scanToken(row)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return &tokens, nil
+}
+
+func (t *Token) GetTokenByHash(hash string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at
+		FROM tokens
+		WHERE token_hash = $1;
+	`
+	return scanToken(db.QueryRowContext(ctx, query, hash))
+}
+
+func (t *Token) TouchToken(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "UPDATE tokens SET last_used_at = $1 WHERE id = $2;", time.Now(), id)
+	return err
+}
+
+func (t *Token) DeleteToken(id, user_id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return execOne(ctx, "DELETE FROM tokens WHERE id = $1 AND user_id = $2;", id, user_id)
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var token Token
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Hash,
+		pq.Array(&token.Scopes),
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
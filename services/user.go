@@ -2,127 +2,439 @@ package services
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"snipnet/events"
 	"snipnet/types"
 )
 
 type UserStore interface {
-	GetUsers() (*[]*User, error)
+	GetUsers(offset, limit int) (*[]*User, error)
 	GetUser(field, value string) (*User, error)
 	CheckUser(username, email string) (*User, error)
-	CreateUser(id string, oauthUser *types.GHUser) (*User, error)
+	CreateUser(id string, identity *types.Identity) (*User, error)
+	GetUserByIdentity(provider, subject string) (*User, error)
+	GetIdentities(user_id string) (*[]*types.Identity, error)
+	LinkIdentity(user_id string, identity *types.Identity) (*types.Identity, error)
+	DeleteIdentity(id, user_id string) error
+	UpdateUserRole(id, role string) (*User, error)
+	SetUserSuspended(id string, suspended bool) (*User, error)
+	UpdateProfile(id string, body *types.UpdateProfileBody) (*User, error)
+	GetProfile(username string) (*types.Profile, error)
+	GetUsernameRedirect(old_username string) (string, error)
 }
 
+var (
+	// ErrEmailTaken is returned when creating a user with the email of another account.
+	ErrEmailTaken = errors.New("Email belongs to another account")
+	// ErrUsernameTaken is returned when creating a user with the username of another account.
+	ErrUsernameTaken = errors.New("Username is taken")
+)
+
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username" validate:"required"`
-	Email     string    `json:"email" validate:"required,email"`
-	Avatar    string    `json:"avatar"`
-	AuthToken string    `json:"auth_token"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID          string `json:"id"`
+	Username    string `json:"username" validate:"required"`
+	Email       string `json:"email" validate:"required,email"`
+	Avatar      string `json:"avatar"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	Website     string `json:"website"`
+	// AvatarOverride replaces Avatar, which comes from the identity provider, when set.
+	AvatarOverride string     `json:"avatar_override"`
+	Role           string     `json:"role"`
+	SuspendedAt    *time.Time `json:"suspended_at"`
+	AuthToken      string     `json:"auth_token,omitempty"`
+	RefreshToken   string     `json:"refresh_token,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
 }
 
 func (u *User) GetUser(field, value string) (*User, error) {
-	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := fmt.Sprintf("SELECT id, username, email, avatar, created_at, updated_at FROM users WHERE %s = $1;", field)
+	query := fmt.Sprintf("SELECT %s FROM users WHERE %s = $1;", userColumns, field)
+	return scanUser(db.QueryRowContext(ctx, query, value))
+}
 
-	row := db.QueryRowContext(ctx, query, value)
-	err := row.Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Avatar,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+func (u *User) CheckUser(username, email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "SELECT " + userColumns + " FROM users WHERE username = $1 OR email = $2;"
+	return scanUser(db.QueryRowContext(ctx, query, username, email))
+}
+
+// CreateUser creates the user together with the identity they signed up with.
+func (u *User) CreateUser(id string, identity *types.Identity) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	return &user, nil
+	query := `
+		INSERT INTO users (id, username, avatar, email, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING ` + userColumns + `;
+	`
+
+	row := tx.QueryRowContext(ctx, query, id, identity.Username, identity.Avatar, identity.Email, time.Now(), time.Now())
+	saveduser, err := scanUser(row)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		switch pqErr.Constraint {
+		case "users_email_key":
+			return nil, ErrEmailTaken
+		case "users_username_key":
+			return nil, ErrUsernameTaken
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the username is taken now, it can no longer send visitors to whoever used to own it
+	_, err = tx.ExecContext(ctx, "DELETE FROM username_redirects WHERE old_username = $1;", saveduser.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = insertIdentity(ctx, tx, id, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = commitUserEvent(ctx, tx, events.UserCreated, id); err != nil {
+		return nil, err
+	}
+
+	return saveduser, nil
 }
 
-func (u *User) CheckUser(username, email string) (*User, error) {
-	var user User
+func (u *User) GetUserByIdentity(provider, subject string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := "SELECT id, username, email, avatar created_at, updated_at FROM users WHERE username = $1 OR email = $2;"
+	query := `
+		SELECT ` + prefixedUserColumns + `
+		FROM users
+		INNER JOIN identities ON identities.user_id = users.id
+		WHERE identities.provider = $1 AND identities.subject = $2;
+	`
+	return scanUser(db.QueryRowContext(ctx, query, provider, subject))
+}
 
-	row := db.QueryRowContext(ctx, query, username, email)
-	err := row.Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Avatar,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+func (u *User) GetIdentities(user_id string) (*[]*types.Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	identities := []*types.Identity{}
+
+	query := `
+		SELECT id, user_id, provider, subject, username, email, created_at
+		FROM identities
+		WHERE user_id = $1
+		ORDER BY created_at;
+	`
+	row, err := db.QueryContext(ctx, query, user_id)
 	if err != nil {
 		return nil, err
 	}
+	defer row.Close()
 
-	return &user, nil
+	for row.Next() {
+		var identity types.Identity
+		err = row.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Subject,
+			&identity.Username,
+			&identity.Email,
+			&identity.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+
+	return &identities, nil
 }
 
-func (u *User) CreateUser(id string, oauthUser *types.GHUser) (*User, error) {
+func (u *User) LinkIdentity(user_id string, identity *types.Identity) (*types.Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return insertIdentity(ctx, db, user_id, identity)
+}
+
+// DeleteIdentity unlinks an identity, a user's last identity can't be removed since they
+// would have no way left to sign in.
+func (u *User) DeleteIdentity(id, user_id string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
-	var saveduser User
 
 	query := `
-		INSERT INTO users (id, username, oauth_id, avatar, email, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, avatar, username, email, created_at, updated_at;
+		DELETE FROM identities
+		WHERE id = $1 AND user_id = $2
+			AND (SELECT count(*) FROM identities WHERE user_id = $2) > 1;
 	`
+	return execOne(ctx, query, id, user_id)
+}
 
-	row := db.QueryRowContext(ctx, query, id, oauthUser.Name, string(oauthUser.ID), oauthUser.AvatarURL, oauthUser.Email, time.Now(), time.Now())
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertIdentity(ctx context.Context, q querier, user_id string, identity *types.Identity) (*types.Identity, error) {
+	var saved types.Identity
+
+	query := `
+		INSERT INTO identities (id, user_id, provider, subject, username, email, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, user_id, provider, subject, username, email, created_at;
+	`
+	row := q.QueryRowContext(ctx, query, uuid.NewString(), user_id, identity.Provider,
+		identity.Subject, identity.Username, identity.Email, time.Now())
 	err := row.Scan(
-		&saveduser.ID,
-		&saveduser.Avatar,
-		&saveduser.Username,
-		&saveduser.Email,
-		&saveduser.CreatedAt,
-		&saveduser.UpdatedAt,
+		&saved.ID,
+		&saved.UserID,
+		&saved.Provider,
+		&saved.Subject,
+		&saved.Username,
+		&saved.Email,
+		&saved.CreatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &saveduser, nil
+	return &saved, nil
 }
 
-func (u *User) GetUsers() (*[]*User, error) {
+func (u *User) GetUsers(offset, limit int) (*[]*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
-	var users []*User
+	users := []*User{}
 
-	query := "SELECT id, username, email, avatar, created_at, updated_at FROM users;"
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		ORDER BY created_at DESC
+		LIMIT $1
+		OFFSET $2;
+	`
 
-	row, err := db.QueryContext(ctx, query)
+	row, err := db.QueryContext(ctx, query, limit, offset)
 	if err != nil {
 		return nil, err
 	}
+	defer row.Close()
 
 	for row.Next() {
-		var user User
-		err = row.Scan(
-			&user.ID,
-			&user.Username,
-			&user.Email,
-			&user.Avatar,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		)
+		user, err := scanUser(row)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, &user)
+		users = append(users, user)
 	}
 	return &users, nil
 }
+
+func (u *User) UpdateUserRole(id, role string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE users SET role = $1, updated_at = $2 WHERE id = $3
+		RETURNING ` + userColumns + `;
+	`
+	return scanUser(db.QueryRowContext(ctx, query, role, time.Now(), id))
+}
+
+func (u *User) SetUserSuspended(id string, suspended bool) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var suspendedAt *time.Time
+	if suspended {
+		now := time.Now()
+		suspendedAt = &now
+	}
+
+	query := `
+		UPDATE users SET suspended_at = $1, updated_at = $2 WHERE id = $3
+		RETURNING ` + userColumns + `;
+	`
+	return scanUser(db.QueryRowContext(ctx, query, suspendedAt, time.Now(), id))
+}
+
+// UpdateProfile changes the fields set in body. A new username leaves a redirect behind so
+// links to the old one keep working.
+func (u *User) UpdateProfile(id string, body *types.UpdateProfileBody) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var username string
+	if err = tx.QueryRowContext(ctx, "SELECT username FROM users WHERE id = $1 FOR UPDATE;", id).Scan(&username); err != nil {
+		return nil, err
+	}
+
+	if body.Username != nil && *body.Username != username {
+		_, err = tx.ExecContext(ctx, "DELETE FROM username_redirects WHERE old_username = $1;", *body.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		query := `
+			INSERT INTO username_redirects (old_username, user_id, created_at) VALUES ($1, $2, $3)
+			ON CONFLICT (old_username) DO UPDATE SET user_id = EXCLUDED.user_id, created_at = EXCLUDED.created_at;
+		`
+		if _, err = tx.ExecContext(ctx, query, username, id, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+		UPDATE users SET
+			username = COALESCE($1, username),
+			display_name = COALESCE($2, display_name),
+			bio = COALESCE($3, bio),
+			website = COALESCE($4, website),
+			avatar_override = COALESCE($5, avatar_override),
+			updated_at = $6
+		WHERE id = $7
+		RETURNING ` + userColumns + `;
+	`
+	row := tx.QueryRowContext(ctx, query, body.Username, body.DisplayName, body.Bio, body.Website,
+		body.Avatar, time.Now(), id)
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = commitUserEvent(ctx, tx, events.UserUpdated, id); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// commitUserEvent records an event about a user changing their own account in the outbox
+// and commits tx.
+func commitUserEvent(ctx context.Context, tx *sql.Tx, t, user_id string) error {
+	if err := recordEvent(ctx, tx, events.Event{Type: t, UserID: user_id, ActorID: user_id}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// GetProfile returns the public view of a user, only snippets anyone can see are counted.
+func (u *User) GetProfile(username string) (*types.Profile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	var profile types.Profile
+
+	query := `
+		SELECT
+			users.id, users.username, users.display_name, users.bio, users.website,
+			COALESCE(NULLIF(users.avatar_override, ''), users.avatar),
+			(SELECT count(*) FROM snippets
+				WHERE snippets.user_id = users.id AND snippets.is_public
+				AND snippets.hidden_at IS NULL AND snippets.quarantined_at IS NULL),
+			(SELECT count(*) FROM follows WHERE followee_id = users.id),
+			(SELECT count(*) FROM follows WHERE follower_id = users.id),
+			users.created_at
+		FROM users
+		WHERE users.username = $1;
+	`
+	err := db.QueryRowContext(ctx, query, username).Scan(
+		&profile.ID,
+		&profile.Username,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.Website,
+		&profile.Avatar,
+		&profile.SnippetCount,
+		&profile.FollowerCount,
+		&profile.FollowingCount,
+		&profile.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// GetUsernameRedirect returns the current username of whoever used to be old_username.
+func (u *User) GetUsernameRedirect(old_username string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	var username string
+
+	query := `
+		SELECT users.username
+		FROM username_redirects
+		INNER JOIN users ON users.id = username_redirects.user_id
+		WHERE username_redirects.old_username = $1;
+	`
+	if err := db.QueryRowContext(ctx, query, old_username).Scan(&username); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// userColumns is scanned by scanUser.
+const userColumns = `
+	id, username, email, avatar, display_name, bio, website, avatar_override, role, suspended_at,
+	created_at, updated_at
+`
+
+// prefixedUserColumns is userColumns for queries that join other tables.
+const prefixedUserColumns = `
+	users.id, users.username, users.email, users.avatar, users.display_name, users.bio, users.website,
+	users.avatar_override, users.role, users.suspended_at, users.created_at, users.updated_at
+`
+
+func scanUser(row scanner) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Avatar,
+		&user.DisplayName,
+		&user.Bio,
+		&user.Website,
+		&user.AvatarOverride,
+		&user.Role,
+		&user.SuspendedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,152 @@
+// Package webhook signs and sends webhook deliveries. Queueing and retrying them is up to
+// the caller, Backoff says when to try a failed delivery again.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// SignatureHeader carries "sha256=" followed by the hex HMAC-SHA256 of
+	// "<timestamp>.<body>" keyed with the webhook's secret.
+	SignatureHeader = "X-Snipnet-Signature"
+	// TimestampHeader is the unix time the delivery was signed at, receivers should refuse
+	// old ones so a captured delivery can't be replayed against them.
+	TimestampHeader = "X-Snipnet-Timestamp"
+	EventHeader     = "X-Snipnet-Event"
+	DeliveryHeader  = "X-Snipnet-Delivery"
+
+	// MaxAttempts is how many times a delivery is tried before it is given up on.
+	MaxAttempts = 8
+
+	// maxResponseBody is how much of the receiver's response is kept for the delivery log.
+	maxResponseBody = 1024
+)
+
+// ErrPrivateAddress is returned for webhook urls resolving to loopback, private or
+// link-local addresses, so webhooks can't be used to reach into our own network.
+var ErrPrivateAddress = errors.New("webhook address is not public")
+
+// Sign returns the value of SignatureHeader for body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks signature in constant time, it is what receivers are expected to do.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Backoff is how long to wait before the next try of a delivery that failed attempts times,
+// it doubles from 30 seconds up to 6 hours.
+func Backoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < 6*time.Hour; i++ {
+		wait *= 2
+	}
+	return min(wait, 6*time.Hour)
+}
+
+// Result of a single attempt. Status is 0 when no response was received.
+type Result struct {
+	Status   int
+	Body     string
+	Err      error
+	Duration time.Duration
+}
+
+// OK reports whether the receiver accepted the delivery.
+func (r Result) OK() bool {
+	return r.Err == nil && r.Status >= 200 && r.Status < 300
+}
+
+type Sender struct {
+	client *http.Client
+}
+
+// NewSender returns a Sender that gives up on receivers after timeout and doesn't follow
+// redirects. Unless allowPrivate is set, it refuses to connect to addresses that aren't
+// public, checked on the resolved address so DNS can't be used to get around it.
+func NewSender(timeout time.Duration, allowPrivate bool) *Sender {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !public(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	return &Sender{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: timeout,
+				MaxIdleConnsPerHost: 2,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func public(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Send POSTs body to url, signed with secret.
+func (s *Sender) Send(ctx context.Context, url, secret, event, delivery string, body []byte) Result {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: err}
+	}
+
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Snipnet-Webhooks/1.0")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, delivery)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return Result{Err: err, Duration: time.Since(start)}
+	}
+	defer res.Body.Close()
+
+	b, _ := io.ReadAll(io.LimitReader(res.Body, maxResponseBody))
+	result := Result{Status: res.StatusCode, Body: strings.ToValidUTF8(string(b), ""), Duration: time.Since(start)}
+	if !result.OK() {
+		result.Err = fmt.Errorf("receiver responded with %d", res.StatusCode)
+	}
+	return result
+}
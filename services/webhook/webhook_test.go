@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"event":"snippet.created"}`)
+	sig := Sign("secret", 1700000000, body)
+
+	if !Verify("secret", 1700000000, body, sig) {
+		t.Errorf("expected %s to verify", sig)
+	}
+	if Verify("other", 1700000000, body, sig) {
+		t.Error("expected a different secret to fail")
+	}
+	if Verify("secret", 1700000001, body, sig) {
+		t.Error("expected a different timestamp to fail")
+	}
+	if Verify("secret", 1700000000, []byte(`{"event":"snippet.deleted"}`), sig) {
+		t.Error("expected a different body to fail")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		8:  64 * time.Minute,
+		20: 6 * time.Hour,
+	}
+	for attempts, want := range tests {
+		if got := Backoff(attempts); got != want {
+			t.Errorf("Backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	body := []byte(`{"id":"1","event":"ping"}`)
+	status := http.StatusInternalServerError
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		if !Verify("secret", timestamp, got, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(EventHeader) != "ping" || r.Header.Get(DeliveryHeader) != "d1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("thanks"))
+	}))
+	defer receiver.Close()
+
+	sender := NewSender(time.Second, true)
+
+	res := sender.Send(context.Background(), receiver.URL, "secret", "ping", "d1", body)
+	if res.OK() || res.Status != http.StatusInternalServerError || res.Err == nil {
+		t.Errorf("expected a failed delivery, got %+v", res)
+	}
+
+	status = http.StatusOK
+	res = sender.Send(context.Background(), receiver.URL, "secret", "ping", "d1", body)
+	if !res.OK() || res.Body != "thanks" {
+		t.Errorf("expected a successful delivery, got %+v", res)
+	}
+
+	res = sender.Send(context.Background(), receiver.URL, "wrong", "ping", "d1", body)
+	if res.Status != http.StatusUnauthorized {
+		t.Errorf("expected the receiver to refuse a bad signature, got %+v", res)
+	}
+}
+
+func TestSendRefusesPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("receiver on loopback should not be reached")
+	}))
+	defer receiver.Close()
+
+	res := NewSender(time.Second, false).Send(context.Background(), receiver.URL, "secret", "ping", "d1", []byte("{}"))
+	if !errors.Is(res.Err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %+v", res)
+	}
+}
@@ -0,0 +1,491 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"snipnet/events"
+	"snipnet/services/webhook"
+	"snipnet/types"
+)
+
+// WebhookEvents are the events webhooks can subscribe to.
+var WebhookEvents = []string{
+	events.SnippetCreated,
+	events.SnippetUpdated,
+	events.SnippetDeleted,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+
+	// WebhookPing is the event of the test deliveries sent by Ping.
+	WebhookPing = "ping"
+)
+
+const (
+	// webhookPoll is how often the queue is checked for deliveries that are due.
+	webhookPoll = 5 * time.Second
+	// webhookLease is how long a claimed delivery is held back from other workers, it is
+	// retried after that if the worker claiming it went away.
+	webhookLease = time.Minute
+	webhookBatch = 20
+)
+
+type WebhookStore interface {
+	CreateWebhook(hook *types.Webhook) (*types.Webhook, error)
+	GetWebhook(id string) (*types.Webhook, error)
+	GetUserWebhooks(user_id string) (*[]*types.Webhook, error)
+	GetOrgWebhooks(org_id string) (*[]*types.Webhook, error)
+	UpdateWebhook(id string, body *types.UpdateWebhookBody) (*types.Webhook, error)
+	DeleteWebhook(id string) error
+	Enqueue(ctx context.Context, event events.Event) error
+	Ping(ctx context.Context, id string) (*types.WebhookDelivery, error)
+	GetDeliveries(webhook_id string, offset, limit int) (*[]*types.WebhookDelivery, error)
+	Redeliver(webhook_id, delivery_id string) (*types.WebhookDelivery, error)
+}
+
+type Webhooks struct {
+	snippets SnippetStore
+	sender   *webhook.Sender
+}
+
+func NewWebhooks(snippets SnippetStore, sender *webhook.Sender) *Webhooks {
+	return &Webhooks{snippets: snippets, sender: sender}
+}
+
+const webhookColumns = "id, user_id, org_id, url, events, active, created_at, updated_at"
+
+func scanWebhook(row scanner) (*types.Webhook, error) {
+	var hook types.Webhook
+	err := row.Scan(
+		&hook.ID,
+		&hook.UserID,
+		&hook.OrgID,
+		&hook.URL,
+		pq.Array(&hook.Events),
+		&hook.Active,
+		&hook.CreatedAt,
+		&hook.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+const deliveryColumns = `id, webhook_id, event, payload, status, attempts, next_attempt_at, response_status,
+	response_body, error, duration_ms, created_at, last_attempt_at`
+
+func scanDelivery(row scanner) (*types.WebhookDelivery, error) {
+	var delivery types.WebhookDelivery
+	var payload []byte
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.ResponseStatus,
+		&delivery.ResponseBody,
+		&delivery.Error,
+		&delivery.DurationMS,
+		&delivery.CreatedAt,
+		&delivery.LastAttemptAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Payload = payload
+	return &delivery, nil
+}
+
+// CreateWebhook stores hook along with its secret, which is never returned again.
+func (wh *Webhooks) CreateWebhook(hook *types.Webhook) (*types.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	query := `
+		INSERT INTO webhooks (id, user_id, org_id, url, secret, events, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, TRUE, $7, $7)
+		RETURNING ` + webhookColumns + `;`
+	created, err := scanWebhook(db.QueryRowContext(ctx, query, hook.ID, hook.UserID, hook.OrgID, hook.URL,
+		hook.Secret, pq.Array(hook.Events), now))
+	if err != nil {
+		return nil, err
+	}
+	created.Secret = hook.Secret
+	return created, nil
+}
+
+func (wh *Webhooks) GetWebhook(id string) (*types.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE id = $1;"
+	return scanWebhook(db.QueryRowContext(ctx, query, id))
+}
+
+func (wh *Webhooks) GetUserWebhooks(user_id string) (*[]*types.Webhook, error) {
+	return wh.getWebhooks("user_id", user_id)
+}
+
+func (wh *Webhooks) GetOrgWebhooks(org_id string) (*[]*types.Webhook, error) {
+	return wh.getWebhooks("org_id", org_id)
+}
+
+// getWebhooks lists the webhooks of an owner, column is one of user_id or org_id.
+func (wh *Webhooks) getWebhooks(column, owner string) (*[]*types.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	hooks := []*types.Webhook{}
+
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE " + column + " = $1 ORDER BY created_at DESC;"
+	row, err := db.QueryContext(ctx, query, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		hook, err := scanWebhook(row)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return &hooks, nil
+}
+
+// UpdateWebhook leaves the fields that aren't set in body as they are.
+func (wh *Webhooks) UpdateWebhook(id string, body *types.UpdateWebhookBody) (*types.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var hookEvents any
+	if body.Events != nil {
+		hookEvents = pq.Array(*body.Events)
+	}
+
+	query := `
+		UPDATE webhooks
+		SET url = COALESCE($2, url), events = COALESCE($3, events), active = COALESCE($4, active), updated_at = $5
+		WHERE id = $1
+		RETURNING ` + webhookColumns + `;`
+	return scanWebhook(db.QueryRowContext(ctx, query, id, body.URL, hookEvents, body.Active, time.Now()))
+}
+
+// DeleteWebhook returns sql.ErrNoRows when there is no webhook with that id, its
+// deliveries go with it.
+func (wh *Webhooks) DeleteWebhook(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return execOne(ctx, "DELETE FROM webhooks WHERE id = $1;", id)
+}
+
+// Enqueue is an events.Handler. It queues a delivery of the event for every active webhook
+// of the snippet's owner, and of the org it belongs to, that subscribed to it.
+// An event handed out again by the outbox is only queued for the webhooks that don't have
+// it yet.
+func (wh *Webhooks) Enqueue(ctx context.Context, event events.Event) error {
+	if !slices.Contains(WebhookEvents, event.Type) || event.SnippetID == "" {
+		return nil
+	}
+
+	user_id, org_id := event.UserID, event.OrgID
+	var data any = map[string]string{"id": event.SnippetID}
+	if event.Type != events.SnippetDeleted {
+		snippet, err := wh.snippets.GetSnippet(event.SnippetID)
+		if err == sql.ErrNoRows {
+			// deleted in the meantime, its snippet.deleted event is on the way
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		user_id, org_id = snippet.UserID, ""
+		if snippet.OrgID != nil {
+			org_id = *snippet.OrgID
+		}
+		// org webhooks may point anywhere, the author's email stays with us
+		snippet.Email = ""
+		data = snippet
+	}
+
+	payload, err := json.Marshal(types.WebhookPayload{ID: event.ID, Event: event.Type, At: event.At, Data: data})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT id FROM webhooks
+		WHERE active AND $1 = ANY(events) AND (user_id = $2 OR org_id = $3);
+	`
+	row, err := tx.QueryContext(ctx, query, event.Type, user_id, nullable(org_id))
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for row.Next() {
+		var id string
+		if err = row.Scan(&id); err != nil {
+			row.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query = `
+		INSERT INTO webhook_deliveries (id, webhook_id, event_id, event, payload, status, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		ON CONFLICT (webhook_id, event_id) DO NOTHING;
+	`
+	for _, id := range ids {
+		_, err = tx.ExecContext(ctx, query, uuid.NewString(), id, event.ID, event.Type, payload, DeliveryPending, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Ping sends a test delivery to the webhook right away, whether it is active or not. It
+// isn't retried, the result is in the returned delivery.
+func (wh *Webhooks) Ping(ctx context.Context, id string) (*types.WebhookDelivery, error) {
+	payload, err := json.Marshal(types.WebhookPayload{
+		ID:    uuid.NewString(),
+		Event: WebhookPing,
+		At:    time.Now(),
+		Data:  map[string]string{"webhook_id": id},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dbCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var url, secret string
+	err = db.QueryRowContext(dbCtx, "SELECT url, secret FROM webhooks WHERE id = $1;", id).Scan(&url, &secret)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery_id := uuid.NewString()
+	query := `
+		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, attempts, created_at)
+		VALUES ($1, $2, $3, $4, $5, 1, $6);
+	`
+	_, err = db.ExecContext(dbCtx, query, delivery_id, id, WebhookPing, payload, DeliveryPending, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	result := wh.sender.Send(ctx, url, secret, WebhookPing, delivery_id, payload)
+	if err = wh.record(delivery_id, 1, result, false); err != nil {
+		return nil, err
+	}
+	return wh.getDelivery(id, delivery_id)
+}
+
+func (wh *Webhooks) getDelivery(webhook_id, id string) (*types.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE id = $1 AND webhook_id = $2;"
+	return scanDelivery(db.QueryRowContext(ctx, query, id, webhook_id))
+}
+
+// GetDeliveries is the delivery log of a webhook, newest first.
+func (wh *Webhooks) GetDeliveries(webhook_id string, offset, limit int) (*[]*types.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	deliveries := []*types.WebhookDelivery{}
+
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+		OFFSET $3;
+	`
+	row, err := db.QueryContext(ctx, query, webhook_id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		delivery, err := scanDelivery(row)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return &deliveries, nil
+}
+
+// Redeliver queues the payload of a past delivery again as a new delivery, receivers can
+// tell it is a replay by the payload's id. It returns sql.ErrNoRows when the webhook has
+// no such delivery.
+func (wh *Webhooks) Redeliver(webhook_id, delivery_id string) (*types.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	query := `
+		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, next_attempt_at, created_at)
+		SELECT $1, webhook_id, event, payload, $2, $3, $3
+		FROM webhook_deliveries
+		WHERE id = $4 AND webhook_id = $5
+		RETURNING ` + deliveryColumns + `;`
+	return scanDelivery(db.QueryRowContext(ctx, query, uuid.NewString(), DeliveryPending, now, delivery_id, webhook_id))
+}
+
+// Run delivers queued deliveries until ctx is done. Any number of instances can run it,
+// each delivery is claimed by one of them at a time.
+func (wh *Webhooks) Run(ctx context.Context, log *slog.Logger) {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			n, err := wh.deliverDue(ctx)
+			if err != nil {
+				log.Error("WEBHOOKS", slog.String("Unable to deliver webhooks", err.Error()))
+			}
+			if err != nil || n < webhookBatch {
+				break
+			}
+		}
+	}
+}
+
+type claimedDelivery struct {
+	id       string
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverDue sends a batch of the deliveries that are due and returns how many it claimed.
+func (wh *Webhooks) deliverDue(ctx context.Context) (int, error) {
+	dbCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	query := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = $1, attempts = d.attempts + 1
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt_at <= $3
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret;
+	`
+	row, err := db.QueryContext(dbCtx, query, now.Add(webhookLease), DeliveryPending, now, webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+	claimed := []claimedDelivery{}
+	for row.Next() {
+		var d claimedDelivery
+		if err = row.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			row.Close()
+			return 0, err
+		}
+		claimed = append(claimed, d)
+	}
+	row.Close()
+	if err = row.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range claimed {
+		result := wh.sender.Send(ctx, d.url, d.secret, d.event, d.id, d.payload)
+		if err = wh.record(d.id, d.attempts, result, true); err != nil {
+			return len(claimed), err
+		}
+	}
+	return len(claimed), nil
+}
+
+// record saves the outcome of an attempt. A failed delivery is scheduled again with
+// webhook.Backoff when retry is set, until it runs out of attempts.
+func (wh *Webhooks) record(id string, attempts int, result webhook.Result, retry bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	status := DeliverySucceeded
+	var next *time.Time
+	var errMsg *string
+	if !result.OK() {
+		status = DeliveryFailed
+		msg := result.Err.Error()
+		errMsg = &msg
+		if retry && attempts < webhook.MaxAttempts {
+			status = DeliveryPending
+			at := now.Add(webhook.Backoff(attempts))
+			next = &at
+		}
+	}
+
+	var responseStatus *int
+	if result.Status != 0 {
+		responseStatus = &result.Status
+	}
+
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, next_attempt_at = $3, response_status = $4, response_body = $5, error = $6,
+			duration_ms = $7, last_attempt_at = $8
+		WHERE id = $1;
+	`
+	_, err := db.ExecContext(ctx, query, id, status, next, responseStatus, result.Body, errMsg,
+		result.Duration.Milliseconds(), now)
+	return err
+}
@@ -1,27 +1,312 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Session struct {
-	UserID     string
-	SessionID  string
-	CreatedAt  time.Time
-	ExpiryTime time.Time
+	// ID identifies the session in listings, SessionID is the secret bearer token.
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	SessionID  string    `json:"-"`
+	FamilyID   string    `json:"family_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	ExpiryTime time.Time `json:"expiry_time"`
+	Current    bool      `json:"current,omitempty"`
+	// Scopes is only set when the request was authenticated with a personal
+	// access token, browser sessions are not restricted.
+	Scopes []string `json:"-"`
+	// Role is loaded from the user on every request so role changes apply immediately.
+	Role string `json:"-"`
+	// RefreshToken is only set on a newly issued session, it is never stored.
+	RefreshToken string `json:"-"`
+}
+
+// HasScope reports whether the session is allowed to act on the given scope.
+func (s Session) HasScope(scope string) bool {
+	if s.Scopes == nil {
+		return true
+	}
+	for _, sc := range s.Scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingScope returns the first of scopes the session isn't allowed to act on, or "" when
+// it has all of them.
+func (s Session) MissingScope(scopes []string) string {
+	for _, scope := range scopes {
+		if !s.HasScope(scope) {
+			return scope
+		}
+	}
+	return ""
 }
 
 type SnippetWithUser struct {
-	ID          string    `json:"id"`
-	UserID      string    `json:"user_id"`
-	Title       string    `json:"title" validate:"required"`
-	Description string    `json:"description" validate:"required"`
-	Language    string    `json:"language" validate:"required"`
-	Code        string    `json:"code" validate:"required"`
-	IsPublic    string    `json:"is_public" validate:"type=bool"`
+	ID          string  `json:"id"`
+	UserID      string  `json:"user_id"`
+	OrgID       *string `json:"org_id"`
+	Title       string  `json:"title" validate:"required"`
+	Description string  `json:"description" validate:"required"`
+	Language    string  `json:"language" validate:"required"`
+	Code        string  `json:"code" validate:"required"`
+	IsPublic    string  `json:"is_public" validate:"type=bool"`
+	// Visibility is one of public, org or private.
+	Visibility string `json:"visibility"`
+	// Hidden snippets have been taken down by a moderator, Notice tells their author so.
+	Hidden bool `json:"hidden"`
+	// Quarantined snippets scored as spam and aren't public until a moderator releases them.
+	Quarantined bool      `json:"quarantined"`
+	Notice      string    `json:"notice,omitempty"`
 	Username    string    `json:"username" validate:"required"`
 	Email       string    `json:"email" validate:"required,email"`
-	Avatar      string    `json:"avatar`
+	Avatar      string    `json:"avatar"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	// Version goes up with every change, the snippet's ETag is made from it.
+	Version int `json:"version"`
+}
+
+// Identity links a user to an account on an OAuth identity provider.
+type Identity struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Avatar    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrgMember struct {
+	OrgID     string    `json:"org_id"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username,omitempty"`
+	Avatar    string    `json:"avatar,omitempty"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrgInvite struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	OrgSlug   string    `json:"org_slug,omitempty"`
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Collaborator is a user a snippet has been shared with.
+type Collaborator struct {
+	SnippetID  string    `json:"snippet_id"`
+	UserID     string    `json:"user_id"`
+	Username   string    `json:"username"`
+	Avatar     string    `json:"avatar"`
+	Permission string    `json:"permission"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type CollaboratorBody struct {
+	Username   string `json:"username" validate:"required"`
+	Permission string `json:"permission" validate:"required,oneof=read write"`
+}
+
+type Report struct {
+	ID           string     `json:"id"`
+	SnippetID    string     `json:"snippet_id"`
+	SnippetTitle string     `json:"snippet_title,omitempty"`
+	AuthorID     string     `json:"author_id,omitempty"`
+	ReporterID   *string    `json:"reporter_id"`
+	Reason       string     `json:"reason"`
+	Details      string     `json:"details"`
+	Status       string     `json:"status"`
+	ResolvedBy   *string    `json:"resolved_by"`
+	ResolvedAt   *time.Time `json:"resolved_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// SpamScore is the breakdown of one spam check of a snippet.
+type SpamScore struct {
+	ID          string          `json:"id"`
+	SnippetID   string          `json:"snippet_id"`
+	Score       float64         `json:"score"`
+	Signals     json.RawMessage `json:"signals" swaggertype:"array,object"`
+	Quarantined bool            `json:"quarantined"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+type ReportBody struct {
+	Reason  string `json:"reason" validate:"required,oneof=spam abuse malware copyright other"`
+	Details string `json:"details" validate:"max=1000"`
+}
+
+type ModerationBody struct {
+	Note string `json:"note" validate:"max=1000"`
+}
+
+// AuditEntry records a decision a moderator made.
+type AuditEntry struct {
+	ID          string    `json:"id"`
+	ModeratorID string    `json:"moderator_id"`
+	Action      string    `json:"action"`
+	ReportID    *string   `json:"report_id"`
+	SnippetID   *string   `json:"snippet_id"`
+	UserID      *string   `json:"user_id"`
+	Note        string    `json:"note"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type InviteBody struct {
+	Username string `json:"username" validate:"required"`
+	Role     string `json:"role" validate:"required,oneof=owner maintainer member"`
+}
+
+// Profile is the public view of a user.
+type Profile struct {
+	ID             string    `json:"id"`
+	Username       string    `json:"username"`
+	DisplayName    string    `json:"display_name"`
+	Bio            string    `json:"bio"`
+	Website        string    `json:"website"`
+	Avatar         string    `json:"avatar"`
+	SnippetCount   int       `json:"snippet_count"`
+	FollowerCount  int       `json:"follower_count"`
+	FollowingCount int       `json:"following_count"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Follow is a user in a followers or following list.
+type Follow struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	Avatar      string    `json:"avatar"`
+	FollowedAt  time.Time `json:"followed_at"`
+}
+
+const (
+	FeedSnippetCreated = "snippet_created"
+	FeedSnippetUpdated = "snippet_updated"
+)
+
+type FeedItem struct {
+	Type    string           `json:"type"`
+	At      time.Time        `json:"at"`
+	Snippet *SnippetWithUser `json:"snippet"`
+}
+
+// Feed is a page of the feed, NextCursor is empty on the last page.
+type Feed struct {
+	Items      []*FeedItem `json:"items"`
+	NextCursor string      `json:"next_cursor"`
+}
+
+// UpdateProfileBody only changes the fields that are set, an empty string clears a field.
+type UpdateProfileBody struct {
+	Username    *string `json:"username" validate:"omitempty,min=1,max=39"`
+	DisplayName *string `json:"display_name" validate:"omitempty,max=50"`
+	Bio         *string `json:"bio" validate:"omitempty,max=300"`
+	Website     *string `json:"website" validate:"omitempty,max=200,http_url"`
+	Avatar      *string `json:"avatar" validate:"omitempty,max=500,http_url"`
+}
+
+type Notification struct {
+	ID            string     `json:"id"`
+	Type          string     `json:"type"`
+	ActorID       *string    `json:"actor_id"`
+	ActorUsername *string    `json:"actor_username"`
+	SnippetID     *string    `json:"snippet_id"`
+	SnippetTitle  *string    `json:"snippet_title"`
+	OrgID         *string    `json:"org_id"`
+	OrgSlug       *string    `json:"org_slug"`
+	ReadAt        *time.Time `json:"read_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type Notifications struct {
+	Notifications []*Notification `json:"notifications"`
+	Unread        int             `json:"unread"`
+}
+
+// StreamMessage is sent to clients listening for live updates, Event names the kind of
+// Data so clients can tell notifications from snippet changes.
+type StreamMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data" swaggertype:"object"`
+}
+
+// SnippetChange tells viewers of a snippet that it changed, they fetch it again to see how.
+type SnippetChange struct {
+	Type      string    `json:"type"`
+	SnippetID string    `json:"snippet_id"`
+	ActorID   string    `json:"actor_id"`
+	At        time.Time `json:"at"`
+}
+
+// NotificationPreferences maps a notification type to whether the user receives it.
+type NotificationPreferences map[string]bool
+
+// Webhook is owned by either a user or an org, it receives the events of the snippets they
+// own. Secret is only returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	UserID    *string   `json:"user_id"`
+	OrgID     *string   `json:"org_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreateWebhookBody struct {
+	URL    string   `json:"url" validate:"required,max=2000,http_url"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=snippet.created snippet.updated snippet.deleted"`
+}
+
+// UpdateWebhookBody only changes the fields that are set.
+type UpdateWebhookBody struct {
+	URL    *string   `json:"url" validate:"omitempty,max=2000,http_url"`
+	Events *[]string `json:"events" validate:"omitempty,min=1,dive,oneof=snippet.created snippet.updated snippet.deleted"`
+	Active *bool     `json:"active"`
+}
+
+// WebhookPayload is the body of every delivery. ID stays the same when a delivery is
+// replayed, so receivers can use it to skip events they have already handled.
+type WebhookPayload struct {
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	At    time.Time `json:"at"`
+	Data  any       `json:"data"`
+}
+
+// WebhookDelivery is an entry of a webhook's delivery log. Status is pending until the
+// receiver accepts it, or failed once every attempt has been used up.
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	WebhookID      string          `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload" swaggertype:"object"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	ResponseStatus *int            `json:"response_status"`
+	ResponseBody   *string         `json:"response_body"`
+	Error          *string         `json:"error"`
+	DurationMS     *int64          `json:"duration_ms"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
 }
 
 type Plan struct {
@@ -80,6 +365,97 @@ type UpdateOneData struct {
 	Value string `json:"value" validate:"required"`
 }
 
+// BatchOperation is one operation of a snippet batch. ID is the snippet it is about, for
+// every operation but create. An update only changes the fields that are set, a visibility
+// change only is_public.
+type BatchOperation struct {
+	Op           string   `json:"op" validate:"required"`
+	ID           string   `json:"id"`
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	Language     *string  `json:"language"`
+	Code         *string  `json:"code"`
+	IsPublic     *bool    `json:"is_public"`
+	OrgID        *string  `json:"org_id"`
+	Tags         []string `json:"tags"`
+	CollectionID string   `json:"collection_id"`
+}
+
+type BatchBody struct {
+	// Atomic batches are applied in full or not at all, otherwise each operation is applied
+	// on its own.
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations" validate:"required,min=1,max=100,dive"`
+}
+
+// BatchResult is the outcome of the operation at Index, Status is the HTTP status the
+// operation would have had on its own.
+type BatchResult struct {
+	Index    int         `json:"index"`
+	Op       string      `json:"op"`
+	ID       string      `json:"id,omitempty"`
+	Status   int         `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Snippet  interface{} `json:"snippet,omitempty"`
+	Warnings interface{} `json:"warnings,omitempty"`
+}
+
+type BatchResponse struct {
+	Atomic  bool          `json:"atomic"`
+	Applied int           `json:"applied"`
+	Failed  int           `json:"failed"`
+	Results []BatchResult `json:"results"`
+}
+
+// SnippetFields are the fields of a snippet that can be patched, merge and JSON patches are
+// applied to them as a JSON document.
+type SnippetFields struct {
+	Title       string `json:"title" validate:"required"`
+	Description string `json:"description" validate:"required"`
+	Language    string `json:"language" validate:"required"`
+	Code        string `json:"code" validate:"required"`
+	IsPublic    *bool  `json:"is_public" validate:"required"`
+}
+
 type OauthReqBody struct{}
 
+type UpdateRoleBody struct {
+	Role string `json:"role" validate:"required"`
+}
+
+type UpdateOrgBody struct {
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description"`
+}
+
+type RefreshTokenBody struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type AuthTokens struct {
+	AuthToken    string    `json:"auth_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiryTime   time.Time `json:"expiry_time"`
+}
+
+// StreamTicket stands in for the Authorization header on the WebSocket and event stream
+// routes, it is passed in the ticket query parameter.
+type StreamTicket struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 const AuthSession = "AuthSession"
+
+const (
+	ScopeSnippetsRead  = "snippets:read"
+	ScopeSnippetsWrite = "snippets:write"
+	ScopeUserRead      = "user:read"
+	ScopeUserWrite     = "user:write"
+)
+
+type CreateTokenBody struct {
+	Name      string     `json:"name" validate:"required"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,oneof=snippets:read snippets:write user:read user:write"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
@@ -0,0 +1,27 @@
+package types
+
+import "testing"
+
+func TestMissingScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		session Session
+		scopes  []string
+		want    string
+	}{
+		{"token without the scope", Session{Scopes: []string{ScopeUserWrite}}, []string{ScopeSnippetsWrite}, ScopeSnippetsWrite},
+		{"token with every scope", Session{Scopes: []string{ScopeUserWrite, ScopeSnippetsWrite}}, []string{ScopeSnippetsWrite, ScopeUserWrite}, ""},
+		{"token with some of them", Session{Scopes: []string{ScopeUserWrite}}, []string{ScopeUserWrite, ScopeSnippetsRead}, ScopeSnippetsRead},
+		{"token without scopes", Session{Scopes: []string{}}, []string{ScopeUserRead}, ScopeUserRead},
+		{"browser session", Session{}, []string{ScopeSnippetsWrite, ScopeUserWrite}, ""},
+		{"nothing asked", Session{Scopes: []string{}}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.session.MissingScope(tt.scopes); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}